@@ -0,0 +1,218 @@
+// Package acl implements access policies: principals are granted roles, and
+// roles are lists of rules allowing actions on topics (and, for consuming, on
+// consumer names) matching patterns.
+package acl
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+const (
+	Produce = "produce"
+	Consume = "consume"
+	Admin   = "admin" // implies produce and consume
+	// principal of requests made with node credentials, and of all requests
+	// when authentication is disabled; it is allowed everything
+	Node = "_node"
+	// set by the authorizer to the principal of the request's token;
+	// requests made with node credentials may set it to act on behalf of
+	// a principal
+	PrincipalHeader = "Hbuf-Principal"
+)
+
+var log = logger.New("acl")
+
+// Rule allows Actions on topics with names matching any of Topics, and, for
+// consuming, with consumer names matching any of Consumers. Patterns are as
+// in path.Match, so "*" matches any name, and "b-*" any name starting with
+// "b-". Actions not tied to a topic, such as listing workers, are checked
+// against topic "", matched only by "*".
+type Rule struct {
+	Topics    []string `json:"topics"`
+	Consumers []string `json:"consumers,omitempty"` // any consumer when empty
+	Actions   []string `json:"actions"`
+}
+
+// Policy maps principals to roles, and roles to rules. Principals with no
+// roles are allowed nothing.
+type Policy struct {
+	Roles      map[string][]*Rule  `json:"roles"`
+	Principals map[string][]string `json:"principals"`
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		Roles:      make(map[string][]*Rule),
+		Principals: make(map[string][]string),
+	}
+}
+
+func validPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Validate() error {
+	//
+	if len(r.Topics) == 0 {
+		return fmt.Errorf("rule must have topic patterns")
+	}
+	if err := validPatterns(r.Topics); err != nil {
+		return err
+	}
+	if err := validPatterns(r.Consumers); err != nil {
+		return err
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("rule must have actions")
+	}
+	for _, a := range r.Actions {
+		switch a {
+		case Produce, Consume, Admin:
+		default:
+			return fmt.Errorf("unknown action %q", a)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) Validate() error {
+	//
+	if p.Roles == nil {
+		p.Roles = make(map[string][]*Rule)
+	}
+	if p.Principals == nil {
+		p.Principals = make(map[string][]string)
+	}
+	for name, rules := range p.Roles {
+		for _, r := range rules {
+			if r == nil {
+				return fmt.Errorf("role %q: empty rule", name)
+			}
+			if err := r.Validate(); err != nil {
+				return fmt.Errorf("role %q: %v", name, err)
+			}
+		}
+	}
+	for principal, roles := range p.Principals {
+		if principal == Node {
+			return fmt.Errorf("principal %q is reserved", Node)
+		}
+		for _, r := range roles {
+			if _, ok := p.Roles[r]; !ok {
+				return fmt.Errorf("principal %q: no role %q", principal, r)
+			}
+		}
+	}
+	return nil
+}
+
+func match(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) allows(action, topic, consumer string) bool {
+	//
+	ok := false
+	for _, a := range r.Actions {
+		ok = ok || a == action || a == Admin
+	}
+	if !ok || !match(r.Topics, topic) {
+		return false
+	}
+	if action == Consume && len(r.Consumers) > 0 {
+		return match(r.Consumers, consumer)
+	}
+	return true
+}
+
+// Allowed is true if principal may do action on topic; consumer is the
+// consumer name when action is Consume.
+func (p *Policy) Allowed(principal, action, topic, consumer string) bool {
+	//
+	if principal == Node {
+		return true
+	}
+	for _, role := range p.Principals[principal] {
+		for _, r := range p.Roles[role] {
+			if r.allows(action, topic, consumer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Principal returns the principal of the request.
+func Principal(req *http.Request) string {
+	if p := req.Header.Get(PrincipalHeader); p != "" {
+		return p
+	}
+	return Node
+}
+
+// Resource returns the topics, and the consumer name, a request acts on.
+type Resource func(*http.Request) (topics []string, consumer string)
+
+// Topics is the Resource of routes with a "topic" variable, which may be a
+// comma separated list of topics, and a "consumer" variable or "c" query
+// parameter. Routes with no topic act on topic "".
+func Topics(req *http.Request) ([]string, string) {
+	//
+	topics := []string{""}
+	if t, ok := mux.Vars(req)["topic"]; ok {
+		topics = strings.Split(t, ",")
+	}
+	consumer := mux.Vars(req)["consumer"]
+	if consumer == "" {
+		consumer = req.URL.Query().Get("c")
+	}
+	if consumer == "" {
+		consumer = "-"
+	}
+	return topics, consumer
+}
+
+// Enforce wraps handler h so that it is called only if the request's
+// principal is allowed action on resource. The policy in effect is returned
+// by policy; when there is none, all principals are allowed if open is true,
+// and only Node otherwise. Denials are logged.
+func Enforce(policy func() *Policy, open bool, action string, resource Resource, h router.HandlerFunc) router.HandlerFunc {
+	return func(req *http.Request) *router.Response {
+		principal := Principal(req)
+		if principal == Node {
+			return h(req)
+		}
+		p := policy()
+		if p == nil && open {
+			return h(req)
+		}
+		topics, consumer := resource(req)
+		for _, t := range topics {
+			if p == nil || !p.Allowed(principal, action, t, consumer) {
+				log.Warnf("denied principal %q %s on topic %q: %s %s", principal, action, t, req.Method, req.URL.Path)
+				return &router.Response{
+					Error:      fmt.Errorf("principal %q is not allowed to %s on topic %q", principal, action, t),
+					StatusCode: http.StatusForbidden,
+				}
+			}
+		}
+		return h(req)
+	}
+}
@@ -0,0 +1,65 @@
+package acl
+
+import (
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	//
+	p := &Policy{
+		Roles: map[string][]*Rule{
+			"producer": {{Topics: []string{"orders"}, Actions: []string{Produce}}},
+			"consumer": {{Topics: []string{"orders"}, Consumers: []string{"b-*"}, Actions: []string{Consume}}},
+			"ops":      {{Topics: []string{"*"}, Actions: []string{Admin}}},
+		},
+		Principals: map[string][]string{
+			"a":   {"producer"},
+			"b":   {"consumer"},
+			"ops": {"ops"},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		principal string
+		action    string
+		topic     string
+		consumer  string
+		allowed   bool
+	}{
+		{"a", Produce, "orders", "", true},
+		{"a", Produce, "payments", "", false},
+		{"a", Consume, "orders", "-", false},
+		{"b", Consume, "orders", "b-1", true},
+		{"b", Consume, "orders", "c-1", false},
+		{"b", Produce, "orders", "", false},
+		{"ops", Admin, "orders", "", true},
+		{"ops", Consume, "orders", "x", true},
+		{"ops", Admin, "", "", true},
+		{"a", Admin, "", "", false},
+		{"x", Produce, "orders", "", false},
+		{Node, Admin, "", "", true},
+	}
+	for _, test := range tests {
+		if ok := p.Allowed(test.principal, test.action, test.topic, test.consumer); ok != test.allowed {
+			t.Errorf("%+v: got %v", test, ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	//
+	tests := []*Policy{
+		{Roles: map[string][]*Rule{"r": {{Topics: []string{"["}, Actions: []string{Produce}}}}},
+		{Roles: map[string][]*Rule{"r": {{Topics: []string{"*"}, Actions: []string{"fly"}}}}},
+		{Roles: map[string][]*Rule{"r": {{Topics: []string{"*"}}}}},
+		{Principals: map[string][]string{"a": {"missing"}}},
+		{Principals: map[string][]string{Node: {}}},
+	}
+	for i, p := range tests {
+		if err := p.Validate(); err == nil {
+			t.Errorf("expected error for policy %d", i)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package auth implements API tokens scoped to tenants, and node credentials
+// used by nodes to talk to each other.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/router"
+	"github.com/mkocikowski/hbuf/util"
+)
+
+var (
+	// how often stores get tokens from the controller; tokens revoked on
+	// one node keep working on others for up to this long
+	RefreshInterval = 5 * time.Second
+	// tokens not found in a store make it get tokens from the controller,
+	// no more often than this, so that tokens work on all nodes as soon as
+	// they are minted
+	MissRefreshInterval = 1 * time.Second
+)
+
+var (
+	ErrorNoToken      = fmt.Errorf("missing bearer token")
+	ErrorInvalidToken = fmt.Errorf("invalid token")
+)
+
+// Token is the stored form of an API token. The token itself is
+// "<id>.<secret>"; only the SHA-256 hash of the secret is stored.
+type Token struct {
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"` // see acl package
+	Hash      string    `json:"hash,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// Secret returns a random 256 bit secret, hex encoded.
+func Secret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewToken creates a new token for principal; when principal is empty, the
+// token's ID is used. The returned token string is not stored and can't be
+// recovered.
+func NewToken(principal string) (string, *Token, error) {
+	//
+	if principal == acl.Node {
+		return "", nil, fmt.Errorf("principal %q is reserved", acl.Node)
+	}
+	secret := Secret()
+	t := &Token{ID: util.Uid(), Principal: principal, Hash: hash(secret), Created: time.Now().UTC()}
+	if t.Principal == "" {
+		t.Principal = t.ID
+	}
+	if !util.PrincipalRE.MatchString(t.Principal) {
+		return "", nil, fmt.Errorf("principal must match %q", util.PrincipalRE)
+	}
+	return t.ID + "." + secret, t, nil
+}
+
+// Info returns copy of the token without the hash.
+func (t *Token) Info() *Token {
+	return &Token{ID: t.ID, Principal: t.Principal, Created: t.Created}
+}
+
+// Store holds the tokens of a tenant, as they are in the state of its
+// controller, for checking requests on the node. Tokens are got with get,
+// every RefreshInterval and when a token isn't found.
+type Store struct {
+	get     func() (map[string]*Token, error)
+	tokens  map[string]*Token
+	missed  time.Time // last refresh made because a token wasn't found
+	lock    *sync.Mutex
+	refresh *sync.Mutex // one refresh at a time, so that they apply in order
+}
+
+func NewStore(get func() (map[string]*Token, error)) *Store {
+	return &Store{
+		get:     get,
+		tokens:  make(map[string]*Token),
+		lock:    new(sync.Mutex),
+		refresh: new(sync.Mutex),
+	}
+}
+
+// Refresh gets the tokens.
+func (s *Store) Refresh() error {
+	//
+	s.refresh.Lock()
+	defer s.refresh.Unlock()
+	tokens, err := s.get()
+	if err != nil {
+		return fmt.Errorf("error getting tokens: %v", err)
+	}
+	s.lock.Lock()
+	s.tokens = tokens
+	s.lock.Unlock()
+	return nil
+}
+
+// lookup returns token id. When there is no such token it returns whether
+// to refresh, which it does no more often than MissRefreshInterval.
+func (s *Store) lookup(id string) (*Token, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.tokens[id]
+	if ok || time.Since(s.missed) < MissRefreshInterval {
+		return t, false
+	}
+	s.missed = time.Now()
+	return nil, true
+}
+
+// Check returns the stored token matching token string, or an error.
+func (s *Store) Check(token string) (*Token, error) {
+	//
+	p := strings.SplitN(token, ".", 2)
+	if len(p) != 2 {
+		return nil, ErrorInvalidToken
+	}
+	t, refresh := s.lookup(p[0])
+	if refresh && s.Refresh() == nil {
+		t, _ = s.lookup(p[0])
+	}
+	if t == nil || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash(p[1]))) != 1 {
+		return nil, ErrorInvalidToken
+	}
+	return t, nil
+}
+
+// Bearer returns the bearer token of the request, or "".
+func Bearer(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+// IsNode is true if the request carries node credentials.
+func IsNode(req *http.Request, nodeToken string) bool {
+	t := Bearer(req)
+	return t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(nodeToken)) == 1
+}
+
+func unauthorized(err error) *router.Response {
+	return &router.Response{Error: err, StatusCode: http.StatusUnauthorized}
+}
+
+// Node returns an authorizer allowing only requests with node credentials.
+func Node(nodeToken string) router.Authorizer {
+	return func(req *http.Request) *router.Response {
+		if IsNode(req, nodeToken) {
+			return nil
+		}
+		if Bearer(req) == "" {
+			return unauthorized(ErrorNoToken)
+		}
+		return &router.Response{Error: fmt.Errorf("node credentials required"), StatusCode: http.StatusForbidden}
+	}
+}
+
+// Tenant returns an authorizer allowing requests with node credentials, or
+// with a token of the tenant. The principal of the token is set on the
+// request, for handlers to check against the tenant's access policy; nodes
+// may set the principal they act on behalf of.
+func Tenant(nodeToken string, s *Store) router.Authorizer {
+	return func(req *http.Request) *router.Response {
+		if IsNode(req, nodeToken) {
+			return nil
+		}
+		req.Header.Del(acl.PrincipalHeader)
+		t := Bearer(req)
+		if t == "" {
+			return unauthorized(ErrorNoToken)
+		}
+		token, err := s.Check(t)
+		if err != nil {
+			return unauthorized(err)
+		}
+		req.Header.Set(acl.PrincipalHeader, token.Principal)
+		return nil
+	}
+}
@@ -6,13 +6,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mkocikowski/hbuf/codec"
+	"github.com/mkocikowski/hbuf/crypt"
+	"github.com/mkocikowski/hbuf/logger"
 	"github.com/mkocikowski/hbuf/message"
 	"github.com/mkocikowski/hbuf/segment"
 	"github.com/mkocikowski/hbuf/stats"
@@ -37,6 +41,15 @@ type Config struct {
 	MessageMaxBytes    int32 `json:"message_max_bytes"`
 	SegmentMaxBytes    int64 `json:"segment_max_bytes"`
 	SegmentMaxMessages int   `json:"segment_max_messages"`
+	// "body" or "record" to encrypt segments and consumer offsets with the
+	// tenant's keys, see crypt package; "" for no encryption
+	Encryption string `json:"encryption,omitempty"`
+	// name of the codec message bodies are compressed with before they are
+	// stored, see codec package; "" for no compression
+	Compression string `json:"compression,omitempty"`
+	// topic the buffer is created for, set by the controller; labels the
+	// buffer's metrics
+	Topic string `json:"topic,omitempty"`
 }
 
 func DefaultConfig() *Config {
@@ -49,41 +62,103 @@ func DefaultConfig() *Config {
 	}
 }
 
+func (c *Config) Validate() error {
+	switch {
+	case c.BufferMaxBytes <= 0:
+		return fmt.Errorf("buffer_max_bytes must be > 0")
+	case c.BufferMaxSegments <= 0:
+		return fmt.Errorf("buffer_max_segments must be > 0")
+	case c.MessageMaxBytes <= 0:
+		return fmt.Errorf("message_max_bytes must be > 0")
+	case c.SegmentMaxBytes <= 0:
+		return fmt.Errorf("segment_max_bytes must be > 0")
+	case c.SegmentMaxMessages <= 0:
+		return fmt.Errorf("segment_max_messages must be > 0")
+	case c.Encryption != "" && c.Encryption != crypt.ModeBody && c.Encryption != crypt.ModeRecord:
+		return fmt.Errorf("encryption must be %q, %q, or empty", crypt.ModeBody, crypt.ModeRecord)
+	}
+	if c.Compression != "" {
+		if _, err := codec.Get(c.Compression); err != nil {
+			return fmt.Errorf("compression: %v", err)
+		}
+	}
+	return nil
+}
+
+var (
+	writeLockWait  = stats.NewHistogram("buffer_write_lock_wait")
+	consumeLatency = stats.NewHistogram("buffer_consume")
+	consumeN       = stats.NewCounter("buffer_message_consume_n")
+	consumeB       = stats.NewCounter("buffer_message_consume_b")
+)
+
 var (
 	ErrorBufferClosed = fmt.Errorf("buffer closed")
+	ErrorBufferSealed = fmt.Errorf("buffer sealed")
+	ErrorMessageSize  = fmt.Errorf("message body larger than message_max_bytes")
 )
 
+// how long a buffer being stopped waits for its replicas to catch up
+var ReplicaStopTimeout = 10 * time.Second
+
 type Buffer struct {
 	*Config
 	ID         string `json:"id"`
 	URL        string `json:"url"`
 	Tenant     string `json:"tenant"`
 	Controller string `json:"-"`
-	Path       string `json:"dir"`
-	Len        int    `json:"len"`
-	sha        []byte
-	running    bool
-	replicas   map[string]*replica
-	consumers  map[string]*Consumer
-	segments   []*segment.Segment
-	lock       *sync.Mutex
+	// all controllers of the tenant, when the controller is replicated
+	Controllers []string `json:"-"`
+	Path        string   `json:"dir"`
+	// size of the segments of all buffers of the worker; changes in the size
+	// of the buffer are added to it
+	Used *int64 `json:"-"`
+	// keys of the tenant; required for encrypted buffers, and to read
+	// buffers restored from encrypted snapshots
+	Keys      *crypt.Keyring `json:"-"`
+	Len       int            `json:"len"`
+	Sealed    bool           `json:"sealed"`
+	sha       []byte
+	size      int64 // of segments, see SizeB
+	running   bool
+	replicas  map[string]*replica
+	consumers map[string]*Consumer
+	segments  []*segment.Segment
+	lock      *sync.Mutex
+	log       *logger.Logger
 }
 
 func (b *Buffer) Init() error {
 	//
-	if b.Config == nil {
-		b.Config = DefaultConfig()
-	}
 	b.lock = new(sync.Mutex)
+	b.log = logger.New("buffer").With("tenant", b.Tenant, "buffer", b.ID)
 	if err := os.MkdirAll(b.Path, 0755); err != nil {
 		return fmt.Errorf("error creating buffer dir: %v", err)
 	}
+	// config is given when the buffer is created, and read from disk when
+	// an existing buffer is opened
+	if b.Config == nil {
+		if err := b.loadConfig(); err != nil {
+			return fmt.Errorf("error loading config: %v", err)
+		}
+	} else if err := b.saveConfig(); err != nil {
+		return fmt.Errorf("error saving config: %v", err)
+	}
+	if b.Encryption != "" && b.Keys == nil {
+		return fmt.Errorf("buffer is encrypted, and no keys are configured")
+	}
 	if err := b.openSegments(); err != nil {
 		return fmt.Errorf("error opening segments: %v", err)
 	}
 	if err := b.loadConsumers(); err != nil {
 		return fmt.Errorf("error loading consumers: %v", err)
 	}
+	if _, err := os.Stat(filepath.Join(b.Path, "sealed")); err == nil {
+		b.Sealed = true
+	}
+	if b.Used != nil {
+		atomic.AddInt64(b.Used, b.size)
+	}
 	b.running = true
 	return nil
 }
@@ -105,11 +180,12 @@ func (b *Buffer) openSegments() error {
 	sort.Strings(segments)
 	for _, f := range segments {
 		p := filepath.Join(b.Path, f)
-		s, err := segment.Open(p)
+		s, err := segment.OpenWithKeys(p, b.Keys)
 		if err != nil {
 			return fmt.Errorf("error opening segment %q: %v", p, err)
 		}
 		b.segments = append(b.segments, s)
+		b.size += s.SizeB()
 	}
 	s := b.segments[len(b.segments)-1]
 	b.Len = s.First + s.Len()
@@ -121,6 +197,28 @@ func (b *Buffer) openSegments() error {
 	return nil
 }
 
+func (b *Buffer) loadConfig() error {
+	//
+	b.Config = DefaultConfig()
+	d, err := ioutil.ReadFile(filepath.Join(b.Path, "config"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config: %v", err)
+	}
+	if err := json.Unmarshal(d, b.Config); err != nil {
+		return fmt.Errorf("error parsing config: %v", err)
+	}
+	return nil
+}
+
+func (b *Buffer) saveConfig() error {
+	//
+	j, _ := json.Marshal(b.Config)
+	return ioutil.WriteFile(filepath.Join(b.Path, "config"), j, 0644)
+}
+
 func (b *Buffer) loadConsumers() error {
 	//
 	b.consumers = make(map[string]*Consumer)
@@ -132,6 +230,9 @@ func (b *Buffer) loadConsumers() error {
 	if err != nil {
 		return fmt.Errorf("error reading consumer offsets: %v", err)
 	}
+	if d, err = crypt.OpenFile(b.Keys, d); err != nil {
+		return fmt.Errorf("error decrypting consumer offsets: %v", err)
+	}
 	if err := json.Unmarshal(d, &b.consumers); err != nil {
 		return fmt.Errorf("error parsing consumer offsets: %v", err)
 	}
@@ -140,7 +241,10 @@ func (b *Buffer) loadConsumers() error {
 
 func (b *Buffer) saveConsumers() error {
 	//
-	j, _ := json.Marshal(b.consumers)
+	j, err := b.sealOffsets()
+	if err != nil {
+		return fmt.Errorf("error encrypting consumer offsets: %v", err)
+	}
 	f := filepath.Join(b.Path, "offsets")
 	if err := ioutil.WriteFile(f, j, 0644); err != nil {
 		return fmt.Errorf("error saving consumer offsets: %v", err)
@@ -148,6 +252,17 @@ func (b *Buffer) saveConsumers() error {
 	return nil
 }
 
+// sealOffsets returns consumer offsets as written to disk: encrypted if the
+// buffer is. Must be called with the lock held.
+func (b *Buffer) sealOffsets() ([]byte, error) {
+	//
+	j, _ := json.Marshal(b.consumers)
+	if b.Encryption == "" {
+		return j, nil
+	}
+	return b.Keys.SealFile(j)
+}
+
 func (b *Buffer) Consumers() []byte {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -155,43 +270,205 @@ func (b *Buffer) Consumers() []byte {
 	return j
 }
 
+// SetTopic sets the topic of a restored buffer, which may be restored to a
+// topic other than the one it was archived from. Must be called before the
+// buffer is in use.
+func (b *Buffer) SetTopic(topic string) error {
+	//
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Topic = topic
+	if err := b.saveConfig(); err != nil {
+		return fmt.Errorf("error saving config: %v", err)
+	}
+	return nil
+}
+
+// Seal makes the buffer read-only. Reads, consumes, and replication of data
+// already in the buffer are not affected. The sealed state is persisted as an
+// empty "sealed" file in the buffer's directory.
+func (b *Buffer) Seal() error {
+	//
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f := filepath.Join(b.Path, "sealed")
+	if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+		return fmt.Errorf("error sealing buffer: %v", err)
+	}
+	b.Sealed = true
+	return nil
+}
+
+func (b *Buffer) Unseal() error {
+	//
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f := filepath.Join(b.Path, "sealed")
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error unsealing buffer: %v", err)
+	}
+	b.Sealed = false
+	return nil
+}
+
+// SetReplicas sets the replicas to which the buffer's data is pushed.
+// Replicas not in the list are stopped and removed.
 func (b *Buffer) SetReplicas(replicas []string) {
 	//
 	if b.replicas == nil {
 		b.replicas = make(map[string]*replica)
 	}
+	keep := make(map[string]bool)
 	for _, r := range replicas {
-		if _, ok := b.replicas[r]; ok {
+		keep[r] = true
+		b.lock.Lock()
+		_, ok := b.replicas[r]
+		b.lock.Unlock()
+		if ok {
 			continue
 		}
-		n := &replica{ID: r, manager: b.Controller, buffer: b}
+		n := &replica{ID: r, managers: b.controllers(), buffer: b}
 		n.Init()
 		b.lock.Lock()
 		b.replicas[r] = n
 		b.lock.Unlock()
-		log.Printf("set replica %q for buffer %q", n.ID, b.ID)
+		b.log.Infof("set replica %q for buffer %q", n.ID, b.ID)
+	}
+	b.lock.Lock()
+	removed := make([]*replica, 0)
+	for id, r := range b.replicas {
+		if keep[id] {
+			continue
+		}
+		removed = append(removed, r)
+		delete(b.replicas, id)
+	}
+	b.lock.Unlock()
+	// replica goroutines read the buffer, so are stopped without the lock
+	for _, r := range removed {
+		r.Stop(0)
+		b.log.Infof("removed replica %q from buffer %q", r.ID, b.ID)
+	}
+}
+
+// Replicas returns the number of messages pushed to each of the replicas.
+func (b *Buffer) Replicas() map[string]int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	replicas := make(map[string]int)
+	for id, r := range b.replicas {
+		replicas[id] = r.Len()
 	}
+	return replicas
 }
 
+// Offsets returns the ID of the next message to be consumed by each of the
+// consumers.
+func (b *Buffer) Offsets() map[string]int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	offsets := make(map[string]int)
+	for id, c := range b.consumers {
+		offsets[id] = c.N
+	}
+	return offsets
+}
+
+// Next returns the ID the next message written to the buffer will get.
+func (b *Buffer) Next() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Len
+}
+
+// NumSegments returns the number of the buffer's segments.
+func (b *Buffer) NumSegments() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.segments)
+}
+
+// SetConsumers replaces consumer offsets with ones in j, in the same format
+// as returned by Consumers.
+func (b *Buffer) SetConsumers(j []byte) error {
+	consumers := make(map[string]*Consumer)
+	if err := json.Unmarshal(j, &consumers); err != nil {
+		return fmt.Errorf("error parsing consumer offsets: %v", err)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.consumers = consumers
+	return b.saveConsumers()
+}
+
+// First returns the ID of the oldest message in the buffer. If the buffer is
+// empty, this is the ID the next message will get.
+func (b *Buffer) First() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.segments) == 0 {
+		return b.Len
+	}
+	return b.segments[0].First
+}
+
+// SizeB returns the size of the buffer's segments on disk. It doesn't wait
+// on writes in progress.
+func (b *Buffer) SizeB() int64 {
+	return atomic.LoadInt64(&b.size)
+}
+
+// grow adds n to the size of the buffer, and to Used. Called with the lock
+// held, so that changes to size are in order.
+func (b *Buffer) grow(n int64) {
+	atomic.AddInt64(&b.size, n)
+	if b.Used != nil {
+		atomic.AddInt64(b.Used, n)
+	}
+}
+
+// Stop stops the buffer, after its replicas have caught up with it, for up
+// to ReplicaStopTimeout, and saves consumer offsets.
 func (b *Buffer) Stop() {
+	b.stop(ReplicaStopTimeout)
+}
+
+func (b *Buffer) stop(timeout time.Duration) {
 	//
 	b.lock.Lock()
-	b.running = false
+	replicas := make([]*replica, 0, len(b.replicas))
 	for _, r := range b.replicas {
-		r.Stop()
+		replicas = append(replicas, r)
+	}
+	b.lock.Unlock()
+	// while the buffer is still running, so that replicas can read it
+	wg := sync.WaitGroup{}
+	for _, r := range replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			r.Stop(timeout)
+		}(r)
 	}
+	wg.Wait()
+	b.lock.Lock()
+	b.running = false
 	for _, s := range b.segments {
 		s.Close()
 	}
+	// a stopped buffer doesn't count towards the size of the worker's
+	b.grow(-atomic.LoadInt64(&b.size))
 	b.lock.Unlock()
 	if err := b.saveConsumers(); err != nil {
-		log.Println(err)
+		b.log.Errorf("%v", err)
 	}
-	log.Printf("buffer %q stopped", b.ID)
+	b.log.Infof("buffer %q stopped", b.ID)
 }
 
+// Delete stops the buffer, without waiting for replicas, and deletes its
+// data.
 func (b *Buffer) Delete() error {
-	b.Stop()
+	b.stop(0)
 	return os.RemoveAll(b.Path)
 }
 
@@ -203,8 +480,9 @@ func (b *Buffer) trimSegments() error {
 	for len(b.segments) > b.BufferMaxSegments {
 		s, b.segments = b.segments[0], b.segments[1:]
 		s.Close()
+		b.grow(-s.SizeB())
 		if err := os.Remove(s.Path); err != nil {
-			log.Printf("error removing segment file: %v", err)
+			b.log.Errorf("error removing segment file: %v", err)
 		}
 	}
 	return nil
@@ -215,11 +493,14 @@ func (b *Buffer) addSegment() error {
 	if len(b.segments) > 0 {
 		b.segments[len(b.segments)-1].Close()
 	}
-	s, err := segment.New(b.Path, b.Len)
+	// new segments are encrypted with the current key; older segments keep
+	// the key they were written with
+	s, err := segment.NewEncrypted(b.Path, b.Len, b.Keys, b.Encryption)
 	if err != nil {
 		return fmt.Errorf("error creating segment: %v", err)
 	}
 	b.segments = append(b.segments, s)
+	b.grow(s.SizeB())
 	return nil
 }
 
@@ -249,8 +530,16 @@ func (b *Buffer) getSegment() (*segment.Segment, error) {
 func (b *Buffer) write(m *message.Message) error {
 	//
 	var err error
+	start := time.Now()
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	writeLockWait.Since(start)
+	if b.Sealed {
+		return ErrorBufferSealed
+	}
+	if len(m.Body) > int(b.MessageMaxBytes) {
+		return ErrorMessageSize
+	}
 	// "normal" messages don't have their id set ahead of time; they get their
 	// id assigned based on the length of the buffer; however replica messages
 	// have their id set when sent from the origin, so that if a new replica
@@ -271,9 +560,11 @@ func (b *Buffer) write(m *message.Message) error {
 		return err
 	}
 	m.Sum(b.sha)
+	size := s.SizeB()
 	if err := s.Write(m); err != nil {
 		return err
 	}
+	b.grow(s.SizeB() - size)
 	b.Len += 1
 	b.sha = m.Sha
 	// this signals to replicas that there is data to be syncd
@@ -286,6 +577,34 @@ func (b *Buffer) write(m *message.Message) error {
 	return nil
 }
 
+// Compress compresses the body of m with the buffer's codec. Bodies already
+// compressed, and bodies compression doesn't make smaller, are left as they
+// are. Size is checked against message_max_bytes before compression.
+// Messages sent by replication are stored as they were on the primary, and
+// aren't passed through Compress.
+func (b *Buffer) Compress(m *message.Message) error {
+	//
+	if len(m.Body) > int(b.MessageMaxBytes) {
+		return ErrorMessageSize
+	}
+	if b.Compression == "" || m.Encoding != "" {
+		return nil
+	}
+	c, err := codec.Get(b.Compression)
+	if err != nil {
+		return err
+	}
+	body, err := c.Compress(m.Body)
+	if err != nil {
+		return fmt.Errorf("error compressing message body: %v", err)
+	}
+	if len(body) < len(m.Body) {
+		m.Body = body
+		m.Encoding = c.Name()
+	}
+	return nil
+}
+
 func (b *Buffer) Write(m *message.Message) error {
 	b.lock.Lock()
 	running := b.running
@@ -355,6 +674,7 @@ func (b *Buffer) Consume(id string) (*message.Message, error) {
 	if !b.running {
 		return nil, fmt.Errorf("buffer not running")
 	}
+	defer consumeLatency.Since(time.Now())
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	c, ok := b.consumers[id]
@@ -368,8 +688,15 @@ func (b *Buffer) Consume(id string) (*message.Message, error) {
 		// TODO: optimize this
 		// cutting this out improves performance 100x
 		b.saveConsumers()
-		stats.Stats <- &stats.Stat{Name: "buffer_message_consume_n", Kind: stats.Counter, IntVal: 1}
-		stats.Stats <- &stats.Stat{Name: "buffer_message_consume_b", Kind: stats.Counter, IntVal: len(m.Body)}
+		consumeN.Add(1)
+		consumeB.Add(len(m.Body))
 	}
 	return m, err
 }
+
+func (b *Buffer) controllers() []string {
+	if len(b.Controllers) > 0 {
+		return b.Controllers
+	}
+	return []string{b.Controller}
+}
@@ -2,12 +2,18 @@ package buffer
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/mkocikowski/hbuf/codec"
+	"github.com/mkocikowski/hbuf/crypt"
 	"github.com/mkocikowski/hbuf/message"
 	"github.com/mkocikowski/hbuf/segment"
 	"github.com/mkocikowski/hbuf/util"
@@ -264,3 +270,273 @@ func BenchmarkConsume(b *testing.B) {
 	}
 
 }
+
+func TestSizeB(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var used int64
+	b := &Buffer{ID: util.Uid(), Path: dir, Used: &used}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.SegmentMaxMessages = 2
+	b.BufferMaxSegments = 2
+	// size on disk, of segments not trimmed
+	size := func() int64 {
+		files, _ := filepath.Glob(filepath.Join(dir, "segment_*"))
+		var n int64
+		for _, f := range files {
+			info, _ := os.Stat(f)
+			n += info.Size()
+		}
+		return n
+	}
+	for i := 0; i < 7; i++ {
+		if err := b.Write(&message.Message{Type: "text/plain", Body: []byte("foo")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := size(); b.SizeB() != n || used != n {
+			t.Fatalf("expected size %d, got %d (used %d)", n, b.SizeB(), used)
+		}
+	}
+	b.Stop()
+	if used != 0 {
+		t.Fatalf("expected stopped buffer not to be counted, got %d", used)
+	}
+	// sizes of segments on disk are counted when the buffer is opened
+	b = &Buffer{ID: b.ID, Path: dir, Used: &used}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := size(); b.SizeB() != n || used != n {
+		t.Fatalf("expected size %d, got %d (used %d)", n, b.SizeB(), used)
+	}
+	if err := b.Delete(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if used != 0 {
+		t.Fatalf("expected deleted buffer not to be counted, got %d", used)
+	}
+}
+
+func TestSeal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uid := util.Uid()
+	b := &Buffer{ID: uid, Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &message.Message{Type: "text/plain", Body: []byte("foo")}
+	if err := b.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Seal(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m = &message.Message{Type: "text/plain", Body: []byte("bar")}
+	if err := b.Write(m); err != ErrorBufferSealed {
+		t.Fatalf("not the error i expected: %v", err)
+	}
+	// sealed buffer can still be read from and consumed
+	if _, err := b.Read(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.Consume("-"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.Stop()
+
+	// sealed state survives restart
+	b = &Buffer{ID: uid, Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !b.Sealed {
+		t.Fatalf("expected buffer to be sealed after restart")
+	}
+	if err := b.Unseal(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Write(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.ID != 1 {
+		t.Fatalf("expected message id==1, got: %v", m.ID)
+	}
+	b.Stop()
+}
+
+func TestConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uid := util.Uid()
+	c := DefaultConfig()
+	c.MessageMaxBytes = 4
+	b := &Buffer{ID: uid, Path: dir, Config: c}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &message.Message{Type: "text/plain", Body: []byte("foo")}
+	if err := b.Write(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m = &message.Message{Type: "text/plain", Body: []byte("monkey")}
+	if err := b.Write(m); err != ErrorMessageSize {
+		t.Fatalf("not the error i expected: %v", err)
+	}
+	b.Stop()
+
+	// config is persisted with the buffer
+	b = &Buffer{ID: uid, Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.MessageMaxBytes != 4 {
+		t.Fatalf("expected message_max_bytes==4, got: %v", b.MessageMaxBytes)
+	}
+	b.Stop()
+}
+
+func TestEncryptedBuffer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	k1, k2 := crypt.GenerateKey(), crypt.GenerateKey()
+	writeKeys := func(current string, keys map[string][]byte) {
+		j, _ := json.Marshal(map[string]interface{}{"current": current, "keys": keys})
+		if err := ioutil.WriteFile(keyFile, j, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("k1", map[string][]byte{"k1": k1})
+	keys, err := crypt.Load(keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(dir, "buffer")
+	config := DefaultConfig()
+	config.Encryption = crypt.ModeRecord
+	config.SegmentMaxMessages = 2
+	if err := (&Buffer{Config: config, Path: path}).Init(); err == nil {
+		t.Fatalf("expected error creating encrypted buffer without keys")
+	}
+	b := &Buffer{Config: config, Path: path, Keys: keys}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.Write(&message.Message{Type: "text/plain", Body: []byte("secret")}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	write(2)
+	// rotate keys: new segments are written with k2, old ones stay readable
+	// with k1
+	time.Sleep(10 * time.Millisecond)
+	writeKeys("k2", map[string][]byte{"k1": k1, "k2": k2})
+	write(2)
+	if _, err := b.Consume("c"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.Stop()
+
+	keys, _ = crypt.Load(keyFile)
+	b = &Buffer{Path: path, Keys: keys}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Verify(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.segments[0].Key != "k1" || b.segments[1].Key != "k2" {
+		t.Fatalf("unexpected segment keys: %q %q", b.segments[0].Key, b.segments[1].Key)
+	}
+	if m, err := b.Consume("c"); err != nil || m.ID != 1 || string(m.Body) != "secret" {
+		t.Fatalf("unexpected message or error: %v %v", m, err)
+	}
+	files, _ := ioutil.ReadDir(path)
+	for _, f := range files {
+		d, _ := ioutil.ReadFile(filepath.Join(path, f.Name()))
+		if bytes.Contains(d, []byte("secret")) || (f.Name() == "offsets" && bytes.Contains(d, []byte(`"c"`))) {
+			t.Fatalf("plain text found in %q", f.Name())
+		}
+	}
+}
+
+func TestCompressedBuffer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.Compression = "foo"
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected error for unknown codec")
+	}
+	config.Compression = codec.Gzip
+	config.MessageMaxBytes = 1 << 10
+	b := &Buffer{Config: config, Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body := bytes.Repeat([]byte("log line "), 100)
+	for _, m := range []*message.Message{
+		{Body: body},
+		{Body: []byte("x")}, // compressed is larger, stored as is
+	} {
+		if err := b.Compress(m); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := b.Write(m); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := b.Compress(&message.Message{Body: bytes.Repeat(body, 2)}); err != ErrorMessageSize {
+		t.Fatalf("expected message size error, got: %v", err)
+	}
+	if s := b.segments[0].SizeB(); s > int64(len(body)/2) {
+		t.Fatalf("segment not compressed: %d bytes", s)
+	}
+	b.Stop()
+	b = &Buffer{Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Verify(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := b.Read(0)
+	if err != nil || m.Encoding != codec.Gzip {
+		t.Fatalf("unexpected message or error: %v %v", m, err)
+	}
+	if d, err := codec.Decode(m.Encoding, m.Body); err != nil || !bytes.Equal(d, body) {
+		t.Fatalf("unexpected body or error: %q %v", d, err)
+	}
+	if m, err = b.Read(1); err != nil || m.Encoding != "" || string(m.Body) != "x" {
+		t.Fatalf("unexpected message or error: %v %v", m, err)
+	}
+}
@@ -3,28 +3,33 @@ package buffer
 import (
 	"bytes"
 	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
 	"github.com/mkocikowski/hbuf/segment"
+	"github.com/mkocikowski/hbuf/stats"
+	"github.com/mkocikowski/hbuf/trace"
 )
 
+var replicaPush = stats.NewHistogram("replica_push")
+
 type replica struct {
-	ID      string `json:"id"`
-	URL     string `json:"url"`
-	manager string
-	length  int
-	buffer  *Buffer
-	lock    *sync.Mutex
-	wg      sync.WaitGroup
-	data    chan bool
-	sync    chan bool
-	done    chan bool
-	isUp    chan bool
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	managers []string // tried in turn
+	length   int
+	buffer   *Buffer
+	lock     *sync.Mutex
+	wg       sync.WaitGroup
+	data     chan bool
+	sync     chan bool
+	done     chan bool
+	isUp     chan bool
+	log      *logger.Logger
 }
 
 func (r *replica) Init() error {
@@ -34,6 +39,7 @@ func (r *replica) Init() error {
 	r.done = make(chan bool)
 	r.isUp = make(chan bool)
 	r.lock = new(sync.Mutex)
+	r.log = logger.New("replica").With("tenant", r.buffer.Tenant, "buffer", r.buffer.ID, "replica", r.ID)
 
 	r.wg.Add(2)
 	go r.update()
@@ -42,10 +48,45 @@ func (r *replica) Init() error {
 	return nil
 }
 
-func (r *replica) Stop() {
+// Stop stops the replica's goroutines. Messages written to the buffer and not
+// yet pushed to the replica are pushed first, for up to timeout. Must not be
+// called with the buffer's lock held.
+func (r *replica) Stop(timeout time.Duration) {
+	r.flush(timeout)
 	close(r.done)
-	//r.wg.Wait()
-	log.Printf("replica %q stopped", r.ID)
+	r.wg.Wait()
+	r.log.Infof("replica %q stopped", r.ID)
+}
+
+// flush waits until the replica has caught up with the buffer, for up to
+// timeout. Replicas whose location isn't known yet can't catch up.
+func (r *replica) flush(timeout time.Duration) {
+	//
+	if timeout <= 0 {
+		return
+	}
+	select {
+	case <-r.isUp:
+	default:
+		return
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for r.Len() < r.buffer.Next() {
+		// the writer may be waiting for a signal after an error
+		select {
+		case r.data <- true:
+		default:
+		}
+		select {
+		case <-r.sync:
+		case <-ticker.C:
+		case <-deadline:
+			r.log.Warnf("replica %q stopped %d messages behind buffer", r.ID, r.buffer.Next()-r.Len())
+			return
+		}
+	}
 }
 
 func (r *replica) Len() int {
@@ -58,22 +99,22 @@ func (r *replica) update() {
 
 	defer r.wg.Done()
 	// get buffer URL from manager
-	for {
+	for i := 0; ; i++ {
 		select {
 		case <-r.done:
 			return
 		default:
 		}
-		u := r.manager + "/buffers/" + r.ID
+		u := r.managers[i%len(r.managers)] + "/buffers/" + r.ID
 		b, err := curl.Get(u)
 		if err != nil {
-			log.Printf("error getting replica URL from manager %q: %v", u, err)
+			r.log.Errorf("error getting replica URL from manager %q: %v", u, err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		buffer := Buffer{}
 		if err := json.Unmarshal(b, &buffer); err != nil {
-			log.Printf("error parsing replica metadata: %v", err)
+			r.log.Errorf("error parsing replica metadata: %v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -89,29 +130,37 @@ func (r *replica) update() {
 		}
 		b, err := curl.Get(r.URL)
 		if err != nil {
-			log.Printf("error getting replica length from buffer %q: %v", r.URL, err)
+			r.log.Errorf("error getting replica length from buffer %q: %v", r.URL, err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		buffer := Buffer{}
 		if err := json.Unmarshal(b, &buffer); err != nil {
-			log.Printf("error parsing replica metadata: %v", err)
+			r.log.Errorf("error parsing replica metadata: %v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		r.length = buffer.Len
-		log.Printf("replica %q length: %d", r.ID, r.length)
+		r.log.Debugf("replica %q length: %d", r.ID, r.length)
 		break
 	}
 	close(r.isUp)
-	r.data <- true // signal for writer to start polling the buffer
+	// signal for writer to start polling the buffer
+	select {
+	case r.data <- true:
+	default:
+	}
 }
 
 func (r *replica) writer() {
 
 	defer r.wg.Done()
-	<-r.isUp
-	log.Printf("starting writer for replica %q", r.ID)
+	select {
+	case <-r.isUp:
+	case <-r.done:
+		return
+	}
+	r.log.Infof("starting writer for replica %q", r.ID)
 
 	for {
 		select {
@@ -124,21 +173,49 @@ func (r *replica) writer() {
 		u := r.URL
 		r.lock.Unlock()
 		for {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			// messages of encrypted buffers are read decrypted, and are
+			// encrypted again by the receiving buffer, with the keys of
+			// the worker (and tenant) it is on
 			m, err := r.buffer.Read(l)
 			if err == segment.ErrorOutOfBounds {
+				// messages may have been trimmed from the buffer; skip
+				// ahead to the oldest message still there
+				if f := r.buffer.First(); l < f {
+					l = f
+					continue
+				}
 				break
 			}
 			if err != nil {
-				log.Println(err)
+				r.log.Errorf("%v", err)
 				break
 			}
 			req, _ := http.NewRequest("POST", u, bytes.NewBuffer(m.Body))
 			req.Header.Add("Content-Type", m.Type)
 			req.Header.Add("Hbuf-Ts", m.TS.Format(time.RFC3339Nano))
 			req.Header.Add("Hbuf-Id", strconv.Itoa(m.ID))
+			// compressed bodies are sent as they are stored, and the
+			// receiving buffer stores them without recompressing
+			if m.Encoding != "" {
+				req.Header.Add("Content-Encoding", m.Encoding)
+			}
+			// so is the request which produced the message
+			if m.RequestID != "" {
+				req.Header.Add(trace.RequestIDHeader, m.RequestID)
+			}
+			if m.Trace != "" {
+				req.Header.Add(trace.TraceparentHeader, m.Trace)
+			}
+			start := time.Now()
 			b, err := curl.Do(req)
+			replicaPush.Since(start)
 			if err != nil {
-				log.Println(err)
+				r.log.Errorf("%v", err)
 				break
 			}
 
@@ -147,14 +224,14 @@ func (r *replica) writer() {
 				ID int `json:"id"`
 			}{}
 			if err = json.Unmarshal(b, &x); err != nil {
-				log.Printf("error parsing write response from remote: %v", err)
+				r.log.Errorf("error parsing write response from remote: %v", err)
 				break
 			}
 			if x.ID != l {
-				log.Println("error replicating: remote message id doesn't match expected")
+				r.log.Errorf("error replicating: remote message id doesn't match expected")
 				break
 			}
-			log.Printf("replicated: %v", string(b))
+			r.log.Debugf("replicated: %v", string(b))
 
 			l += 1
 			r.lock.Lock()
@@ -168,5 +245,5 @@ func (r *replica) writer() {
 		}
 	}
 
-	log.Printf("stopped replica %q writer", r.ID)
+	r.log.Infof("stopped replica %q writer", r.ID)
 }
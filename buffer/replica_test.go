@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mkocikowski/hbuf/message"
 	"github.com/mkocikowski/hbuf/util"
@@ -42,7 +44,7 @@ func TestReplica(t *testing.T) {
 	// the manager will give the replicator the information on where to find the remote buffer
 	mux := http.NewServeMux()
 	mux.HandleFunc("/manager/buffers/r1", func(w http.ResponseWriter, req *http.Request) {
-		fmt.Fprintf(w, `{"url":"`+worker.URL+`"}`)
+		fmt.Fprintf(w, `{"url":%q}`, worker.URL)
 	})
 	manager := httptest.NewServer(mux)
 	defer manager.Close()
@@ -51,12 +53,61 @@ func TestReplica(t *testing.T) {
 
 	// set up a replicator on the local buffer; it will query the manager about
 	// the location of the remote buffer "r1"
-	r := &replica{ID: "r1", manager: manager.URL + "/manager", buffer: b}
+	r := &replica{ID: "r1", managers: []string{manager.URL + "/manager"}, buffer: b}
 	r.Init()
 	<-r.sync
 	if r.Len() != 1 {
 		t.Fatal("replica not working", r.Len())
 	}
 
-	r.Stop()
+	r.Stop(0)
+}
+
+func TestReplicaStop(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := &Buffer{ID: util.Uid(), Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := b.Write(&message.Message{Type: "text/plain", Body: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the remote buffer takes a while to write each message
+	lock := new(sync.Mutex)
+	n := 0
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method == "GET" {
+			fmt.Fprintf(w, `{"len":0}`)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"id":%d}`, n)
+		n++
+	}))
+	defer worker.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manager/buffers/r1", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"url":%q}`, worker.URL)
+	})
+	manager := httptest.NewServer(mux)
+	defer manager.Close()
+	r := &replica{ID: "r1", managers: []string{manager.URL + "/manager"}, buffer: b}
+	r.Init()
+	<-r.isUp
+	// messages not yet pushed are pushed before the replica stops
+	r.Stop(5 * time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	if r.Len() != 20 || n != 20 {
+		t.Fatalf("expected 20 messages replicated, got %d (%d)", r.Len(), n)
+	}
 }
@@ -0,0 +1,113 @@
+package buffer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	segmentNameRE = regexp.MustCompile(`^segment_[0-9a-f]{16}$`)
+)
+
+// Restore unpacks a tar archive of a single buffer directory (as written by
+// Snapshot.WriteTar, or by running tar on a buffer's directory) into dir.
+// Directory names within the archive are ignored. Consumer offsets are
+// restored only when offsets is true. Returns the buffer's manifest if the
+// archive contains one, nil otherwise.
+func Restore(dir string, r io.Reader, offsets bool) (*Manifest, error) {
+	//
+	var manifest *Manifest
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating buffer dir: %v", err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Base(h.Name)
+		switch {
+		case segmentNameRE.MatchString(name):
+		case name == "offsets" && offsets:
+		case name == "config":
+		case name == "manifest.json":
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("error reading manifest: %v", err)
+			}
+			manifest = new(Manifest)
+			if err := json.Unmarshal(b, manifest); err != nil {
+				return nil, fmt.Errorf("error parsing manifest: %v", err)
+			}
+			continue
+		default:
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error creating file %q: %v", name, err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error writing file %q: %v", name, err)
+		}
+	}
+	return manifest, nil
+}
+
+// Verify reads all messages in the buffer and checks that message IDs are
+// consecutive and that the SHA chain is intact. The SHA of the first message
+// can be verified only if it is the first message ever written to the buffer
+// (ID 0); otherwise it is taken on trust. If manifest is not nil, the buffer's
+// length and last SHA are checked against it.
+func (b *Buffer) Verify(manifest *Manifest) error {
+	//
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var previous []byte
+	id := -1
+	for _, s := range b.segments {
+		for i := 0; i < s.Len(); i++ {
+			m, err := s.Read(i)
+			if err != nil {
+				return fmt.Errorf("error reading message %d from segment %q: %v", i, s.Path, err)
+			}
+			if id != -1 && m.ID != id+1 {
+				return fmt.Errorf("expected message id %d, got %d", id+1, m.ID)
+			}
+			sha := m.Sha
+			if id != -1 || m.ID == 0 {
+				if !bytes.Equal(m.Sum(previous), sha) {
+					return fmt.Errorf("sha of message %d doesn't match the chain", m.ID)
+				}
+			}
+			id = m.ID
+			previous = sha
+		}
+	}
+	if manifest == nil {
+		return nil
+	}
+	if manifest.Len != b.Len {
+		return fmt.Errorf("buffer length %d doesn't match manifest length %d", b.Len, manifest.Len)
+	}
+	if !bytes.Equal(manifest.Sha, b.sha) {
+		return fmt.Errorf("sha of last message doesn't match manifest")
+	}
+	return nil
+}
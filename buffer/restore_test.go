@@ -0,0 +1,87 @@
+package buffer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/util"
+)
+
+func TestRestore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Buffer{ID: util.Uid(), Path: filepath.Join(dir, "a")}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.SegmentMaxMessages = 2
+	for i := 0; i < 5; i++ {
+		m := &message.Message{Type: "text/plain", Body: []byte(fmt.Sprintf("foo-%d", i))}
+		if err := b.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Consume("c")
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := snap.WriteTar(tw, b.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tw.Close()
+	archive := buf.Bytes()
+	b.Stop()
+
+	p := filepath.Join(dir, "b")
+	manifest, err := Restore(p, bytes.NewReader(archive), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := &Buffer{ID: util.Uid(), Path: p}
+	if err := r.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Verify(manifest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// consumer "c" had already consumed message 0
+	m, err := r.Consume("c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(m.Body) != "foo-1" {
+		t.Fatalf("unexpected body: %v", string(m.Body))
+	}
+	r.Stop()
+
+	// tamper with a message, chain verification should fail
+	p = filepath.Join(dir, "c")
+	archive = bytes.Replace(archive, []byte("foo-3"), []byte("bar-3"), 1)
+	manifest, err = Restore(p, bytes.NewReader(archive), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r = &Buffer{ID: util.Uid(), Path: p}
+	if err := r.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Verify(manifest); err == nil {
+		t.Fatalf("expected error, didn't get it")
+	}
+	r.Stop()
+}
@@ -0,0 +1,126 @@
+package buffer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Manifest describes the state of a buffer at the time a snapshot was taken.
+type Manifest struct {
+	ID       string   `json:"id"`
+	First    int      `json:"first"`
+	Len      int      `json:"len"`
+	Sha      []byte   `json:"sha"`
+	Sealed   bool     `json:"sealed"`
+	Segments []string `json:"segments"`
+}
+
+// Snapshot holds the "cut points" of a buffer: open handles to its segment
+// files, and the number of bytes of each that belong to the snapshot. Because
+// the files are held open, segments trimmed after the cut can still be read.
+type Snapshot struct {
+	Manifest
+	files   []*os.File
+	sizes   []int64
+	offsets []byte
+	config  []byte
+}
+
+// Snapshot records the cut points for a consistent copy of the buffer. The
+// buffer is locked only for as long as it takes to open the segment files and
+// to record their sizes; the data is copied later with WriteTar.
+func (b *Buffer) Snapshot() (*Snapshot, error) {
+	//
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.running {
+		return nil, ErrorBufferClosed
+	}
+	s := &Snapshot{
+		Manifest: Manifest{
+			ID:       b.ID,
+			First:    b.Len,
+			Len:      b.Len,
+			Sha:      b.sha,
+			Sealed:   b.Sealed,
+			Segments: make([]string, 0, len(b.segments)),
+		},
+	}
+	if len(b.segments) > 0 {
+		s.First = b.segments[0].First
+	}
+	for _, segment := range b.segments {
+		f, err := os.Open(segment.Path)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error opening segment for snapshot: %v", err)
+		}
+		s.files = append(s.files, f)
+		s.sizes = append(s.sizes, segment.SizeB())
+		s.Segments = append(s.Segments, filepath.Base(segment.Path))
+	}
+	offsets, err := b.sealOffsets()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error encrypting consumer offsets: %v", err)
+	}
+	s.offsets = offsets
+	s.config, _ = json.Marshal(b.Config)
+	return s, nil
+}
+
+// Close releases the segment files held open by the snapshot.
+func (s *Snapshot) Close() {
+	for _, f := range s.files {
+		f.Close()
+	}
+	s.files = nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	h := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// WriteTar writes the snapshot's segments (each up to its recorded length),
+// consumer offsets, config, and manifest to tw, under dir. The snapshot is closed
+// when done.
+func (s *Snapshot) WriteTar(tw *tar.Writer, dir string) error {
+	//
+	defer s.Close()
+	for i, f := range s.files {
+		p := filepath.Join(dir, s.Segments[i])
+		if err := writeTarFile(tw, p, s.sizes[i], f); err != nil {
+			return fmt.Errorf("error writing segment %q to archive: %v", p, err)
+		}
+	}
+	p := filepath.Join(dir, "offsets")
+	if err := writeTarFile(tw, p, int64(len(s.offsets)), bytes.NewReader(s.offsets)); err != nil {
+		return fmt.Errorf("error writing offsets to archive: %v", err)
+	}
+	p = filepath.Join(dir, "config")
+	if err := writeTarFile(tw, p, int64(len(s.config)), bytes.NewReader(s.config)); err != nil {
+		return fmt.Errorf("error writing config to archive: %v", err)
+	}
+	j, _ := json.Marshal(s.Manifest)
+	p = filepath.Join(dir, "manifest.json")
+	if err := writeTarFile(tw, p, int64(len(j)), bytes.NewReader(j)); err != nil {
+		return fmt.Errorf("error writing manifest to archive: %v", err)
+	}
+	return nil
+}
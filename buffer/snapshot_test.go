@@ -0,0 +1,86 @@
+package buffer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/util"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Buffer{ID: util.Uid(), Path: dir}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.SegmentMaxMessages = 2
+	for i := 0; i < 5; i++ {
+		m := &message.Message{Type: "text/plain", Body: []byte(fmt.Sprintf("foo-%d", i))}
+		if err := b.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Consume("-")
+
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// writes after the cut are not part of the snapshot
+	m := &message.Message{Type: "text/plain", Body: []byte("bar")}
+	if err := b.Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := snap.WriteTar(tw, b.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tw.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files[h.Name], _ = ioutil.ReadAll(tr)
+	}
+	if len(files) != 6 {
+		t.Fatalf("expected 6 files in archive, got: %d", len(files))
+	}
+	manifest := Manifest{}
+	if err := json.Unmarshal(files[b.ID+"/manifest.json"], &manifest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if manifest.Len != 5 || len(manifest.Segments) != 3 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	last := files[b.ID+"/"+manifest.Segments[2]]
+	if bytes.Contains(last, []byte("bar")) {
+		t.Fatalf("message written after the cut is in the snapshot")
+	}
+	if !bytes.Contains(files[b.ID+"/offsets"], []byte(`"N":1`)) {
+		t.Fatalf("unexpected offsets: %s", files[b.ID+"/offsets"])
+	}
+	b.Stop()
+}
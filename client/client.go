@@ -1,66 +1,190 @@
 package client
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/quota"
 	"github.com/mkocikowski/hbuf/router"
 	"github.com/mkocikowski/hbuf/util"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 256,
-		},
-		Timeout: 5 * time.Second,
-	}
+	client = curl.NewClient(256, 5*time.Second)
+	// used for responses which can take longer than 5s to transfer, such
+	// as snapshots; only the time to get the response headers is limited
+	streamClient = curl.NewStreamClient(5 * time.Second)
 )
 
 type Buffer struct {
-	ID  string `json:"id"`
-	URL string `json:"url"`
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Draining bool   `json:"draining,omitempty"` // on a draining worker
 }
 
+var (
+	// how often topic and buffer metadata, and the access policy, are
+	// refreshed
+	MetadataRefreshInterval = 10 * time.Second
+)
+
 type Topic struct {
 	ID      string   `json:"id"`
 	Buffers []string `json:"buffers"`
+	Epochs  []int    `json:"epochs"`
+	Sealed  bool     `json:"sealed"`
+}
+
+// layout returns the topic's buffer list as of epoch; when epoch is "" the
+// current buffer list is returned.
+func (t *Topic) layout(epoch string) ([]string, error) {
+	if epoch == "" {
+		return t.Buffers, nil
+	}
+	n, err := strconv.Atoi(epoch)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing epoch: %v", err)
+	}
+	epochs := t.Epochs
+	if len(epochs) == 0 {
+		epochs = []int{len(t.Buffers)}
+	}
+	if n < 0 || n >= len(epochs) || epochs[n] > len(t.Buffers) {
+		return nil, fmt.Errorf("topic %q has no epoch %d", t.ID, n)
+	}
+	return t.Buffers[:epochs[n]], nil
 }
 
 type Client struct {
 	ID         string `json:"id"`
 	URL        string `json:"url"`
-	Controller string `json:"-"`
-	Tenant     string `json:"-"`
-	routes     []*router.Route
-	topics     map[string]*Topic
-	buffers    map[string]*Buffer
-	lock       *sync.Mutex
+	Controller string `json:"-"` // the controller in use
+	// all controllers of the tenant, when the controller is replicated; on
+	// error the client fails over to the next one
+	Controllers []string `json:"-"`
+	Tenant      string   `json:"-"`
+	routes      []*router.Route
+	topics      map[string]*Topic
+	buffers     map[string]*Buffer
+	policy      *acl.Policy // access policy of the tenant; nil when there is none
+	consume     *quota.Limiter
+	busy        map[string]time.Time // buffers which asked to retry writes later, until when
+	lock        *sync.Mutex
+	done        chan bool
+	log         *logger.Logger
 }
 
 func (c *Client) Init() *Client {
+	c.log = logger.New("client").With("tenant", c.Tenant, "client", c.ID)
 	c.topics = make(map[string]*Topic)
 	c.buffers = make(map[string]*Buffer)
 	c.lock = new(sync.Mutex)
+	c.consume = quota.NewLimiter()
+	c.busy = make(map[string]time.Time)
 	c.routes = []*router.Route{
 		{"", []string{"GET"}, c.handleGetInfo, "show information about the node"},
 		{"/topics", []string{"GET"}, c.handleGetTopics, "show topics"},
-		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"POST"}, c.handleWriteToTopic, "send message to topic, creating topic if necessary"},
-		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"DELETE"}, c.handleDeleteTopic, "delete topic and all its data"},
-		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/next`, []string{"GET", "POST"}, c.handleConsumeFromTopic, "consume from topic; optional ?c= specifies consumer"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"POST"}, c.allow(acl.Produce, c.handleWriteToTopic), "send message to topic, creating topic if necessary; messages with the same Hbuf-Key header go to the same buffer, Hbuf-Epoch header pins the key to the topic's buffer layout at that epoch"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"DELETE"}, c.allow(acl.Admin, c.handleDeleteTopic), "delete topic and all its data"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/next`, []string{"GET", "POST"}, c.allow(acl.Consume, c.handleConsumeFromTopic), "consume from topic; optional ?c= specifies consumer"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_seal`, []string{"POST"}, c.allow(acl.Admin, c.handleSealTopic), "make topic read-only; writes will fail with 409"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_unseal`, []string{"POST"}, c.allow(acl.Admin, c.handleUnsealTopic), "make sealed topic writable again"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_snapshot`, []string{"GET"}, c.allow(acl.Admin, c.handleSnapshotTopic), "get tar archive of topic's buffers; ?format=tar.gz for compressed"},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_restore`, []string{"POST"}, c.allow(acl.Admin, c.handleRestoreTopic), "create topic from tar archive of buffers; ?offsets=true restores consumer offsets"},
+	}
+	c.done = make(chan bool)
+	if err := c.updatePolicy(); err != nil {
+		c.log.Errorf("error getting access policy: %v", err)
 	}
+	go c.refresh(MetadataRefreshInterval)
 	return c
 }
 
+// refresh periodically updates topic and buffer metadata, so that changes
+// such as buffers added to topics are picked up by writers.
+func (c *Client) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.updateMetadata(); err != nil {
+			c.log.Errorf("error refreshing metadata: %v", err)
+		}
+		if err := c.updatePolicy(); err != nil {
+			c.log.Errorf("error refreshing access policy: %v", err)
+		}
+	}
+}
+
+// allow wraps handler h with a check of the access policy. Without a policy
+// all principals are allowed.
+func (c *Client) allow(action string, h router.HandlerFunc) router.HandlerFunc {
+	return acl.Enforce(c.getPolicy, true, action, acl.Topics, h)
+}
+
+func (c *Client) getPolicy() *acl.Policy {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.policy
+}
+
+// updatePolicy gets the access policy and quotas from the controller.
+func (c *Client) updatePolicy() error {
+	//
+	u := c.controller()
+	var p *acl.Policy
+	q := new(quota.Status)
+	for _, x := range []struct {
+		path string
+		v    interface{}
+	}{{"/acl", &p}, {"/quotas", q}} {
+		b, err := curl.Get(u + x.path)
+		if err != nil {
+			c.failover(u)
+			return err
+		}
+		if err := json.Unmarshal(b, x.v); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	c.policy = p
+	c.lock.Unlock()
+	if q.Quotas != nil {
+		c.consume.SetRate(q.Quotas.ConsumeBytesPerSec)
+	} else {
+		c.consume.SetRate(0)
+	}
+	return nil
+}
+
+func (c *Client) Stop() {
+	close(c.done)
+	c.log.Infof("client %q stopped", c.ID)
+}
+
 func (c *Client) Routes() []*router.Route {
 	return c.routes
 }
@@ -72,9 +196,35 @@ func (c *Client) handleGetInfo(req *http.Request) *router.Response {
 	return &router.Response{Body: j}
 }
 
+// controller returns the URL of the controller in use.
+func (c *Client) controller() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Controller
+}
+
+// failover switches to the controller following u, unless some other request
+// already switched away from u.
+func (c *Client) failover(u string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if u != c.Controller || len(c.Controllers) == 0 {
+		return
+	}
+	for i, x := range c.Controllers {
+		if x == u {
+			c.Controller = c.Controllers[(i+1)%len(c.Controllers)]
+			return
+		}
+	}
+	c.Controller = c.Controllers[0]
+}
+
 func (c *Client) getTopics() (map[string]*Topic, error) {
-	resp, err := client.Get(c.Controller + "/topics")
+	u := c.controller()
+	resp, err := client.Get(u + "/topics")
 	if err != nil {
+		c.failover(u)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -91,8 +241,10 @@ func (c *Client) getTopics() (map[string]*Topic, error) {
 }
 
 func (c *Client) getBuffers() (map[string]*Buffer, error) {
-	resp, err := client.Get(c.Controller + "/buffers")
+	u := c.controller()
+	resp, err := client.Get(u + "/buffers")
 	if err != nil {
+		c.failover(u)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -138,18 +290,34 @@ func (c *Client) handleGetTopics(req *http.Request) *router.Response {
 	return &router.Response{Body: j}
 }
 
-func (c *Client) createTopic(id string) error {
-	resp, err := client.Post(c.Controller+"/topics/"+id, "application/json", nil)
+// createTopic creates topic id, returning an error response if that failed.
+func (c *Client) createTopic(id string) *router.Response {
+	u := c.controller()
+	resp, err := client.Post(u+"/topics/"+id, "application/json", nil)
 	if err != nil {
-		return err
+		c.failover(u)
+		return &router.Response{Error: fmt.Errorf("error creating topic: %v", err)}
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
 	switch resp.StatusCode {
 	case http.StatusCreated, http.StatusConflict:
 		return nil
+	case http.StatusInsufficientStorage:
+		// over the tenant's topic quota
+		return passQuota(resp, body)
+	}
+	return &router.Response{Error: fmt.Errorf("error creating topic: (%d) %v", resp.StatusCode, string(body))}
+}
+
+// passQuota passes a quota exceeded or busy response from a controller or a
+// worker on to the user, with its Retry-After header.
+func passQuota(resp *http.Response, body []byte) *router.Response {
+	return &router.Response{
+		Error:      fmt.Errorf("%s", strings.TrimSpace(string(body))),
+		StatusCode: resp.StatusCode,
+		Header:     http.Header{"Retry-After": resp.Header["Retry-After"]},
 	}
-	return fmt.Errorf("error creating topic: (%d) %v", resp.StatusCode, string(body))
 }
 
 func (c *Client) handleWriteToTopic(req *http.Request) *router.Response {
@@ -159,8 +327,8 @@ func (c *Client) handleWriteToTopic(req *http.Request) *router.Response {
 	c.lock.Unlock()
 	// create topic if needed
 	if !ok {
-		if err := c.createTopic(topic); err != nil {
-			return &router.Response{Error: fmt.Errorf("error creating topic: %v", err)}
+		if resp := c.createTopic(topic); resp != nil {
+			return resp
 		}
 		err := c.updateMetadata()
 		if err != nil {
@@ -173,43 +341,130 @@ func (c *Client) handleWriteToTopic(req *http.Request) *router.Response {
 			return &router.Response{Error: fmt.Errorf("error writing to topic: couldn't create topic")}
 		}
 	}
-	// make a local copy of buffers
+	// keyed messages go to the buffer picked by hashing the key over the
+	// topic's buffer layout; when the topic grows the current layout changes,
+	// so producers that need keys to stay on the same buffers pin the epoch
+	ids := t.Buffers
+	if key := req.Header.Get("Hbuf-Key"); key != "" {
+		layout, err := t.layout(req.Header.Get("Hbuf-Epoch"))
+		if err != nil {
+			return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		i := int(h.Sum32() % uint32(len(layout)))
+		ids = layout[i : i+1]
+	}
+	// make a local copy of buffers, skipping buffers which asked to retry
+	// later, so that load goes to the others
 	c.lock.Lock()
-	buffers := make([]*Buffer, 0, len(t.Buffers))
-	for _, id := range t.Buffers {
+	buffers := make([]*Buffer, 0, len(ids))
+	var wait time.Duration
+	now := time.Now()
+	for _, id := range ids {
+		if until, ok := c.busy[id]; ok {
+			if now.Before(until) {
+				if d := until.Sub(now); wait == 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			delete(c.busy, id)
+		}
 		if b, ok := c.buffers[id]; ok {
 			buffers = append(buffers, b)
 		}
 	}
 	c.lock.Unlock()
+	// buffers on draining workers get writes only when no others can
+	active := make([]*Buffer, 0, len(buffers))
+	for _, b := range buffers {
+		if !b.Draining {
+			active = append(active, b)
+		}
+	}
+	if len(active) > 0 {
+		buffers = active
+	}
+	if len(buffers) == 0 && wait > 0 {
+		return &router.Response{
+			Error:      fmt.Errorf("error writing to topic %q: all buffers busy", t.ID),
+			StatusCode: http.StatusTooManyRequests,
+			Header:     router.RetryAfter(wait),
+		}
+	}
 	if len(buffers) == 0 {
 		return &router.Response{Error: fmt.Errorf("error writing to topic %q: no buffers registered", t.ID)}
 	}
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Printf("couldn't read message body: %v", err)
+		c.log.Errorf("couldn't read message body: %v", err)
 		return &router.Response{Error: fmt.Errorf("error writing to topic: couldn't read message body: %v")}
 	}
+	sealed := 0
+	var busy *router.Response
 	n := rand.Intn(len(buffers))
 	for i := n; i < n+len(buffers); i++ {
 		b := buffers[i%len(buffers)]
 		//dump, _ := httputil.DumpRequest(req, true)
 		//INFO.Println(string(dump))
 		//resp, err := http.Post(b.URL, req.Header.Get("Content-Type"), req.Body)
-		resp, err := client.Post(b.URL, req.Header.Get("Content-Type"), bytes.NewBuffer(data))
+		r, _ := http.NewRequestWithContext(req.Context(), "POST", b.URL, bytes.NewBuffer(data))
+		r.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+		if e := req.Header.Get("Content-Encoding"); e != "" {
+			r.Header.Set("Content-Encoding", e)
+		}
+		resp, err := client.Do(r)
 		if err != nil {
-			log.Println(err)
+			c.log.Errorf("%v", err)
 			continue
 		}
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			log.Printf("couldn't read response from worker for buffer: %v", err)
+			c.log.Errorf("couldn't read response from worker for buffer: %v", err)
 		}
 		if resp.StatusCode == http.StatusOK {
 			return &router.Response{Body: body, StatusCode: http.StatusOK}
 		}
-		log.Printf("error response when writing to buffer %q for topic %q: %v", b.ID, topic, string(body))
+		if resp.StatusCode == http.StatusConflict {
+			sealed += 1
+			continue
+		}
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			// all buffers of a topic have the same config
+			return &router.Response{Error: fmt.Errorf("%s", strings.TrimSpace(string(body))), StatusCode: resp.StatusCode}
+		}
+		if resp.StatusCode == http.StatusInsufficientStorage {
+			return passQuota(resp, body)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// the buffer (or its worker) is busy, or over the tenant's
+			// produce rate; other buffers may take the message
+			c.lock.Lock()
+			c.busy[b.ID] = time.Now().Add(curl.RetryAfter(resp))
+			c.lock.Unlock()
+			if busy == nil {
+				busy = passQuota(resp, body)
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			// the buffer may have been moved or deleted; refresh metadata
+			// so that following writes don't try it
+			go c.updateMetadata()
+		}
+		c.log.Warnf("error response when writing to buffer %q for topic %q: %v", b.ID, topic, string(body))
+	}
+	if sealed == len(buffers) {
+		return &router.Response{
+			Error:      fmt.Errorf("error writing to topic %q: topic is sealed", topic),
+			StatusCode: http.StatusConflict,
+		}
+	}
+	if busy != nil {
+		// no buffer took the message, and some asked to retry later
+		return busy
 	}
 	return &router.Response{
 		Error:      fmt.Errorf("error writing to topic: couldn't write to any buffer %v", buffers),
@@ -245,7 +500,7 @@ func (c *Client) handleConsumeFromTopic(req *http.Request) *router.Response {
 	}
 	c.lock.Unlock()
 	if len(buffers) == 0 {
-		log.Printf("no buffers for topic[s] %q found", mux.Vars(req)["topic"])
+		c.log.Debugf("no buffers for topic[s] %q found", mux.Vars(req)["topic"])
 		return &router.Response{StatusCode: http.StatusNoContent}
 	}
 	consumer := req.URL.Query().Get("c")
@@ -258,14 +513,25 @@ func (c *Client) handleConsumeFromTopic(req *http.Request) *router.Response {
 			StatusCode: http.StatusBadRequest,
 		}
 	}
+	// messages are charged against the consume rate once consumed, so
+	// that messages aren't consumed and then refused
+	if d := c.consume.Wait(); d > 0 {
+		return quota.Exceeded(http.StatusTooManyRequests, d, fmt.Errorf("consume rate of tenant %q over quota", c.Tenant))
+	}
 	n := rand.Intn(len(buffers))
 	for i := n; i < n+len(buffers); i++ {
 		b := buffers[i%len(buffers)]
 		url := b.URL + "/consumers/" + consumer + "/_next"
 		//DEBUG.Println(url)
-		resp, err := client.Post(url, "", nil)
+		r, _ := http.NewRequestWithContext(req.Context(), "POST", url, nil)
+		// set explicitly, so that the transport passes compressed bodies
+		// through as they are instead of decompressing them
+		if e := req.Header.Get("Accept-Encoding"); e != "" {
+			r.Header.Set("Accept-Encoding", e)
+		}
+		resp, err := client.Do(r)
 		if err != nil {
-			log.Printf("error making consume post request: %v", err)
+			c.log.Errorf("error making consume post request: %v", err)
 			return &router.Response{Error: fmt.Errorf("error connecting to buffer: %v", err)}
 		}
 		body, err := ioutil.ReadAll(resp.Body)
@@ -274,21 +540,28 @@ func (c *Client) handleConsumeFromTopic(req *http.Request) *router.Response {
 			continue
 		}
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("error consuming from buffer: (%d) %v", resp.StatusCode, err)
+			c.log.Errorf("error consuming from buffer: (%d) %v", resp.StatusCode, err)
 			continue
 		}
 		if err != nil {
-			log.Printf("error reading reponse body for consumed message: %v", err)
+			c.log.Errorf("error reading reponse body for consumed message: %v", err)
 			return &router.Response{Error: fmt.Errorf("error reading buffer response: %v", err)}
 		}
-		return &router.Response{Body: body, ContentType: resp.Header.Get("Content-Type")}
+		c.consume.Take(len(body))
+		header := make(http.Header)
+		for _, h := range []string{"Content-Encoding", message.RequestIDHeader, message.TraceparentHeader} {
+			if v := resp.Header.Get(h); v != "" {
+				header.Set(h, v)
+			}
+		}
+		return &router.Response{Body: body, ContentType: resp.Header.Get("Content-Type"), Header: header}
 	}
 	return &router.Response{StatusCode: http.StatusNoContent}
 }
 
 func (c *Client) handleDeleteTopic(req *http.Request) *router.Response {
 	t := mux.Vars(req)["topic"]
-	r, _ := http.NewRequest("DELETE", c.Controller+"/topics/"+t, nil)
+	r, _ := http.NewRequest("DELETE", c.controller()+"/topics/"+t, nil)
 	resp, err := client.Do(r)
 	if err != nil {
 		return &router.Response{
@@ -306,3 +579,179 @@ func (c *Client) handleDeleteTopic(req *http.Request) *router.Response {
 		StatusCode: http.StatusInternalServerError,
 	}
 }
+
+func (c *Client) sealTopic(topic string, action string) *router.Response {
+	resp, err := client.Post(c.controller()+"/topics/"+topic+"/"+action, "", nil)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error calling controller: %v", err)}
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &router.Response{
+			Error:      fmt.Errorf("error response from controller: (%d) %v", resp.StatusCode, string(body)),
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return &router.Response{Body: body}
+}
+
+func (c *Client) handleSealTopic(req *http.Request) *router.Response {
+	return c.sealTopic(mux.Vars(req)["topic"], "_seal")
+}
+
+func (c *Client) handleUnsealTopic(req *http.Request) *router.Response {
+	return c.sealTopic(mux.Vars(req)["topic"], "_unseal")
+}
+
+// copySnapshot copies the entries of a buffer snapshot archive into tw,
+// returning the contents of the buffer's manifest.
+func copySnapshot(tw *tar.Writer, r io.Reader) (json.RawMessage, error) {
+	var manifest json.RawMessage
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if path.Base(h.Name) != "manifest.json" {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		manifest, err = ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(manifest); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handleSnapshotTopic streams a tar archive with a directory for each of the
+// topic's buffers, and a manifest.json listing the manifests of all buffers.
+// Snapshots of all buffers are requested (and so their cut points recorded)
+// before any data is transferred.
+func (c *Client) handleSnapshotTopic(req *http.Request) *router.Response {
+	topic := mux.Vars(req)["topic"]
+	if err := c.updateMetadata(); err != nil {
+		return &router.Response{Error: fmt.Errorf("error getting metadata: %v", err)}
+	}
+	c.lock.Lock()
+	t, ok := c.topics[topic]
+	buffers := make([]*Buffer, 0)
+	if ok {
+		for _, id := range t.Buffers {
+			if b, ok := c.buffers[id]; ok {
+				buffers = append(buffers, b)
+			}
+		}
+	}
+	c.lock.Unlock()
+	if !ok {
+		return &router.Response{Error: fmt.Errorf("topic not found"), StatusCode: http.StatusNotFound}
+	}
+	if len(buffers) != len(t.Buffers) {
+		return &router.Response{Error: fmt.Errorf("not all buffers for topic %q are registered", topic)}
+	}
+	responses := make([]*http.Response, 0, len(buffers))
+	closeAll := func() {
+		for _, resp := range responses {
+			resp.Body.Close()
+		}
+	}
+	for _, b := range buffers {
+		resp, err := streamClient.Get(b.URL + "/_snapshot")
+		if err != nil {
+			closeAll()
+			return &router.Response{Error: fmt.Errorf("error getting snapshot of buffer %q: %v", b.ID, err)}
+		}
+		responses = append(responses, resp)
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			closeAll()
+			return &router.Response{Error: fmt.Errorf("error getting snapshot of buffer %q: (%d) %v", b.ID, resp.StatusCode, string(body))}
+		}
+	}
+	compress := req.URL.Query().Get("format") == "tar.gz"
+	stream := func(out io.Writer) error {
+		defer closeAll()
+		if compress {
+			gz := gzip.NewWriter(out)
+			defer gz.Close()
+			out = gz
+		}
+		tw := tar.NewWriter(out)
+		manifest := struct {
+			Topic   string            `json:"topic"`
+			TS      time.Time         `json:"ts"`
+			Buffers []json.RawMessage `json:"buffers"`
+		}{Topic: topic, TS: time.Now().UTC()}
+		for i, resp := range responses {
+			m, err := copySnapshot(tw, resp.Body)
+			if err != nil {
+				return fmt.Errorf("error copying snapshot of buffer %q: %v", buffers[i].ID, err)
+			}
+			manifest.Buffers = append(manifest.Buffers, m)
+		}
+		j, _ := json.Marshal(manifest)
+		h := &tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(j)), ModTime: time.Now()}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(j); err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+	ct := "application/x-tar"
+	if compress {
+		ct = "application/gzip"
+	}
+	return &router.Response{Stream: stream, ContentType: ct}
+}
+
+// handleRestoreTopic passes the tar archive in the request body on to the
+// controller, which places the buffers on workers. The topic name in the
+// request doesn't need to match the name of the topic the archive was made
+// from.
+func (c *Client) handleRestoreTopic(req *http.Request) *router.Response {
+	topic := mux.Vars(req)["topic"]
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Type") == "application/gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return &router.Response{Error: fmt.Errorf("error reading gzip archive: %v", err), StatusCode: http.StatusBadRequest}
+		}
+		body = gz
+	}
+	u := c.controller() + "/topics/" + topic + "/_restore"
+	if req.URL.Query().Get("offsets") == "true" {
+		u += "?offsets=true"
+	}
+	resp, err := streamClient.Post(u, "application/x-tar", body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error calling controller: %v", err)}
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return &router.Response{
+			Error:      fmt.Errorf("error restoring topic: (%d) %v", resp.StatusCode, strings.TrimSpace(string(b))),
+			StatusCode: resp.StatusCode,
+		}
+	}
+	// pick up the new topic on next write
+	if err := c.updateMetadata(); err != nil {
+		c.log.Errorf("error updating metadata after restore: %v", err)
+	}
+	return &router.Response{Body: b, StatusCode: http.StatusCreated}
+}
@@ -9,17 +9,14 @@ import (
 	"os/signal"
 	"sync"
 	"time"
+
+	"github.com/mkocikowski/hbuf/curl"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 256,
-		},
-		Timeout: 5 * time.Second,
-	}
-	wg   = sync.WaitGroup{}
-	done = make(chan bool)
+	client = curl.NewClient(256, 5*time.Second)
+	wg     = sync.WaitGroup{}
+	done   = make(chan bool)
 )
 
 func startConsumer(url string) {
@@ -12,7 +12,10 @@ import (
 	"github.com/mkocikowski/hbuf/cmd/hbuf/consume"
 	"github.com/mkocikowski/hbuf/cmd/hbuf/node"
 	"github.com/mkocikowski/hbuf/cmd/hbuf/produce"
+	"github.com/mkocikowski/hbuf/cmd/hbuf/restore"
 	"github.com/mkocikowski/hbuf/cmd/hbuf/stress"
+	"github.com/mkocikowski/hbuf/cmd/hbuf/verify"
+	"github.com/mkocikowski/hbuf/curl"
 )
 
 var (
@@ -25,25 +28,111 @@ var (
 	produce		read from stdin, write to specified topic
 	consume		consume from specified topic[s], write to stdout
 	stress		run "fake" load against specified cluster
+	restore		create topic from tar archive of buffer directories
+	verify		verify SHA chain of buffer directory, optionally encrypted
 
 When called with no arguments, starts an hbuf node on localhost:8080; this is
 for dev convenience, to run a "real" server see the "node" command.`
 )
 
+// tlsFlags adds -ca, -cert, -key and -token flags to fs. The returned function,
+// called after flags are parsed, configures TLS and credentials for all http
+// clients.
+func tlsFlags(fs *flag.FlagSet) func() {
+	ca := fs.String("ca", "", "PEM file with CA certificates to trust for https (default system roots)")
+	cert := fs.String("cert", "", "PEM file with client certificate, for servers requiring one")
+	key := fs.String("key", "", "PEM file with key of the client certificate")
+	token := fs.String("token", os.Getenv("HBUF_TOKEN"), "API token of the tenant, for nodes requiring authentication")
+	return func() {
+		curl.SetToken(*token)
+		if *ca == "" && *cert == "" && *key == "" {
+			return
+		}
+		c, err := curl.LoadTLSConfig(*ca, *cert, *key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		curl.SetTLSConfig(c)
+	}
+}
+
 func main() {
 
 	log.Printf("version: %s build: %s %s %s", Version, BuildHash, BuildDate, runtime.Version())
 
 	if len(os.Args) == 1 {
-		node.Run()
+		node.Run(node.DefaultConfig())
 		os.Exit(0)
 	}
 
 	switch os.Args[1] {
 	case "node":
 		fs := flag.NewFlagSet("node", flag.ExitOnError)
+		defaults := node.DefaultConfig()
+		path := fs.String("config", "", "path to JSON config file; flags override values set in it")
+		listen := fs.String("listen", defaults.Listen, "address to listen on")
+		url := fs.String("url", "", "URL of the node advertised to other nodes (default http://<listen>)")
+		data := fs.String("data", defaults.Data, "data directory")
+		role := fs.String("role", defaults.Role, "comma separated roles of the node: controller, worker, client, or all")
+		join := fs.String("join", "", "comma separated URLs of nodes running controllers; required for nodes without the controller role")
+		peers := fs.String("peers", "", "comma separated URLs of all controller nodes of the cluster; controllers are replicated among them")
+		labels := fs.String("labels", "", "worker labels used for placement, e.g. zone=a,rack=r1,host=h1")
+		ca := fs.String("ca", "", "PEM file with CA certificates; used to verify other nodes and client certificates")
+		cert := fs.String("cert", "", "PEM file with certificate of the node; when set, the node serves https")
+		key := fs.String("key", "", "PEM file with key of the node's certificate")
+		mtls := fs.Bool("mtls", false, "require client certificates signed by -ca on inter-node (manager and worker) routes")
+		authn := fs.Bool("auth", false, "require tokens: node credentials on node and inter-node routes, tenant tokens on client routes")
+		logFormat := fs.String("log-format", defaults.LogFormat, "log format: logfmt or json")
+		traceSpans := fs.Int("trace-spans", defaults.TraceSpans, "number of spans of recent requests kept for /debug/traces; 0 to not keep spans")
+		nodeToken := fs.String("node-token", "", "file with node credentials shared by all nodes of the cluster (default <data>/node_token, generated)")
+		fs.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Start hbuf server node.")
+			fs.PrintDefaults()
+		}
 		fs.Parse(os.Args[2:])
-		node.Run()
+		config := defaults
+		if *path != "" {
+			c, err := node.LoadConfig(*path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config = c
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				config.Listen = *listen
+			case "url":
+				config.URL = *url
+			case "data":
+				config.Data = *data
+			case "role":
+				config.Role = *role
+			case "join":
+				config.Join = node.ParseList(*join)
+			case "peers":
+				config.Peers = node.ParseList(*peers)
+			case "labels":
+				config.Labels = node.ParseLabels(*labels)
+			case "ca":
+				config.CA = *ca
+			case "cert":
+				config.Cert = *cert
+			case "key":
+				config.Key = *key
+			case "mtls":
+				config.MTLS = *mtls
+			case "auth":
+				config.Auth = *authn
+			case "node-token":
+				config.NodeToken = *nodeToken
+			case "log-format":
+				config.LogFormat = *logFormat
+			case "trace-spans":
+				config.TraceSpans = *traceSpans
+			}
+		})
+		node.Run(config)
 		os.Exit(0)
 	case "produce":
 		fs := flag.NewFlagSet("produce", flag.ExitOnError)
@@ -53,7 +142,9 @@ func main() {
 			fs.PrintDefaults()
 		}
 		ct := fs.String("content-type", "text/plain", "'Content-Type:' of the data")
+		setTLS := tlsFlags(fs)
 		fs.Parse(os.Args[2:])
+		setTLS()
 		produce.Run(*url, *ct)
 		os.Exit(0)
 	case "consume":
@@ -63,25 +154,60 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Consume messages from topic[s], write to stdout.")
 			fs.PrintDefaults()
 		}
+		setTLS := tlsFlags(fs)
 		fs.Parse(os.Args[2:])
+		setTLS()
 		consume.Run(*url)
 		os.Exit(0)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		url := fs.String("url", "http://localhost:8080/topics/test", "url of the topic to create")
+		file := fs.String("file", "-", "path to the tar (or .tar.gz) archive; '-' reads from stdin")
+		offsets := fs.Bool("offsets", false, "when set, restore consumer offsets")
+		fs.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Create topic from tar archive of buffer directories (such as made by /_snapshot).")
+			fs.PrintDefaults()
+		}
+		setTLS := tlsFlags(fs)
+		fs.Parse(os.Args[2:])
+		setTLS()
+		restore.Run(*url, *file, *offsets)
+		os.Exit(0)
+	case "verify":
+		fs := flag.NewFlagSet("verify", flag.ExitOnError)
+		dir := fs.String("dir", "", "buffer directory, as on a worker or unpacked from a snapshot")
+		keys := fs.String("keys", "", "key file of the tenant, for encrypted buffers")
+		dump := fs.Bool("dump", false, "when set, write message bodies to stdout, one per line")
+		fs.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Verify SHA chain of buffer directory not in use by a node.")
+			fs.PrintDefaults()
+		}
+		fs.Parse(os.Args[2:])
+		if *dir == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		verify.Run(*dir, *keys, *dump)
+		os.Exit(0)
 	case "stress":
 		fs := flag.NewFlagSet("stress", flag.ExitOnError)
 		config := fs.String("config", "", "path to the config file; uses default config when config=''")
 		example := fs.Bool("example", false, "when set, print default config to stdout and exit")
 		duration := fs.Duration("duration", 10*time.Second, "run for this long then exit")
+		statsURL := fs.String("stats", "", "stats url of a node, e.g. http://localhost:8080/stats; when set, its stats are reset on start, and stats of the run are written to stdout")
 		fs.Usage = func() {
 			fmt.Fprintln(os.Stderr, "Run load against configured endpoints.")
 			fs.PrintDefaults()
 		}
+		setTLS := tlsFlags(fs)
 		fs.Parse(os.Args[2:])
+		setTLS()
 		if *example {
 			j, _ := json.MarshalIndent(stress.DefaultConf, "", "  ")
 			fmt.Fprintf(os.Stdout, "%s\n", string(j))
 			os.Exit(1)
 		}
-		stress.Run(*config, *duration)
+		stress.Run(*config, *duration, *statsURL)
 	default:
 		fmt.Println(info)
 		os.Exit(2)
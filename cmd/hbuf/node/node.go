@@ -1,47 +1,262 @@
 package node
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
 	"github.com/mkocikowski/hbuf/node"
+	"github.com/mkocikowski/hbuf/tenant"
+	"github.com/mkocikowski/hbuf/trace"
+	"github.com/mkocikowski/hbuf/util"
 )
 
 var (
 	INFO = log.New(os.Stderr, "[INFO] ", 0)
 )
 
-func Run() {
+// Config of a node. It is read from a JSON file, and values set with command
+// line flags override values from the file.
+type Config struct {
+	Listen string            `json:"listen"` // address to listen on
+	URL    string            `json:"url"`    // advertised to other nodes; defaults to http://<listen>
+	Data   string            `json:"data"`   // data directory
+	Role   string            `json:"role"`   // comma separated: controller, worker, client, or all
+	Join   []string          `json:"join"`   // URLs of nodes running controllers, for nodes which don't
+	Peers  []string          `json:"peers"`  // URLs of all controller nodes, including this one
+	Labels map[string]string `json:"labels"` // worker labels used for placement
+	CA     string            `json:"ca"`     // PEM file with CA certificates
+	Cert   string            `json:"cert"`   // PEM file with the node's certificate; when set, the node serves https
+	Key    string            `json:"key"`    // PEM file with the key of the node's certificate
+	MTLS   bool              `json:"mtls"`   // require client certificates on inter-node routes
+	// require tokens on all routes; nodes authenticate with the token in
+	// file NodeToken, generated in the data directory when not set
+	Auth      bool   `json:"auth"`
+	NodeToken string `json:"node_token"`
+	LogFormat string `json:"log_format"` // logfmt or json
+	// spans of the last TraceSpans requests are kept for /debug/traces; 0
+	// to not keep spans
+	TraceSpans int `json:"trace_spans"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:    "localhost:8080",
+		Data:      "./data",
+		Role:      tenant.RoleAll,
+		LogFormat: logger.Logfmt,
+	}
+}
+
+// LoadConfig reads config from a JSON file. Fields not set in the file take
+// default values.
+func LoadConfig(path string) (*Config, error) {
+	//
+	config := DefaultConfig()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	return config, nil
+}
+
+// ParseLabels parses comma separated key=value pairs.
+func ParseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			continue
+		}
+		labels[p[0]] = p[1]
+	}
+	return labels
+}
+
+// ParseList parses a comma separated list, skipping empty items.
+func ParseList(s string) []string {
+	l := make([]string, 0)
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			l = append(l, x)
+		}
+	}
+	return l
+}
+
+// advertisedURL is the URL of the node when not set explicitly: the listen
+// address, with the host name filled in if listening on all interfaces.
+func (c *Config) advertisedURL() string {
+	//
+	if c.URL != "" {
+		return strings.TrimSuffix(c.URL, "/")
+	}
+	scheme := "http://"
+	if c.Cert != "" {
+		scheme = "https://"
+	}
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return scheme + c.Listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host, _ = os.Hostname()
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// nodeToken reads the node credentials from config.NodeToken, or from the
+// "node_token" file in the data directory, creating it if it doesn't exist.
+// All nodes of a cluster must use the same token.
+func (c *Config) nodeToken() (string, error) {
+	//
+	path := c.NodeToken
+	if path == "" {
+		path = filepath.Join(c.Data, "node_token")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.MkdirAll(c.Data, 0755); err != nil {
+				return "", err
+			}
+			if err := util.WriteFileAtomic(path, []byte(auth.Secret()+"\n"), 0600); err != nil {
+				return "", fmt.Errorf("error writing node token: %v", err)
+			}
+			log.Printf("generated node token in %q", path)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading node token: %v", err)
+	}
+	t := strings.TrimSpace(string(b))
+	if t == "" {
+		return "", fmt.Errorf("node token file %q is empty", path)
+	}
+	return t, nil
+}
+
+func Run(config *Config) {
 	//INFO.Println("starting...")
+	if err := logger.SetFormat(config.LogFormat); err != nil {
+		log.Fatal(err)
+	}
+	// messages of the standard library's log, such as from net/http, and
+	// from here, are logged in the same format
+	log.SetFlags(0)
+	log.SetOutput(logger.New("node").Writer(logger.Info))
+	if config.TraceSpans > 0 {
+		trace.SetRecorder(trace.NewRecorder(config.TraceSpans))
+	}
+	roles, err := tenant.ParseRoles(config.Role)
+	if err != nil {
+		log.Fatalf("error parsing role: %v", err)
+	}
+	if !roles.Has(tenant.RoleController) && len(config.Join) == 0 {
+		log.Fatalf("node with role %q must join nodes running controllers", config.Role)
+	}
+	if config.MTLS && (config.CA == "" || config.Cert == "") {
+		log.Fatalf("mtls requires ca and cert")
+	}
+	if config.CA != "" || config.Cert != "" {
+		// the node's certificate is also its client certificate for
+		// requests to other nodes
+		c, err := curl.LoadTLSConfig(config.CA, config.Cert, config.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		curl.SetTLSConfig(c)
+	}
+	token := ""
+	if config.Auth {
+		token, err = config.nodeToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		curl.SetToken(token)
+	}
 	n := &node.Node{
-		URL:  "http://localhost:8080",
-		Path: "./data",
+		URL:       config.advertisedURL(),
+		Path:      config.Data,
+		Labels:    config.Labels,
+		Peers:     config.Peers,
+		Roles:     roles,
+		Join:      config.Join,
+		MTLS:      config.MTLS,
+		NodeToken: token,
 	}
 	n.Init()
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		// Block until a signal is received.
-		<-c
-		//log.Println("got signal:", <-c)
-		n.Stop()
-		os.Exit(0)
-	}()
 	go func() {
 		n.Load()
 		n.AddTenant("-")
 	}()
 	//log.Fatal(http.ListenAndServe(fmt.Sprintf("localhost:%d", *port), n))
 	// https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	// snapshots and restores lift the read and write deadlines, see
+	// node.ServeHTTP
 	srv := &http.Server{
-		Addr:           "localhost:8080",
+		Addr:           config.Listen,
 		Handler:        n,
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   5 * time.Second,
 		MaxHeaderBytes: 1 << 12, // 4KB
 	}
-	log.Fatal(srv.ListenAndServe())
+	if config.Cert != "" {
+		c, err := curl.LoadServerTLSConfig(config.CA, config.Cert, config.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = c
+	}
+	done := make(chan bool)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		log.Printf("got %v, shutting down", <-c)
+		shutdown(n, srv)
+		close(done)
+	}()
+	if config.Cert == "" {
+		err = srv.ListenAndServe()
+	} else {
+		err = srv.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// how long a node shutting down waits for requests in flight
+const shutdownTimeout = 30 * time.Second
+
+// shutdown stops node n in order: controllers and clients are told to avoid
+// the node, the server stops accepting requests and waits for requests in
+// flight, and tenants are stopped: buffers wait for replicas to catch up and
+// save consumer offsets, and controllers save their state.
+func shutdown(n *node.Node, srv *http.Server) {
+	//
+	if err := n.Drain(true); err != nil {
+		log.Printf("%v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("error waiting for requests in flight: %v", err)
+	}
+	n.Stop()
 }
@@ -9,18 +9,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/mkocikowski/hbuf/curl"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 256,
-		},
-		Timeout: 5 * time.Second,
-	}
-	wg = sync.WaitGroup{}
+	client = curl.NewClient(256, 5*time.Second)
+	wg     = sync.WaitGroup{}
 	//done = make(chan bool)
 	data = make(chan []byte)
 )
@@ -29,24 +27,42 @@ func startProducer(url, contentType string) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		backoff := &curl.Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second}
 		for b := range data {
-			resp, err := client.Post(url, contentType, bytes.NewBuffer(b))
-			if err != nil {
-				log.Fatalln(url, err)
-			}
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Fatalln(url, err)
-			}
-			resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				log.Fatalln(url, string(body))
+			for !send(url, contentType, b, backoff) {
 			}
 		}
 		log.Println("exiting...")
 	}()
 }
 
+// send sends message b, returning false when it should be sent again, after
+// waiting for the backoff. Messages refused for good are logged and dropped.
+func send(url, contentType string, b []byte, backoff *curl.Backoff) bool {
+	//
+	resp, err := client.Post(url, contentType, bytes.NewBuffer(b))
+	if err != nil {
+		d := backoff.Next(nil)
+		log.Printf("%s: %v; retrying in %v", url, err, d)
+		time.Sleep(d)
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	switch {
+	case err == nil && resp.StatusCode == http.StatusOK:
+		backoff.Reset()
+		return true
+	case err != nil || curl.Retryable(resp.StatusCode):
+		d := backoff.Next(resp)
+		log.Printf("%s: (%d) %s; retrying in %v", url, resp.StatusCode, strings.TrimSpace(string(body)), d)
+		time.Sleep(d)
+		return false
+	}
+	log.Printf("%s: dropping message: (%d) %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
+	return true
+}
+
 func Run(url, contentType string) {
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -0,0 +1,52 @@
+package restore
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mkocikowski/hbuf/curl"
+)
+
+var (
+	// no timeout: archives can take a long time to upload
+	client = curl.NewClient(0, 0)
+)
+
+// Run sends the tar archive at path (or stdin when path is "-") to the restore
+// route of the topic at url.
+func Run(url, path string, offsets bool) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	ct := "application/x-tar"
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		ct = "application/gzip"
+	}
+	u := strings.TrimRight(url, "/") + "/_restore"
+	if offsets {
+		u += "?offsets=true"
+	}
+	resp, err := client.Post(u, ct, r)
+	if err != nil {
+		log.Fatalln(u, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalln(u, err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		log.Fatalln(resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	log.Printf("restored: %s", string(body))
+}
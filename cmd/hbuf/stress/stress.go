@@ -12,17 +12,14 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/mkocikowski/hbuf/curl"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 256,
-		},
-		Timeout: 5 * time.Second,
-	}
-	wg   = sync.WaitGroup{}
-	done = make(chan bool)
+	client = curl.NewClient(256, 5*time.Second)
+	wg     = sync.WaitGroup{}
+	done   = make(chan bool)
 	//
 	defaultProducerConf = &producerT{
 		URL:          "http://localhost:8080/topics/foo",
@@ -66,25 +63,15 @@ func startProducer(p *producerT) {
 	go func() {
 		defer wg.Done()
 		s := strings.Repeat("x", p.MsgSizeB)
+		backoff := &curl.Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second}
 		for {
 			select {
 			case <-done:
 				return
 			default:
 			}
-			resp, err := http.Post(p.URL, "text/plain", bytes.NewBufferString(s))
-			if err != nil {
-				log.Fatalln(err)
-			}
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				log.Fatalln(resp.StatusCode, string(body))
-			}
-			time.Sleep(time.Duration(p.WriteSleepMs) * time.Millisecond)
+			resp, err := client.Post(p.URL, "text/plain", bytes.NewBufferString(s))
+			sleep(check(resp, err, backoff, http.StatusOK), p.WriteSleepMs)
 		}
 	}()
 }
@@ -93,6 +80,7 @@ func startConsumer(c *consumerT) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		backoff := &curl.Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second}
 		for {
 			select {
 			case <-done:
@@ -100,25 +88,49 @@ func startConsumer(c *consumerT) {
 			default:
 			}
 			resp, err := client.Get(c.URL)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			resp.Body.Close()
-			switch resp.StatusCode {
-			case http.StatusOK:
-			case http.StatusNoContent:
-			default:
-				log.Fatalln(resp.StatusCode, string(body))
-			}
-			time.Sleep(time.Duration(c.ReadSleepMs) * time.Millisecond)
+			sleep(check(resp, err, backoff, http.StatusOK, http.StatusNoContent), c.ReadSleepMs)
 		}
 	}()
 }
 
+// check reads the response to a request, returning how long to back off
+// before the next request; 0 when the response status is one of ok. Errors
+// are logged; the stress test goes on.
+func check(resp *http.Response, err error, backoff *curl.Backoff, ok ...int) time.Duration {
+	//
+	if err != nil {
+		log.Println(err)
+		return backoff.Next(nil)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Println(err)
+		return backoff.Next(resp)
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			backoff.Reset()
+			return 0
+		}
+	}
+	log.Println(resp.StatusCode, strings.TrimSpace(string(body)))
+	return backoff.Next(resp)
+}
+
+// sleep waits for the backoff, or, when there is none, for ms milliseconds
+// between requests; it returns early when the test is done.
+func sleep(backoff time.Duration, ms int) {
+	d := backoff
+	if d == 0 {
+		d = time.Duration(ms) * time.Millisecond
+	}
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
+}
+
 func configure(filename string) (*confT, error) {
 	if filename == "" {
 		return DefaultConf, nil
@@ -134,11 +146,36 @@ func configure(filename string) (*confT, error) {
 	return c, nil
 }
 
-func Run(path string, duration time.Duration) {
+// stats gets node stats from u, starting a new stats window.
+func stats(u string) ([]byte, error) {
+	//
+	resp, err := client.Get(u + "?reset=true")
+	if err != nil {
+		return nil, fmt.Errorf("error getting stats: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stats: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting stats: (%d) %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// Run runs load for duration. When statsURL is set, node stats are reset on
+// start, and the stats of the run are written to stdout on exit.
+func Run(path string, duration time.Duration, statsURL string) {
 	conf, err := configure(path)
 	if err != nil {
 		log.Fatalf("error loading config: %v", err)
 	}
+	if statsURL != "" {
+		if _, err := stats(statsURL); err != nil {
+			log.Fatal(err)
+		}
+	}
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
@@ -158,4 +195,11 @@ func Run(path string, duration time.Duration) {
 	}
 	log.Printf("running for: %v", duration)
 	wg.Wait()
+	if statsURL != "" {
+		b, err := stats(statsURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(b)
+	}
 }
@@ -0,0 +1,62 @@
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mkocikowski/hbuf/buffer"
+	"github.com/mkocikowski/hbuf/codec"
+	"github.com/mkocikowski/hbuf/crypt"
+)
+
+// Run opens the buffer in directory dir, which must not be in use by a node,
+// and verifies its SHA chain (and, if the directory has a manifest.json, its
+// length and last SHA against the manifest). Encrypted buffers are read with
+// keys from the key file at keys. When dump is set, message bodies are
+// decompressed and written to stdout, one per line.
+func Run(dir, keys string, dump bool) {
+	//
+	b := &buffer.Buffer{ID: filepath.Base(dir), Path: dir}
+	if keys != "" {
+		k, err := crypt.Load(keys)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		b.Keys = k
+	}
+	if _, err := os.Stat(dir); err != nil {
+		log.Fatalln(err)
+	}
+	if err := b.Init(); err != nil {
+		log.Fatalf("error opening buffer: %v", err)
+	}
+	var manifest *buffer.Manifest
+	if j, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		manifest = new(buffer.Manifest)
+		if err := json.Unmarshal(j, manifest); err != nil {
+			log.Fatalf("error parsing manifest: %v", err)
+		}
+	}
+	if err := b.Verify(manifest); err != nil {
+		log.Fatalf("buffer %q failed verification: %v", dir, err)
+	}
+	log.Printf("buffer %q verified: messages %d to %d", dir, b.First(), b.Len-1)
+	if !dump {
+		return
+	}
+	for id := b.First(); id < b.Len; id++ {
+		m, err := b.Read(id)
+		if err != nil {
+			log.Fatalf("error reading message %d: %v", id, err)
+		}
+		body, err := codec.Decode(m.Encoding, m.Body)
+		if err != nil {
+			log.Fatalf("error decompressing message %d: %v", id, err)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", body)
+	}
+}
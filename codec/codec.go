@@ -0,0 +1,154 @@
+// Package codec compresses message bodies. Codecs are identified by name; the
+// name is recorded in the metadata of stored messages, and is used as the
+// value of Content-Encoding and Accept-Encoding headers.
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	Gzip  = "gzip"
+	Flate = "flate" // raw DEFLATE, as in compress/flate; not HTTP "deflate", which is zlib
+)
+
+type Codec interface {
+	Name() string
+	Compress([]byte) ([]byte, error)
+	NewReader(io.Reader) (io.ReadCloser, error) // decompresses what is read from r
+}
+
+// ErrorTooLarge is returned by DecodeMax when the decompressed body is larger
+// than allowed.
+var ErrorTooLarge = fmt.Errorf("decompressed body too large")
+
+var (
+	codecs = make(map[string]Codec)
+	lock   = new(sync.Mutex)
+)
+
+func init() {
+	Register(&gzipCodec{})
+	Register(&flateCodec{})
+}
+
+// Register makes codec c available by its name, replacing codec registered
+// under the same name, if any.
+func Register(c Codec) {
+	lock.Lock()
+	defer lock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func Get(name string) (Codec, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// Decode decompresses b encoded with codec name; when name is "" b is
+// returned as is.
+func Decode(name string, b []byte) ([]byte, error) {
+	//
+	return DecodeMax(name, b, 0)
+}
+
+// DecodeMax is Decode which reads no more than max bytes of the decompressed
+// body, and returns ErrorTooLarge if there is more; max 0 means no limit. It
+// is used on bodies sent by producers, which may not decompress to what they
+// claim.
+func DecodeMax(name string, b []byte, max int) ([]byte, error) {
+	//
+	if name == "" {
+		return b, nil
+	}
+	c, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > max {
+		return nil, ErrorTooLarge
+	}
+	return body, nil
+}
+
+// Accepts is true if the value of an Accept-Encoding header lists encoding
+// name, or "*", without q=0.
+func Accepts(header, name string) bool {
+	//
+	for _, e := range strings.Split(header, ",") {
+		p := strings.Split(e, ";")
+		n := strings.TrimSpace(p[0])
+		if n != name && n != "*" {
+			continue
+		}
+		if len(p) > 1 && strings.Replace(strings.TrimSpace(p[1]), " ", "", -1) == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+type gzipCodec struct{}
+
+func (c *gzipCodec) Name() string { return Gzip }
+
+func (c *gzipCodec) Compress(b []byte) ([]byte, error) {
+	out := new(bytes.Buffer)
+	w := gzip.NewWriter(out)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (c *gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type flateCodec struct{}
+
+func (c *flateCodec) Name() string { return Flate }
+
+func (c *flateCodec) Compress(b []byte) ([]byte, error) {
+	out := new(bytes.Buffer)
+	w, _ := flate.NewWriter(out, flate.DefaultCompression)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (c *flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
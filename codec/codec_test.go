@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	body := bytes.Repeat([]byte("foo bar "), 100)
+	for _, name := range []string{Gzip, Flate} {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := c.Compress(body)
+		if err != nil || len(b) >= len(body) {
+			t.Fatalf("unexpected result or error: %d %v", len(b), err)
+		}
+		if b, err = Decode(name, b); err != nil || !bytes.Equal(b, body) {
+			t.Fatalf("unexpected result or error: %q %v", b, err)
+		}
+	}
+	if _, err := Get("foo"); err == nil {
+		t.Fatalf("expected error for unknown codec")
+	}
+}
+
+func TestDecodeMax(t *testing.T) {
+	body := make([]byte, 10<<20)
+	for _, name := range []string{Gzip, Flate} {
+		c, _ := Get(name)
+		b, _ := c.Compress(body)
+		if _, err := DecodeMax(name, b, 1<<20); err != ErrorTooLarge {
+			t.Fatalf("%s: expected %v, got: %v", name, ErrorTooLarge, err)
+		}
+		if b, err := DecodeMax(name, b, len(body)); err != nil || len(b) != len(body) {
+			t.Fatalf("%s: unexpected result or error: %d %v", name, len(b), err)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		header string
+		name   string
+		ok     bool
+	}{
+		{"", Gzip, false},
+		{"gzip", Gzip, true},
+		{"br, gzip;q=0.8", Gzip, true},
+		{"gzip;q=0", Gzip, false},
+		{"gzip; q=0", Gzip, false},
+		{"*", Flate, true},
+		{"gzip", Flate, false},
+	}
+	for _, test := range tests {
+		if ok := Accepts(test.header, test.name); ok != test.ok {
+			t.Errorf("%q %q: expected %v got %v", test.header, test.name, test.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+// The tenant's access policy is part of the controller's state. Workers and
+// clients fetch it periodically, so changes take effect on them with a delay.
+
+func (c *Controller) aclRoutes() []*router.Route {
+	return []*router.Route{
+		{"/acl", []string{"GET"}, c.handleGetACL, ""},
+		{"/acl", []string{"POST"}, c.handleSetACL, ""},
+		{"/acl", []string{"DELETE"}, c.handleDeleteACL, ""},
+		{`/acl/roles/{role:[a-zA-Z0-9_\-]{1,256}}`, []string{"POST"}, c.handleSetRole, ""},
+		{`/acl/roles/{role:[a-zA-Z0-9_\-]{1,256}}`, []string{"DELETE"}, c.handleDeleteRole, ""},
+		{`/acl/principals/{principal:[a-zA-Z0-9_\-]{1,256}}`, []string{"POST"}, c.handleSetPrincipal, ""},
+		{`/acl/principals/{principal:[a-zA-Z0-9_\-]{1,256}}`, []string{"DELETE"}, c.handleDeletePrincipal, ""},
+	}
+}
+
+// policy returns the access policy in effect; nil when there is none.
+func (c *Controller) policy() *acl.Policy {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.access
+}
+
+// updatePolicy applies f to a copy of the policy (a new policy when there is
+// none), and, if the result is valid, saves it.
+func (c *Controller) updatePolicy(f func(*acl.Policy) error) *router.Response {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := acl.NewPolicy()
+	if c.access != nil {
+		j, _ := json.Marshal(c.access)
+		json.Unmarshal(j, p)
+	}
+	if err := f(p); err != nil {
+		return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+	}
+	if err := p.Validate(); err != nil {
+		return &router.Response{Error: fmt.Errorf("invalid policy: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	old := c.access
+	c.access = p
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			c.access = old
+		}
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	j, _ := json.Marshal(p)
+	return &router.Response{Body: j}
+}
+
+func (c *Controller) handleGetACL(req *http.Request) *router.Response {
+	//
+	c.lock.Lock()
+	j, _ := json.Marshal(c.access)
+	c.lock.Unlock()
+	return &router.Response{Body: j}
+}
+
+// handleSetACL replaces the policy; from then on principals are allowed only
+// what the policy grants them.
+func (c *Controller) handleSetACL(req *http.Request) *router.Response {
+	//
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	resp := c.updatePolicy(func(p *acl.Policy) error {
+		*p = acl.Policy{}
+		if err := json.Unmarshal(b, p); err != nil {
+			return fmt.Errorf("error parsing policy: %v", err)
+		}
+		return nil
+	})
+	if resp.Error == nil {
+		c.log.Infof("access policy of tenant %q set by %q", c.Tenant, acl.Principal(req))
+	}
+	return resp
+}
+
+// handleDeleteACL removes the policy: client routes are open to all
+// principals, worker and controller routes only to nodes.
+func (c *Controller) handleDeleteACL(req *http.Request) *router.Response {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.access
+	c.access = nil
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			c.access = old
+		}
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("access policy of tenant %q deleted by %q", c.Tenant, acl.Principal(req))
+	return &router.Response{}
+}
+
+func (c *Controller) handleSetRole(req *http.Request) *router.Response {
+	//
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	rules := make([]*acl.Rule, 0)
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return &router.Response{Error: fmt.Errorf("error parsing rules: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	return c.updatePolicy(func(p *acl.Policy) error {
+		p.Roles[mux.Vars(req)["role"]] = rules
+		return nil
+	})
+}
+
+func (c *Controller) handleDeleteRole(req *http.Request) *router.Response {
+	//
+	role := mux.Vars(req)["role"]
+	return c.updatePolicy(func(p *acl.Policy) error {
+		if _, ok := p.Roles[role]; !ok {
+			return fmt.Errorf("role %q not found", role)
+		}
+		delete(p.Roles, role)
+		return nil
+	})
+}
+
+// handleSetPrincipal sets the roles of a principal.
+func (c *Controller) handleSetPrincipal(req *http.Request) *router.Response {
+	//
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	roles := make([]string, 0)
+	if err := json.Unmarshal(b, &roles); err != nil {
+		return &router.Response{Error: fmt.Errorf("error parsing roles: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	return c.updatePolicy(func(p *acl.Policy) error {
+		p.Principals[mux.Vars(req)["principal"]] = roles
+		return nil
+	})
+}
+
+func (c *Controller) handleDeletePrincipal(req *http.Request) *router.Response {
+	//
+	principal := mux.Vars(req)["principal"]
+	return c.updatePolicy(func(p *acl.Policy) error {
+		delete(p.Principals, principal)
+		return nil
+	})
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+const (
+	// set on requests forwarded to the leader, so that they are not
+	// forwarded again if leadership changed in the meantime
+	forwardedHeader = "Hbuf-Forwarded-By"
+)
+
+// initRaft sets up replication of the controller's state among Peers. The
+// state is restored from the raft log; if there is none yet (for example the
+// controller used to run on its own) the state file is used.
+func (c *Controller) initRaft() error {
+	//
+	c.raft = newRaft(c.URL, c.Peers, c.Path, c.log)
+	c.raft.apply = c.applyState
+	c.raft.elected = c.onElected
+	if err := c.raft.load(); err != nil {
+		return err
+	}
+	if data := c.raft.committed(); data != nil {
+		return c.setState(data)
+	}
+	return c.load()
+}
+
+// setState replaces the controller's metadata with state encoded by save.
+// Must be called with the lock held.
+func (c *Controller) setState(data []byte) error {
+	//
+	state := State{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error parsing controller state: %v", err)
+	}
+	c.workers = make(map[string]*Worker)
+	c.topics = make(map[string]*Topic)
+	c.buffers = make(map[string]*Buffer)
+	c.replicas = make(map[string][]string)
+	c.tokens = make(map[string]*auth.Token)
+	for k, v := range state.Workers {
+		c.workers[k] = v
+	}
+	for k, v := range state.Topics {
+		c.topics[k] = v
+	}
+	for k, v := range state.Buffers {
+		c.buffers[k] = v
+	}
+	for k, v := range state.Replicas {
+		c.replicas[k] = v
+	}
+	for k, v := range state.Tokens {
+		c.tokens[k] = v
+	}
+	c.access = state.ACL
+	c.quotas = state.Quotas
+	return nil
+}
+
+// applyState is called by raft with committed state. The leader's state is
+// the source of what is committed, so it is not overwritten.
+func (c *Controller) applyState(data []byte) {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.raft.isLeader() {
+		return
+	}
+	if err := c.setState(data); err != nil {
+		c.log.Errorf("error applying replicated state: %v", err)
+	}
+}
+
+// onElected is called when this controller becomes the leader. The new
+// leader's log holds the latest state (possibly not yet applied), and the
+// leader takes over setting up replication of buffers.
+func (c *Controller) onElected() {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.raft.lock.Lock()
+	data := c.raft.latest()
+	c.raft.lock.Unlock()
+	if data != nil {
+		if err := c.setState(data); err != nil {
+			c.log.Errorf("error loading state on election: %v", err)
+		}
+	}
+	for p, r := range c.replicas {
+		go c.setReplicas(p, r)
+	}
+}
+
+// leaderOnly wraps handler h, so that requests made to a controller which is
+// not the leader are forwarded to the leader.
+func (c *Controller) leaderOnly(h router.HandlerFunc) router.HandlerFunc {
+	return func(req *http.Request) *router.Response {
+		if c.raft.isLeader() {
+			return h(req)
+		}
+		leader := c.raft.leaderURL()
+		if leader == "" || leader == c.URL || req.Header.Get(forwardedHeader) != "" {
+			return &router.Response{
+				Error:      fmt.Errorf("no controller leader available, try again later"),
+				StatusCode: http.StatusServiceUnavailable,
+			}
+		}
+		return c.forward(leader, req)
+	}
+}
+
+func (c *Controller) forward(leader string, req *http.Request) *router.Response {
+	//
+	base, _ := url.Parse(c.URL)
+	u := leader + strings.TrimPrefix(req.URL.Path, base.Path)
+	if req.URL.RawQuery != "" {
+		u += "?" + req.URL.RawQuery
+	}
+	r, err := http.NewRequest(req.Method, u, req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error creating request to leader: %v", err)}
+	}
+	r.Header = req.Header.Clone()
+	r.Header.Set(forwardedHeader, c.URL)
+	// the leader is called with this node's credentials, on behalf of the
+	// principal the request was authorized as
+	r.Header.Del("Authorization")
+	r.Header.Set(acl.PrincipalHeader, acl.Principal(req))
+	resp, err := streamClient.Do(r)
+	if err != nil {
+		return &router.Response{
+			Error:      fmt.Errorf("error forwarding request to leader %q: %v", leader, err),
+			StatusCode: http.StatusServiceUnavailable,
+		}
+	}
+	return &router.Response{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Stream: func(w io.Writer) error {
+			defer resp.Body.Close()
+			_, err := io.Copy(w, resp.Body)
+			return err
+		},
+	}
+}
@@ -5,24 +5,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/buffer"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/quota"
 	"github.com/mkocikowski/hbuf/router"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 5000,
-		},
-		Timeout: 5 * time.Second,
-	}
+	client = curl.NewClient(5000, 5*time.Second)
+	// used for requests which can take longer than 5s to transfer, such as
+	// restores; only the time to get the response headers is limited
+	streamClient = curl.NewStreamClient(5 * time.Second)
 )
 
 type Buffer struct {
@@ -30,80 +33,168 @@ type Buffer struct {
 	URL string `json:"url"`
 }
 
+const (
+	DefaultTopicBuffers  = 3
+	DefaultTopicReplicas = 2
+	MaxTopicBuffers      = 1 << 10
+	MaxTopicReplicas     = 8
+)
+
+// TopicConfig determines how many primary buffers a topic is created with,
+// how many replicas each primary has, and the config of the buffers.
+type TopicConfig struct {
+	Buffers  int            `json:"buffers"`
+	Replicas int            `json:"replicas"`
+	Config   *buffer.Config `json:"config"`
+}
+
+func DefaultTopicConfig() *TopicConfig {
+	return &TopicConfig{
+		Buffers:  DefaultTopicBuffers,
+		Replicas: DefaultTopicReplicas,
+		Config:   buffer.DefaultConfig(),
+	}
+}
+
+// copy returns a deep copy of the config, so that it can be used as a base
+// for overrides without modifying the original.
+func (c *TopicConfig) copy() *TopicConfig {
+	x := *c
+	x.Config = buffer.DefaultConfig()
+	if c.Config != nil {
+		*x.Config = *c.Config
+	}
+	return &x
+}
+
+func (c *TopicConfig) Validate() error {
+	switch {
+	case c.Buffers < 1 || c.Buffers > MaxTopicBuffers:
+		return fmt.Errorf("buffers must be between 1 and %d", MaxTopicBuffers)
+	case c.Replicas < 0 || c.Replicas > MaxTopicReplicas:
+		return fmt.Errorf("replicas must be between 0 and %d", MaxTopicReplicas)
+	}
+	return c.Config.Validate()
+}
+
+// Topic's buffer list is append-only: buffers are added at the end when the
+// topic grows, and moved buffers keep their position. Epochs records the
+// length of the buffer list after each change, so the layout of epoch n is
+// Buffers[:Epochs[n]]. Producers that route messages by hashing a key over
+// the buffer list can keep using the layout of an older epoch, so that
+// existing keys keep mapping to the same buffers after the topic grows.
 type Topic struct {
-	ID      string   `json:"id"`
-	Buffers []string `json:"buffers"`
+	ID      string       `json:"id"`
+	Buffers []string     `json:"buffers"`
+	Epochs  []int        `json:"epochs"`
+	Sealed  bool         `json:"sealed"`
+	Config  *TopicConfig `json:"config,omitempty"`
 }
 
 type Worker struct {
-	ID  string `json:"id"`
-	URL string `json:"url"`
+	ID        string            `json:"id"`
+	URL       string            `json:"url"`
+	Labels    map[string]string `json:"labels"`
+	FreeBytes uint64            `json:"free_bytes"`
+	UsedBytes int64             `json:"used_bytes"` // size of the worker's buffers
+	Draining  bool              `json:"draining,omitempty"`
 }
 
 type State struct {
-	Workers map[string]*Worker `json:"workers"`
-	Topics  map[string]*Topic  `json:"topics"`
-	Buffers map[string]*Buffer `json:"buffers"`
+	Workers  map[string]*Worker  `json:"workers"`
+	Topics   map[string]*Topic   `json:"topics"`
+	Buffers  map[string]*Buffer  `json:"buffers"`
+	Replicas map[string][]string `json:"replicas"`
+	ACL      *acl.Policy         `json:"acl,omitempty"`
+	Quotas   *quota.Quotas       `json:"quotas,omitempty"`
+	// API tokens of the tenant, with the hashes of their secrets
+	Tokens map[string]*auth.Token `json:"tokens,omitempty"`
 }
 
 type Controller struct {
-	ID       string `json:"id"`
-	URL      string `json:"url"`
-	Tenant   string `json:"-"`
-	Path     string `json:"-"`
+	ID       string       `json:"id"`
+	URL      string       `json:"url"`
+	Tenant   string       `json:"-"`
+	Path     string       `json:"-"`
+	Defaults *TopicConfig `json:"defaults"` // for topics created without explicit config
+	Peers    []string     `json:"peers"`    // URLs of controllers (including this one) the state is replicated among
 	routes   []*router.Route
 	workers  map[string]*Worker
 	topics   map[string]*Topic
 	buffers  map[string]*Buffer
 	replicas map[string][]string
+	moving   map[string]bool
+	access   *acl.Policy   // nil when there is no access policy
+	quotas   *quota.Quotas // nil when there are no quotas
+	tokens   map[string]*auth.Token
+	raft     *raft
 	running  bool
-	n        int
 	lock     *sync.Mutex
+	log      *logger.Logger
 }
 
 func (c *Controller) Init() (*Controller, error) {
 	//
+	c.log = logger.New("controller").With("tenant", c.Tenant, "controller", c.ID)
 	c.workers = make(map[string]*Worker)
 	c.topics = make(map[string]*Topic)
 	c.buffers = make(map[string]*Buffer)
 	c.replicas = make(map[string][]string)
+	c.moving = make(map[string]bool)
+	c.tokens = make(map[string]*auth.Token)
+	if c.Defaults == nil {
+		c.Defaults = DefaultTopicConfig()
+	}
 	c.lock = new(sync.Mutex)
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	//
 	c.routes = []*router.Route{
 		{"", []string{"GET"}, c.handleGetInfo, ""},
+		{"/_status", []string{"GET"}, c.handleGetStatus, ""},
 		{"/workers", []string{"POST"}, c.handleRegisterWorker, ""},
 		{"/workers", []string{"GET"}, c.handleGetWorkers, ""},
 		{"/topics", []string{"GET"}, c.handleGetTopics, ""},
 		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"POST"}, c.handleCreateTopic, ""},
 		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"DELETE"}, c.handleDeleteTopic, ""},
 		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}`, []string{"GET"}, c.handleGetTopic, ""},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_seal`, []string{"POST"}, c.handleSealTopic, ""},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_unseal`, []string{"POST"}, c.handleUnsealTopic, ""},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/_restore`, []string{"POST"}, c.handleRestoreTopic, ""},
+		{`/topics/{topic:[a-zA-Z0-9_\-]{1,256}}/buffers`, []string{"POST"}, c.handleGrowTopic, ""},
 		{"/buffers", []string{"POST"}, c.handleRegisterBuffer, ""},
 		{"/buffers", []string{"GET"}, c.handleGetBuffers, ""},
 		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"GET"}, c.handleGetBuffer, ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/_move", []string{"POST"}, c.handleMoveBuffer, ""},
 	}
+	c.routes = append(c.routes, c.aclRoutes()...)
+	c.routes = append(c.routes, c.quotaRoutes()...)
+	c.routes = append(c.routes, c.tokenRoutes()...)
 	//
-	if _, err := os.Stat(c.Path); os.IsNotExist(err) {
-		// directory doesn't exist, assume "fresh" node
-		return c, nil
-	}
-	t, err := ioutil.ReadFile(filepath.Join(c.Path, "topics"))
-	if err != nil {
-		log.Printf("error reading topics data: %v", err)
+	if len(c.Peers) > 1 {
+		if err := c.initRaft(); err != nil {
+			return nil, err
+		}
+		for _, r := range c.routes {
+			r.Handler = c.leaderOnly(r.Handler)
+		}
+		c.routes = append(c.routes,
+			&router.Route{"/_raft", []string{"GET"}, c.raft.handleGetStatus, ""},
+			&router.Route{"/_raft/vote", []string{"POST"}, c.raft.handleVote, ""},
+			&router.Route{"/_raft/append", []string{"POST"}, c.raft.handleAppend, ""},
+		)
+		c.enforce()
+		// replication of buffers is set up once this controller is elected
+		c.raft.start()
 		return c, nil
 	}
-	if err := json.Unmarshal(t, &c.topics); err != nil {
-		return nil, fmt.Errorf("error parsing topics data: %v", err)
-	}
-	//
-	r, err := ioutil.ReadFile(filepath.Join(c.Path, "replicas"))
-	if err != nil {
-		log.Printf("error reading replicas data: %v", err)
+	c.enforce()
+	if _, err := os.Stat(c.Path); os.IsNotExist(err) {
+		// directory doesn't exist, assume "fresh" node
 		return c, nil
 	}
-	if err := json.Unmarshal(r, &c.replicas); err != nil {
-		return nil, fmt.Errorf("error parsing replicas data: %v", err)
+	if err := c.load(); err != nil {
+		return nil, err
 	}
 	for p, r := range c.replicas {
 		go c.setReplicas(p, r)
@@ -112,6 +203,15 @@ func (c *Controller) Init() (*Controller, error) {
 	return c, nil
 }
 
+// enforce wraps handlers of all routes with checks of the access policy. All
+// controller routes are admin routes; without a policy only nodes can use
+// them.
+func (c *Controller) enforce() {
+	for _, r := range c.routes {
+		r.Handler = acl.Enforce(c.policy, false, acl.Admin, acl.Topics, r.Handler)
+	}
+}
+
 func (c *Controller) Routes() []*router.Route {
 	return c.routes
 }
@@ -121,23 +221,32 @@ func (c *Controller) Stop() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.running = false
-	os.MkdirAll(c.Path, 0755)
-	t, _ := json.Marshal(c.topics)
-	ioutil.WriteFile(filepath.Join(c.Path, "topics"), t, 0644)
-	r, _ := json.Marshal(c.replicas)
-	ioutil.WriteFile(filepath.Join(c.Path, "replicas"), r, 0644)
-	log.Printf("controller %q stopped", c.ID)
+	if c.raft != nil {
+		// the state is saved as it is committed
+		c.raft.stop()
+	} else if err := c.save(); err != nil {
+		c.log.Errorf("error saving controller state: %v", err)
+	}
+	c.log.Infof("controller %q stopped", c.ID)
 }
 
 func (c *Controller) handleGetInfo(req *http.Request) *router.Response {
 	//
 	c.lock.Lock()
-	state := State{
-		Topics:  c.topics,
-		Buffers: c.buffers,
-		Workers: c.workers,
+	info := struct {
+		State
+		Usage *quota.Usage `json:"usage"`
+	}{
+		State: State{
+			Topics:   c.topics,
+			Buffers:  c.buffers,
+			Workers:  c.workers,
+			Replicas: c.replicas,
+			Quotas:   c.quotas,
+		},
+		Usage: c.usage(),
 	}
-	j, _ := json.Marshal(state)
+	j, _ := json.Marshal(info)
 	c.lock.Unlock()
 	return &router.Response{Body: j}
 }
@@ -156,9 +265,16 @@ func (c *Controller) handleRegisterWorker(req *http.Request) *router.Response {
 		}
 	}
 	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := c.workerChanged(w)
 	c.workers[w.ID] = w
-	c.lock.Unlock()
-	log.Printf("registered worker: %v", w.URL)
+	if !changed {
+		return &router.Response{StatusCode: http.StatusNoContent}
+	}
+	if err := c.save(); err != nil {
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("registered worker: %v", w.URL)
 	return &router.Response{StatusCode: http.StatusNoContent}
 }
 
@@ -185,14 +301,36 @@ func (c *Controller) handleRegisterBuffer(req *http.Request) *router.Response {
 	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if b, ok := c.buffers[remote.ID]; ok && b.URL == remote.URL {
+		return &router.Response{StatusCode: http.StatusNoContent}
+	}
 	c.buffers[remote.ID] = remote
+	if err := c.save(); err != nil {
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
 	return &router.Response{StatusCode: http.StatusNoContent}
 }
 
+// bufferInfo is a buffer as listed by the controller: buffers on draining
+// workers are marked, so that clients write to other buffers.
+type bufferInfo struct {
+	*Buffer
+	Draining bool `json:"draining,omitempty"`
+}
+
 func (c *Controller) handleGetBuffers(req *http.Request) *router.Response {
 	//
 	c.lock.Lock()
-	j, _ := json.Marshal(c.buffers)
+	buffers := make(map[string]*bufferInfo, len(c.buffers))
+	for id, b := range c.buffers {
+		buffers[id] = &bufferInfo{Buffer: b}
+		for _, w := range c.workers {
+			if w.Draining && c.onWorker(b, w) {
+				buffers[id].Draining = true
+			}
+		}
+	}
+	j, _ := json.Marshal(buffers)
 	c.lock.Unlock()
 	return &router.Response{Body: j}
 }
@@ -209,30 +347,24 @@ func (c *Controller) handleGetBuffer(req *http.Request) *router.Response {
 	return &router.Response{Body: j}
 }
 
-func (c *Controller) pickWorker() (*Worker, error) {
+func (c *Controller) createBuffer(config *buffer.Config) (*Buffer, error) {
 	//
-	if len(c.workers) == 0 {
-		return nil, fmt.Errorf("no workers registered")
-	}
-	n := c.n % len(c.workers)
-	w := &Worker{}
-	for _, w = range c.workers {
-		if n == 0 {
-			break
-		}
-		n -= 1
+	w, err := c.pickWorker()
+	if err != nil {
+		return nil, fmt.Errorf("error picking worker for new buffer: %v", err)
 	}
-	c.n += 1
-	return w, nil
+	return c.createBufferOn(w, config)
 }
 
-func (c *Controller) createBuffer() (*Buffer, error) {
+// createBufferOn creates a buffer on worker w. When config is nil, the worker
+// uses the default buffer config.
+func (c *Controller) createBufferOn(w *Worker, config *buffer.Config) (*Buffer, error) {
 	//
-	w, err := c.pickWorker()
-	if err != nil {
-		return nil, fmt.Errorf("error picking worker for new buffer: %v", err)
+	var j []byte
+	if config != nil {
+		j, _ = json.Marshal(config)
 	}
-	resp, err := client.Post(w.URL+"/buffers", "", nil)
+	resp, err := client.Post(w.URL+"/buffers", "application/json", bytes.NewBuffer(j))
 	if err != nil {
 		return nil, fmt.Errorf("error making create buffer request: %v", err)
 	}
@@ -251,6 +383,25 @@ func (c *Controller) createBuffer() (*Buffer, error) {
 	return b, nil
 }
 
+// postReplicas makes a single attempt at setting the replicas of buffer b.
+func (c *Controller) postReplicas(b *Buffer, replicas []string) error {
+	//
+	j, _ := json.Marshal(replicas)
+	resp, err := client.Post(b.URL+"/replicas", "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		return fmt.Errorf("error making set replicas request: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading response body for set replicas request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error making set replicas request: (%d) %v", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
 func (c *Controller) setReplicas(primary string, replicas []string) {
 	//
 	for {
@@ -258,66 +409,133 @@ func (c *Controller) setReplicas(primary string, replicas []string) {
 		b, ok := c.buffers[primary]
 		c.lock.Unlock()
 		if !ok {
-			log.Printf("buffer %q not registered with controller, can't set replicas", primary)
+			c.log.Warnf("buffer %q not registered with controller, can't set replicas", primary)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		j, _ := json.Marshal(replicas)
-		resp, err := client.Post(b.URL+"/replicas", "application/json", bytes.NewBuffer(j))
-		if err != nil {
-			log.Printf("error making set replicas request: %v", err)
+		if err := c.postReplicas(b, replicas); err != nil {
+			c.log.Errorf("%v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+		c.log.Infof("replicas %q for buffer %q set successfuly", replicas, b.ID)
+		return
+	}
+}
+
+// createPrimary creates a primary buffer of topic and its replicas, and
+// starts setting up replication. If there are not enough workers to hold all
+// the copies of the buffer on separate workers, fewer replicas are created.
+func (c *Controller) createPrimary(topic string, config *TopicConfig) (*Buffer, *Placement, error) {
+	//
+	w, reason, err := c.placeCopy(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error picking worker for primary buffer: %v", err)
+	}
+	bc := buffer.DefaultConfig()
+	if config.Config != nil {
+		*bc = *config.Config
+	}
+	bc.Topic = topic
+	b, err := c.createBufferOn(w, bc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating primary buffer: %v", err)
+	}
+	c.buffers[b.ID] = b
+	p := &Placement{Buffer: b.ID, Worker: w.ID, Labels: w.Labels, Reason: reason}
+	if config.Replicas == 0 {
+		return b, p, nil
+	}
+	copies := []*Worker{w}
+	replicas := make([]string, 0, config.Replicas)
+	for i := 0; i < config.Replicas; i++ {
+		w, reason, err := c.placeCopy(copies)
 		if err != nil {
-			log.Printf("error reading response body for set replicas request: %v", string(body))
-			time.Sleep(1 * time.Second)
-			continue
+			p.Warnings = append(p.Warnings, fmt.Sprintf("created %d of %d replicas: %v", i, config.Replicas, err))
+			break
 		}
-		if resp.StatusCode == http.StatusOK {
-			log.Printf("replicas %q for buffer %q set successfuly", replicas, b.ID)
-			return
+		r, err := c.createBufferOn(w, bc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating replica buffer: %v", err)
 		}
-		fmt.Printf("error making set replicas request: (%d) %v", resp.StatusCode, string(body))
-		time.Sleep(1 * time.Second)
+		c.buffers[r.ID] = r
+		replicas = append(replicas, r.ID)
+		copies = append(copies, w)
+		p.Replicas = append(p.Replicas, &Placement{Buffer: r.ID, Worker: w.ID, Labels: w.Labels, Reason: reason})
 	}
+	if len(replicas) > 0 {
+		c.replicas[b.ID] = replicas
+		go c.setReplicas(b.ID, replicas)
+	}
+	return b, p, nil
 }
 
-func (c *Controller) createTopic(id string) (*Topic, error) {
+func (c *Controller) createTopic(id string, config *TopicConfig) (*Topic, []*Placement, error) {
 	//
 	t := &Topic{
 		ID:      id,
-		Buffers: make([]string, 0, 3),
+		Buffers: make([]string, 0, config.Buffers),
+		Config:  config,
 	}
-	for i := 0; i < 3; i++ {
-		b, err := c.createBuffer()
+	placement := make([]*Placement, 0, config.Buffers)
+	for i := 0; i < config.Buffers; i++ {
+		b, p, err := c.createPrimary(id, config)
 		if err != nil {
 			// TODO: cleanup buffers that have already been created?
-			return nil, fmt.Errorf("error creating primary buffer: %v", err)
+			return nil, nil, err
 		}
-		c.buffers[b.ID] = b
 		t.Buffers = append(t.Buffers, b.ID)
-		//
-		replicas := make([]string, 0, 2)
-		for i := 0; i < 2; i++ {
-			r, err := c.createBuffer()
-			if err != nil {
-				return nil, fmt.Errorf("error creating replica buffer: %v", err)
+		placement = append(placement, p)
+	}
+	t.Epochs = []int{len(t.Buffers)}
+	return t, placement, nil
+}
+
+// growTopic adds count primary buffers (with replicas) to the end of the
+// topic's buffer list, and starts a new layout epoch.
+func (c *Controller) growTopic(t *Topic, count int) ([]*Placement, error) {
+	//
+	config := t.Config
+	if config == nil {
+		config = c.Defaults
+	}
+	if len(t.Epochs) == 0 {
+		// topic created before epochs were recorded
+		t.Epochs = []int{len(t.Buffers)}
+	}
+	placement := make([]*Placement, 0, count)
+	for i := 0; i < count; i++ {
+		b, p, err := c.createPrimary(t.ID, config)
+		if err != nil {
+			if i > 0 {
+				// keep what was created, so that it is not orphaned
+				t.Epochs = append(t.Epochs, len(t.Buffers))
 			}
-			c.buffers[r.ID] = r
-			replicas = append(replicas, r.ID)
+			return nil, err
 		}
-		c.replicas[b.ID] = replicas
-		go c.setReplicas(b.ID, replicas)
+		t.Buffers = append(t.Buffers, b.ID)
+		placement = append(placement, p)
 	}
-	return t, nil
+	t.Epochs = append(t.Epochs, len(t.Buffers))
+	return placement, nil
+}
+
+// topicPlacement is the response to requests creating buffers for a topic.
+type topicPlacement struct {
+	*Topic
+	Placement []*Placement `json:"placement"`
 }
 
+// handleCreateTopic creates a topic. Optional request body is a JSON topic
+// config; fields not set in it (including fields of the buffer config) take
+// the controller's default values.
 func (c *Controller) handleCreateTopic(req *http.Request) *router.Response {
 	//
 	id := mux.Vars(req)["topic"]
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading create topic request body: %v", err)}
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	//
@@ -327,19 +545,93 @@ func (c *Controller) handleCreateTopic(req *http.Request) *router.Response {
 			StatusCode: http.StatusConflict,
 		}
 	}
-	t, err := c.createTopic(id)
+	if resp := c.checkTopics(); resp != nil {
+		return resp
+	}
+	config := c.Defaults.copy()
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, config); err != nil {
+			return &router.Response{
+				Error:      fmt.Errorf("error parsing topic config: %v", err),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+	if config.Config == nil {
+		config.Config = buffer.DefaultConfig()
+	}
+	if err := config.Validate(); err != nil {
+		return &router.Response{
+			Error:      fmt.Errorf("invalid topic config: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	t, placement, err := c.createTopic(id, config)
 	if err != nil {
-		log.Printf("error creating topic: %v", err)
+		c.log.Errorf("error creating topic: %v", err)
 		return &router.Response{
 			Error:      fmt.Errorf("error creating topic: %v", err),
 			StatusCode: http.StatusInternalServerError,
 		}
 	}
 	c.topics[id] = t
-	j, _ := json.Marshal(t)
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			delete(c.topics, id)
+		}
+		return &router.Response{Error: fmt.Errorf("error creating topic: %v", err), StatusCode: saveStatus(err)}
+	}
+	j, _ := json.Marshal(&topicPlacement{Topic: t, Placement: placement})
 	return &router.Response{Body: j, StatusCode: http.StatusCreated}
 }
 
+// handleGrowTopic adds ?count= (default 1) buffers to the topic.
+func (c *Controller) handleGrowTopic(req *http.Request) *router.Response {
+	//
+	id := mux.Vars(req)["topic"]
+	count := 1
+	if s := req.URL.Query().Get("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return &router.Response{
+				Error:      fmt.Errorf("count must be a positive integer"),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		count = n
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, ok := c.topics[id]
+	if !ok {
+		return &router.Response{Error: fmt.Errorf("topic not found"), StatusCode: http.StatusNotFound}
+	}
+	if t.Sealed {
+		return &router.Response{
+			Error:      fmt.Errorf("topic %q is sealed", id),
+			StatusCode: http.StatusConflict,
+		}
+	}
+	if len(t.Buffers)+count > MaxTopicBuffers {
+		return &router.Response{
+			Error:      fmt.Errorf("topic can't have more than %d buffers", MaxTopicBuffers),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	placement, err := c.growTopic(t, count)
+	// buffers added before an error are kept, so save either way
+	if err := c.save(); err != nil {
+		return &router.Response{Error: fmt.Errorf("error adding buffers to topic: %v", err), StatusCode: saveStatus(err)}
+	}
+	if err != nil {
+		c.log.Errorf("error growing topic %q: %v", id, err)
+		return &router.Response{Error: fmt.Errorf("error adding buffers to topic: %v", err)}
+	}
+	c.log.Infof("added %d buffers to topic %q", count, id)
+	j, _ := json.Marshal(&topicPlacement{Topic: t, Placement: placement})
+	return &router.Response{Body: j}
+}
+
 func (c *Controller) handleGetTopics(req *http.Request) *router.Response {
 	//
 	c.lock.Lock()
@@ -371,7 +663,7 @@ func (c *Controller) deleteBuffer(id string) error {
 	r, _ := http.NewRequest("DELETE", b.URL, nil)
 	resp, err := client.Do(r)
 	if err != nil {
-		fmt.Errorf("error making request to worker: %v", err)
+		return fmt.Errorf("error making request to worker: %v", err)
 	}
 	body, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
@@ -394,10 +686,10 @@ func (c *Controller) deleteTopic(id string) error {
 	delete(c.topics, id)
 	for _, b := range t.Buffers {
 		if err := c.deleteBuffer(b); err != nil {
-			log.Printf("error deleting buffer for topic %q; this buffer is now orphaned: %v", id, err)
+			c.log.Errorf("error deleting buffer for topic %q; this buffer is now orphaned: %v", id, err)
 		}
 	}
-	return nil
+	return c.save()
 }
 
 func (c *Controller) handleDeleteTopic(req *http.Request) *router.Response {
@@ -405,7 +697,100 @@ func (c *Controller) handleDeleteTopic(req *http.Request) *router.Response {
 	id := mux.Vars(req)["topic"]
 	err := c.deleteTopic(id)
 	if err != nil {
-		return &router.Response{Error: fmt.Errorf("error deleting topic: %v", err)}
+		return &router.Response{Error: fmt.Errorf("error deleting topic: %v", err), StatusCode: saveStatus(err)}
 	}
 	return &router.Response{StatusCode: http.StatusOK}
 }
+
+// sealBuffer seals or unseals a single buffer on its worker.
+func (c *Controller) sealBuffer(id string, sealed bool) error {
+	//
+	b, ok := c.buffers[id]
+	if !ok {
+		return fmt.Errorf("buffer %q not registered with controller", id)
+	}
+	u := b.URL + "/_seal"
+	if !sealed {
+		u = b.URL + "/_unseal"
+	}
+	resp, err := client.Post(u, "", nil)
+	if err != nil {
+		return fmt.Errorf("error making request to worker: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error response from worker: (%d) %v", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// sealTopic seals (or unseals) all primary buffers of a topic. Replicas are
+// left alone, so that data already written to the primaries can still be
+// replicated. The topic is marked sealed only if all its buffers were sealed;
+// on error, buffers already changed are changed back.
+func (c *Controller) sealTopic(id string, sealed bool) (*Topic, error) {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, ok := c.topics[id]
+	if !ok {
+		return nil, nil
+	}
+	// buffers of a topic already sealed (or not) were so before, and are
+	// left as they are on error
+	prev := t.Sealed
+	changed := make([]string, 0, len(t.Buffers))
+	rollback := func(err error) (*Topic, error) {
+		t.Sealed = prev
+		if prev == sealed {
+			return nil, err
+		}
+		for _, b := range changed {
+			if err := c.sealBuffer(b, !sealed); err != nil {
+				c.log.Errorf("error reverting seal of buffer %q of topic %q: %v", b, id, err)
+			}
+		}
+		return nil, err
+	}
+	for _, b := range t.Buffers {
+		if err := c.sealBuffer(b, sealed); err != nil {
+			return rollback(err)
+		}
+		changed = append(changed, b)
+	}
+	t.Sealed = sealed
+	if err := c.save(); err != nil {
+		if committing(err) {
+			return nil, err
+		}
+		return rollback(err)
+	}
+	return t, nil
+}
+
+func (c *Controller) handleSealTopic(req *http.Request) *router.Response {
+	//
+	t, err := c.sealTopic(mux.Vars(req)["topic"], true)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error sealing topic: %v", err), StatusCode: saveStatus(err)}
+	}
+	if t == nil {
+		return &router.Response{Error: fmt.Errorf("topic not found"), StatusCode: http.StatusNotFound}
+	}
+	j, _ := json.Marshal(t)
+	return &router.Response{Body: j}
+}
+
+func (c *Controller) handleUnsealTopic(req *http.Request) *router.Response {
+	//
+	t, err := c.sealTopic(mux.Vars(req)["topic"], false)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error unsealing topic: %v", err), StatusCode: saveStatus(err)}
+	}
+	if t == nil {
+		return &router.Response{Error: fmt.Errorf("topic not found"), StatusCode: http.StatusNotFound}
+	}
+	j, _ := json.Marshal(t)
+	return &router.Response{Body: j}
+}
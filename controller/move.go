@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/buffer"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+const (
+	moveCatchUpLag      = 100 // messages; how far behind the target can be when writes are fenced
+	moveCatchUpTimeout  = 60 * time.Second
+	moveFenceTimeout    = 10 * time.Second
+	movePollingInterval = 100 * time.Millisecond
+)
+
+// moveError is returned by moveBuffer for moves refused before anything was
+// changed, with the status of the response.
+type moveError struct {
+	status int
+	err    error
+}
+
+func (e *moveError) Error() string {
+	return e.err.Error()
+}
+
+func get(u string) ([]byte, error) {
+	//
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("(%d) %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+type bufferState struct {
+	*buffer.Config
+	Len    int  `json:"len"`
+	Sealed bool `json:"sealed"`
+}
+
+func getBufferState(b *Buffer) (*bufferState, error) {
+	//
+	body, err := get(b.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error getting state of buffer %q: %v", b.ID, err)
+	}
+	state := &bufferState{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, fmt.Errorf("error parsing state of buffer %q: %v", b.ID, err)
+	}
+	return state, nil
+}
+
+// waitForReplica waits until replica is no more than lag messages behind
+// buffer b.
+func (c *Controller) waitForReplica(b *Buffer, replica string, lag int, timeout time.Duration) error {
+	//
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := getBufferState(b)
+		if err != nil {
+			return err
+		}
+		body, err := get(b.URL + "/replicas")
+		if err != nil {
+			return fmt.Errorf("error getting replicas of buffer %q: %v", b.ID, err)
+		}
+		replicas := make(map[string]int)
+		if err := json.Unmarshal(body, &replicas); err != nil {
+			return fmt.Errorf("error parsing replicas of buffer %q: %v", b.ID, err)
+		}
+		n, ok := replicas[replica]
+		if ok && state.Len-n <= lag {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for replica %q to catch up with buffer %q (%d of %d)", replica, b.ID, n, state.Len)
+		}
+		time.Sleep(movePollingInterval)
+	}
+}
+
+func copyConsumers(from, to *Buffer) error {
+	//
+	offsets, err := get(from.URL + "/consumers")
+	if err != nil {
+		return fmt.Errorf("error getting consumer offsets: %v", err)
+	}
+	resp, err := client.Post(to.URL+"/consumers", "application/json", bytes.NewBuffer(offsets))
+	if err != nil {
+		return fmt.Errorf("error setting consumer offsets: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error setting consumer offsets: (%d) %v", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// replaceBuffer replaces buffer id with buffer with, in topics and in replica
+// sets. Must be called with the lock held.
+func (c *Controller) replaceBuffer(id, with string) {
+	//
+	for _, t := range c.topics {
+		for i, b := range t.Buffers {
+			if b == id {
+				t.Buffers[i] = with
+			}
+		}
+	}
+	for p, replicas := range c.replicas {
+		changed := false
+		for i, r := range replicas {
+			if r == id {
+				replicas[i] = with
+				changed = true
+			}
+		}
+		if changed {
+			go c.setReplicas(p, replicas)
+		}
+	}
+	if replicas, ok := c.replicas[id]; ok {
+		c.replicas[with] = replicas
+		delete(c.replicas, id)
+		go c.setReplicas(with, replicas)
+	}
+}
+
+// moveBuffer moves buffer id to worker workerID. A new buffer is created on
+// the target worker and is caught up with the source by replication. Then
+// writes to the source are fenced (by sealing it), the target is brought up
+// to date, consumer offsets are copied over, and the source is replaced with
+// the target in topics and replica sets, and deleted. Writes made by clients
+// while the source is fenced get a 409 and go to other buffers of the topic;
+// messages consumed from the source after the offsets were copied will be
+// consumed again from the target. Buffers aren't moved to draining workers.
+func (c *Controller) moveBuffer(id, workerID string) (*Buffer, error) {
+	//
+	c.lock.Lock()
+	src, ok := c.buffers[id]
+	w, wok := c.workers[workerID]
+	refuse := func(status int, format string, a ...interface{}) (*Buffer, error) {
+		c.lock.Unlock()
+		return nil, &moveError{status: status, err: fmt.Errorf(format, a...)}
+	}
+	switch {
+	case !ok:
+		return refuse(http.StatusNotFound, "buffer %q not registered with controller", id)
+	case !wok:
+		return refuse(http.StatusNotFound, "worker %q not registered with controller", workerID)
+	case w.Draining:
+		return refuse(http.StatusConflict, "worker %q is draining", workerID)
+	case c.onWorker(src, w):
+		return refuse(http.StatusConflict, "buffer %q is already on worker %q", id, workerID)
+	case c.moving[id]:
+		return refuse(http.StatusConflict, "buffer %q is already being moved", id)
+	}
+	for _, other := range c.copies(id) {
+		if b, ok := c.buffers[other]; ok && c.onWorker(b, w) {
+			return refuse(http.StatusConflict, "worker %q already holds buffer %q, a copy of buffer %q", workerID, other, id)
+		}
+	}
+	c.moving[id] = true
+	replicas := append([]string{}, c.replicas[id]...)
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.moving, id)
+		c.lock.Unlock()
+	}()
+	//
+	state, err := getBufferState(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := c.createBufferOn(w, state.Config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating target buffer: %v", err)
+	}
+	c.lock.Lock()
+	c.buffers[dst.ID] = dst
+	c.lock.Unlock()
+	abort := func(err error) (*Buffer, error) {
+		if err := c.postReplicas(src, replicas); err != nil {
+			c.log.Errorf("error restoring replicas of buffer %q: %v", id, err)
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if !state.Sealed {
+			if err := c.sealBuffer(id, false); err != nil {
+				c.log.Errorf("error unsealing buffer %q: %v", id, err)
+			}
+		}
+		if err := c.deleteBuffer(dst.ID); err != nil {
+			c.log.Errorf("error deleting target buffer %q: %v", dst.ID, err)
+		}
+		return nil, fmt.Errorf("error moving buffer %q: %v", id, err)
+	}
+	//
+	if err := c.postReplicas(src, append(append([]string{}, replicas...), dst.ID)); err != nil {
+		return abort(err)
+	}
+	if err := c.waitForReplica(src, dst.ID, moveCatchUpLag, moveCatchUpTimeout); err != nil {
+		return abort(err)
+	}
+	c.lock.Lock()
+	err = c.sealBuffer(id, true)
+	c.lock.Unlock()
+	if err != nil {
+		return abort(err)
+	}
+	if err := c.waitForReplica(src, dst.ID, 0, moveFenceTimeout); err != nil {
+		return abort(err)
+	}
+	if err := copyConsumers(src, dst); err != nil {
+		return abort(err)
+	}
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if state.Sealed {
+		if err := c.sealBuffer(dst.ID, true); err != nil {
+			c.log.Errorf("error sealing target buffer %q: %v", dst.ID, err)
+		}
+	}
+	c.replaceBuffer(id, dst.ID)
+	if err := c.deleteBuffer(id); err != nil {
+		c.log.Errorf("error deleting moved buffer %q; this buffer is now orphaned: %v", id, err)
+	}
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	c.log.Infof("moved buffer %q to worker %q as %q", id, workerID, dst.ID)
+	return dst, nil
+}
+
+func (c *Controller) handleMoveBuffer(req *http.Request) *router.Response {
+	//
+	id := mux.Vars(req)["buffer"]
+	worker := req.URL.Query().Get("worker")
+	if worker == "" {
+		return &router.Response{
+			Error:      fmt.Errorf("target worker must be specified with ?worker="),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	b, err := c.moveBuffer(id, worker)
+	if e, ok := err.(*moveError); ok {
+		return &router.Response{Error: err, StatusCode: e.status}
+	}
+	if err != nil {
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	j, _ := json.Marshal(b)
+	return &router.Response{Body: j}
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// worker labels, in order of importance, across which copies of a
+	// buffer (the primary and its replicas) are spread
+	FailureDomains = []string{"zone", "rack", "host"}
+)
+
+// Placement explains on which worker a buffer was created, and why.
+type Placement struct {
+	Buffer   string            `json:"buffer"`
+	Worker   string            `json:"worker"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Reason   string            `json:"reason"`
+	Replicas []*Placement      `json:"replicas,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+func (c *Controller) onWorker(b *Buffer, w *Worker) bool {
+	return strings.HasPrefix(b.URL, w.URL+"/")
+}
+
+func (c *Controller) workerBuffers(w *Worker) int {
+	n := 0
+	for _, b := range c.buffers {
+		if c.onWorker(b, w) {
+			n += 1
+		}
+	}
+	return n
+}
+
+// copies returns ids of the other copies of buffer id: its primary and
+// sibling replicas if id is a replica, its replicas if id is a primary.
+func (c *Controller) copies(id string) []string {
+	if replicas, ok := c.replicas[id]; ok {
+		return replicas
+	}
+	for p, replicas := range c.replicas {
+		for _, r := range replicas {
+			if r != id {
+				continue
+			}
+			copies := []string{p}
+			for _, r := range replicas {
+				if r != id {
+					copies = append(copies, r)
+				}
+			}
+			return copies
+		}
+	}
+	return nil
+}
+
+type candidate struct {
+	worker  *Worker
+	domains []bool // for each failure domain, true if not shared with other copies
+	buffers int
+}
+
+// less is true if candidate a is a better place for a copy than b: a spreads
+// copies across more important failure domains, then a holds fewer buffers,
+// then a has more free disk.
+func (a *candidate) less(b *candidate) bool {
+	for i := range a.domains {
+		if a.domains[i] != b.domains[i] {
+			return a.domains[i]
+		}
+	}
+	if a.buffers != b.buffers {
+		return a.buffers < b.buffers
+	}
+	if a.worker.FreeBytes != b.worker.FreeBytes {
+		return a.worker.FreeBytes > b.worker.FreeBytes
+	}
+	return a.worker.ID < b.worker.ID
+}
+
+func (a *candidate) reason(copies []*Worker) string {
+	parts := make([]string, 0)
+	if len(copies) > 0 {
+		for i, key := range FailureDomains {
+			v := a.worker.Labels[key]
+			if v == "" {
+				continue
+			}
+			if a.domains[i] {
+				parts = append(parts, fmt.Sprintf("%s %q not shared with other copies", key, v))
+			} else {
+				parts = append(parts, fmt.Sprintf("%s %q shared with another copy, no better worker available", key, v))
+			}
+		}
+	}
+	parts = append(parts, fmt.Sprintf("worker has %d buffers and %d bytes free", a.buffers, a.worker.FreeBytes))
+	return strings.Join(parts, "; ")
+}
+
+// placeCopy picks the worker for a copy of a buffer, given the workers which
+// already hold the other copies. Two copies are never placed on the same
+// worker, and copies are not placed on draining workers; an error is returned
+// if there is no worker left.
+func (c *Controller) placeCopy(copies []*Worker) (*Worker, string, error) {
+	//
+	if len(c.workers) == 0 {
+		return nil, "", fmt.Errorf("no workers registered")
+	}
+	used := make(map[string]bool)
+	values := make([]map[string]bool, len(FailureDomains))
+	for i := range values {
+		values[i] = make(map[string]bool)
+	}
+	for _, w := range copies {
+		used[w.ID] = true
+		for i, key := range FailureDomains {
+			values[i][w.Labels[key]] = true
+		}
+	}
+	candidates := make([]*candidate, 0, len(c.workers))
+	for _, w := range c.workers {
+		if used[w.ID] || w.Draining {
+			continue
+		}
+		x := &candidate{worker: w, domains: make([]bool, len(FailureDomains)), buffers: c.workerBuffers(w)}
+		for i, key := range FailureDomains {
+			v := w.Labels[key]
+			x.domains[i] = v != "" && !values[i][v]
+		}
+		candidates = append(candidates, x)
+	}
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("no worker without a copy of the buffer available")
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].less(candidates[j]) })
+	best := candidates[0]
+	return best.worker, best.reason(copies), nil
+}
+
+func (c *Controller) pickWorker() (*Worker, error) {
+	//
+	w, _, err := c.placeCopy(nil)
+	return w, err
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPlaceCopy(t *testing.T) {
+
+	type worker struct {
+		id       string
+		labels   map[string]string
+		free     uint64
+		buffers  int
+		draining bool
+	}
+	z := func(zone, rack string) map[string]string {
+		return map[string]string{"zone": zone, "rack": rack}
+	}
+	tests := []struct {
+		name    string
+		workers []worker
+		copies  []string // workers holding the other copies
+		want    string   // "" if no worker is available
+	}{
+		{
+			name:    "fewest buffers",
+			workers: []worker{{id: "a", buffers: 1}, {id: "b"}},
+			want:    "b",
+		},
+		{
+			name:    "most free disk",
+			workers: []worker{{id: "a", free: 10}, {id: "b", free: 20}},
+			want:    "b",
+		},
+		{
+			name:    "fewest buffers before free disk",
+			workers: []worker{{id: "a", free: 20, buffers: 1}, {id: "b", free: 10}},
+			want:    "b",
+		},
+		{
+			name:    "id",
+			workers: []worker{{id: "b"}, {id: "a"}},
+			want:    "a",
+		},
+		{
+			name: "failure domain before buffers",
+			workers: []worker{
+				{id: "a", labels: z("z1", "r1")},
+				{id: "b", labels: z("z1", "r2")},
+				{id: "c", labels: z("z2", "r3"), buffers: 5},
+			},
+			copies: []string{"a"},
+			want:   "c",
+		},
+		{
+			name: "zone before rack",
+			workers: []worker{
+				{id: "a", labels: z("z1", "r1")},
+				{id: "b", labels: z("z1", "r2")},
+				{id: "c", labels: z("z2", "r1")},
+			},
+			copies: []string{"a"},
+			want:   "c",
+		},
+		{
+			name: "rack when zones are shared",
+			workers: []worker{
+				{id: "a", labels: z("z1", "r1")},
+				{id: "b", labels: z("z1", "r1")},
+				{id: "c", labels: z("z1", "r2"), buffers: 5},
+			},
+			copies: []string{"a"},
+			want:   "c",
+		},
+		{
+			name:    "never two copies on one worker",
+			workers: []worker{{id: "a"}, {id: "b", buffers: 5}},
+			copies:  []string{"a"},
+			want:    "b",
+		},
+		{
+			name:    "no worker without a copy",
+			workers: []worker{{id: "a"}},
+			copies:  []string{"a"},
+		},
+		{
+			name:    "draining",
+			workers: []worker{{id: "a", free: 20, draining: true}, {id: "b", free: 10, buffers: 5}},
+			want:    "b",
+		},
+		{
+			name:    "only draining",
+			workers: []worker{{id: "a", draining: true}},
+		},
+	}
+	for _, test := range tests {
+		c := &Controller{
+			workers:  make(map[string]*Worker),
+			buffers:  make(map[string]*Buffer),
+			replicas: make(map[string][]string),
+		}
+		for _, w := range test.workers {
+			c.workers[w.id] = &Worker{
+				ID:        w.id,
+				URL:       "http://localhost/" + w.id,
+				Labels:    w.labels,
+				FreeBytes: w.free,
+				Draining:  w.draining,
+			}
+			for i := 0; i < w.buffers; i++ {
+				id := fmt.Sprintf("%s-%d", w.id, i)
+				c.buffers[id] = &Buffer{ID: id, URL: c.workers[w.id].URL + "/buffers/" + id}
+			}
+		}
+		copies := make([]*Worker, 0)
+		for _, id := range test.copies {
+			copies = append(copies, c.workers[id])
+		}
+		w, _, err := c.placeCopy(copies)
+		switch {
+		case test.want == "" && err == nil:
+			t.Fatalf("%s: expected error, got worker %q", test.name, w.ID)
+		case test.want == "":
+		case err != nil:
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		case w.ID != test.want:
+			t.Fatalf("%s: expected worker %q, got %q", test.name, test.want, w.ID)
+		}
+	}
+}
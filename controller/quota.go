@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/quota"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+// Quotas of the tenant are part of the controller's state. Workers and
+// clients fetch them periodically, together with the tenant's usage, see
+// quota package.
+
+// topicsRetryAfter is sent with responses to topic creation over quota; the
+// quota frees up only when topics are deleted.
+const topicsRetryAfter = 60
+
+func (c *Controller) quotaRoutes() []*router.Route {
+	return []*router.Route{
+		{"/quotas", []string{"GET"}, c.handleGetQuotas, ""},
+		{"/quotas", []string{"POST"}, c.handleSetQuotas, ""},
+		{"/quotas", []string{"DELETE"}, c.handleDeleteQuotas, ""},
+	}
+}
+
+// usage returns the tenant's usage. Must be called with the lock held.
+func (c *Controller) usage() *quota.Usage {
+	//
+	u := &quota.Usage{Topics: len(c.topics), Workers: make(map[string]int64, len(c.workers))}
+	for id, w := range c.workers {
+		u.Bytes += w.UsedBytes
+		u.Workers[id] = w.UsedBytes
+	}
+	return u
+}
+
+// checkTopics returns an error response when creating a topic would exceed
+// the topic quota. Must be called with the lock held.
+func (c *Controller) checkTopics() *router.Response {
+	//
+	if c.quotas == nil || c.quotas.MaxTopics == 0 || len(c.topics) < c.quotas.MaxTopics {
+		return nil
+	}
+	err := fmt.Errorf("tenant %q has %d topics, max_topics is %d", c.Tenant, len(c.topics), c.quotas.MaxTopics)
+	return quota.Exceeded(http.StatusInsufficientStorage, topicsRetryAfter*time.Second, err)
+}
+
+func (c *Controller) handleGetQuotas(req *http.Request) *router.Response {
+	//
+	c.lock.Lock()
+	j, _ := json.Marshal(&quota.Status{Quotas: c.quotas, Usage: c.usage()})
+	c.lock.Unlock()
+	return &router.Response{Body: j}
+}
+
+// handleSetQuotas replaces the tenant's quotas. Fields not set take zero
+// values, meaning no limit.
+func (c *Controller) handleSetQuotas(req *http.Request) *router.Response {
+	//
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	q := new(quota.Quotas)
+	if err := json.Unmarshal(b, q); err != nil {
+		return &router.Response{Error: fmt.Errorf("error parsing quotas: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	if err := q.Validate(); err != nil {
+		return &router.Response{Error: fmt.Errorf("invalid quotas: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.quotas
+	c.quotas = q
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			c.quotas = old
+		}
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("quotas of tenant %q set by %q", c.Tenant, acl.Principal(req))
+	j, _ := json.Marshal(q)
+	return &router.Response{Body: j}
+}
+
+func (c *Controller) handleDeleteQuotas(req *http.Request) *router.Response {
+	//
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.quotas
+	c.quotas = nil
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			c.quotas = old
+		}
+		return &router.Response{Error: err, StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("quotas of tenant %q deleted by %q", c.Tenant, acl.Principal(req))
+	return &router.Response{}
+}
@@ -0,0 +1,712 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/router"
+	"github.com/mkocikowski/hbuf/util"
+)
+
+var (
+	RaftHeartbeatInterval = 50 * time.Millisecond
+	// followers start an election after hearing nothing from the leader for
+	// between 1x and 2x this long
+	RaftElectionTimeout = 500 * time.Millisecond
+	// how long a proposal waits to be committed by a majority of peers
+	RaftCommitTimeout = 5 * time.Second
+	//
+	ErrorNotLeader = fmt.Errorf("controller is not the leader")
+	// returned by propose for entries appended to the log which weren't
+	// committed in time; they may still be committed
+	ErrorOutcomeUnknown = fmt.Errorf("change not committed in time, outcome unknown; check and retry")
+)
+
+const (
+	raftFile = "raft"
+	//
+	roleFollower  = "follower"
+	roleCandidate = "candidate"
+	roleLeader    = "leader"
+)
+
+// Each log entry holds the complete state of the controller (as saved by
+// Controller.save), so applying an entry is replacing the state, and the
+// snapshot is simply the data of the last applied entry. Entries with no data
+// are no-ops, appended by new leaders to commit entries of earlier terms.
+type raftEntry struct {
+	Term  int    `json:"term"`
+	Index int    `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+// raftLog is the part of raft state persisted to disk.
+type raftLog struct {
+	Term          int          `json:"term"`
+	VotedFor      string       `json:"voted_for"`
+	Commit        int          `json:"commit"`
+	SnapshotIndex int          `json:"snapshot_index"`
+	SnapshotTerm  int          `json:"snapshot_term"`
+	Snapshot      []byte       `json:"snapshot"`
+	Entries       []*raftEntry `json:"entries"`
+}
+
+type voteRequest struct {
+	Term         int    `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex int    `json:"last_log_index"`
+	LastLogTerm  int    `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    int  `json:"term"`
+	Granted bool `json:"granted"`
+}
+
+type raftSnapshot struct {
+	Index int    `json:"index"`
+	Term  int    `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+type appendRequest struct {
+	Term         int           `json:"term"`
+	Leader       string        `json:"leader"`
+	PrevLogIndex int           `json:"prev_log_index"`
+	PrevLogTerm  int           `json:"prev_log_term"`
+	Entries      []*raftEntry  `json:"entries"`
+	LeaderCommit int           `json:"leader_commit"`
+	Snapshot     *raftSnapshot `json:"snapshot,omitempty"` // sent to followers behind the leader's snapshot
+}
+
+type appendResponse struct {
+	Term    int  `json:"term"`
+	Success bool `json:"success"`
+	Match   int  `json:"match"` // index of the last entry known to match the leader's log
+}
+
+// raft replicates controller state among controllers of a tenant running on
+// different nodes. Peers are identified by their controller URLs.
+type raft struct {
+	raftLog
+	id          string
+	peers       []string // other controllers
+	path        string
+	role        string
+	leader      string
+	applied     int
+	nextIndex   map[string]int
+	matchIndex  map[string]int
+	inflight    map[string]bool
+	lastContact time.Time
+	timeout     time.Duration
+	apply       func(data []byte) // called for committed entries, in order
+	elected     func()            // called when this peer becomes the leader
+	kick        chan bool
+	done        chan bool
+	lock        *sync.Mutex
+	cond        *sync.Cond // signalled on commit, apply and role change
+	log         *logger.Logger
+}
+
+func newRaft(id string, peers []string, path string, log *logger.Logger) *raft {
+	//
+	r := &raft{
+		id:         id,
+		log:        log,
+		path:       path,
+		role:       roleFollower,
+		nextIndex:  make(map[string]int),
+		matchIndex: make(map[string]int),
+		inflight:   make(map[string]bool),
+		kick:       make(chan bool, 1),
+		done:       make(chan bool),
+		lock:       new(sync.Mutex),
+	}
+	r.cond = sync.NewCond(r.lock)
+	for _, p := range peers {
+		if p != id {
+			r.peers = append(r.peers, p)
+		}
+	}
+	return r
+}
+
+func (r *raft) load() error {
+	//
+	j, err := ioutil.ReadFile(filepath.Join(r.path, raftFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading raft log: %v", err)
+	}
+	if err := json.Unmarshal(j, &r.raftLog); err != nil {
+		return fmt.Errorf("error parsing raft log: %v", err)
+	}
+	r.applied = r.Commit
+	return nil
+}
+
+// persist must be called with the lock held, before responding to any
+// request which changed the term, the vote, or the log. If it fails, the
+// request must not be acknowledged.
+func (r *raft) persist() error {
+	//
+	if err := os.MkdirAll(r.path, 0755); err != nil {
+		return fmt.Errorf("error creating raft data directory: %v", err)
+	}
+	j, _ := json.Marshal(&r.raftLog)
+	if err := util.WriteFileAtomic(filepath.Join(r.path, raftFile), j, 0644); err != nil {
+		return fmt.Errorf("error writing raft log: %v", err)
+	}
+	return nil
+}
+
+func (r *raft) start() {
+	//
+	r.lock.Lock()
+	r.lastContact = time.Now()
+	r.resetTimeout()
+	r.lock.Unlock()
+	go r.run()
+	go r.applier()
+}
+
+func (r *raft) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	close(r.done)
+	r.cond.Broadcast()
+}
+
+func (r *raft) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *raft) resetTimeout() {
+	r.timeout = RaftElectionTimeout + time.Duration(rand.Int63n(int64(RaftElectionTimeout)))
+}
+
+func (r *raft) lastIndex() int {
+	return r.SnapshotIndex + len(r.Entries)
+}
+
+func (r *raft) lastTerm() int {
+	if len(r.Entries) == 0 {
+		return r.SnapshotTerm
+	}
+	return r.Entries[len(r.Entries)-1].Term
+}
+
+// termAt returns the term of the entry at index i, or -1 if the entry has
+// been compacted or doesn't exist.
+func (r *raft) termAt(i int) int {
+	switch {
+	case i == r.SnapshotIndex:
+		return r.SnapshotTerm
+	case i < r.SnapshotIndex || i > r.lastIndex():
+		return -1
+	}
+	return r.Entries[i-r.SnapshotIndex-1].Term
+}
+
+func (r *raft) entry(i int) *raftEntry {
+	return r.Entries[i-r.SnapshotIndex-1]
+}
+
+// latest returns the data of the most recent entry with data, committed or
+// not, or the snapshot.
+func (r *raft) latest() []byte {
+	for i := len(r.Entries) - 1; i >= 0; i-- {
+		if r.Entries[i].Data != nil {
+			return r.Entries[i].Data
+		}
+	}
+	return r.Snapshot
+}
+
+// committed returns the data of the most recent committed entry with data.
+func (r *raft) committed() []byte {
+	for i := r.Commit; i > r.SnapshotIndex; i-- {
+		if d := r.entry(i).Data; d != nil {
+			return d
+		}
+	}
+	return r.Snapshot
+}
+
+func (r *raft) isLeader() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.role == roleLeader
+}
+
+// leaderURL returns the URL of the current leader, or "" if not known.
+func (r *raft) leaderURL() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.leader
+}
+
+func (r *raft) becomeFollower(term int) {
+	if term > r.Term {
+		r.Term = term
+		r.VotedFor = ""
+	}
+	if r.role == roleLeader {
+		r.log.Infof("controller %q stepping down as leader in term %d", r.id, r.Term)
+	}
+	r.role = roleFollower
+	r.cond.Broadcast()
+}
+
+// propose appends data to the log and waits until it is committed. Only the
+// leader can propose. If the entry isn't committed in time, or leadership is
+// lost, ErrorOutcomeUnknown is returned: the entry stays in the log, and may
+// be committed later, by this leader or the next.
+func (r *raft) propose(data []byte) error {
+	//
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.role != roleLeader {
+		return ErrorNotLeader
+	}
+	term := r.Term
+	e := &raftEntry{Term: term, Index: r.lastIndex() + 1, Data: data}
+	r.Entries = append(r.Entries, e)
+	if err := r.persist(); err != nil {
+		r.Entries = r.Entries[:len(r.Entries)-1]
+		return err
+	}
+	select {
+	case r.kick <- true:
+	default:
+	}
+	deadline := time.Now().Add(RaftCommitTimeout)
+	for r.Commit < e.Index {
+		if r.role != roleLeader || r.Term != term || r.stopped() {
+			r.log.Warnf("lost leadership before entry %d was committed", e.Index)
+			return ErrorOutcomeUnknown
+		}
+		if time.Now().After(deadline) {
+			r.log.Warnf("timed out waiting for entry %d to be committed", e.Index)
+			return ErrorOutcomeUnknown
+		}
+		r.cond.Wait()
+	}
+	return nil
+}
+
+func (r *raft) run() {
+	//
+	ticker := time.NewTicker(RaftHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.kick:
+		}
+		r.lock.Lock()
+		// wakes up proposals waiting on commit, so that they can time out
+		r.cond.Broadcast()
+		switch {
+		case r.role == roleLeader:
+			r.replicate()
+		case time.Since(r.lastContact) > r.timeout:
+			r.campaign()
+		}
+		r.lock.Unlock()
+	}
+}
+
+func (r *raft) post(peer, path string, req, resp interface{}) error {
+	//
+	j, _ := json.Marshal(req)
+	res, err := client.Post(peer+path, "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("(%d) %s", res.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, resp)
+}
+
+// campaign starts an election. Must be called with the lock held.
+func (r *raft) campaign() {
+	//
+	r.Term += 1
+	r.role = roleCandidate
+	r.VotedFor = r.id
+	r.lastContact = time.Now()
+	r.resetTimeout()
+	// votes for itself only once the vote is on disk
+	if err := r.persist(); err != nil {
+		r.log.Errorf("error starting election: %v", err)
+		return
+	}
+	term := r.Term
+	votes := 1
+	req := &voteRequest{Term: term, Candidate: r.id, LastLogIndex: r.lastIndex(), LastLogTerm: r.lastTerm()}
+	r.log.Infof("controller %q starting election for term %d", r.id, term)
+	if len(r.peers) == 0 {
+		r.becomeLeader()
+		return
+	}
+	for _, p := range r.peers {
+		go func(p string) {
+			resp := &voteResponse{}
+			if err := r.post(p, "/_raft/vote", req, resp); err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if resp.Term > r.Term {
+				r.becomeFollower(resp.Term)
+				if err := r.persist(); err != nil {
+					r.log.Errorf("%v", err)
+				}
+				return
+			}
+			if !resp.Granted || r.role != roleCandidate || r.Term != term {
+				return
+			}
+			votes += 1
+			if votes > (len(r.peers)+1)/2 {
+				r.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// becomeLeader must be called with the lock held.
+func (r *raft) becomeLeader() {
+	//
+	r.log.Infof("controller %q elected leader for term %d", r.id, r.Term)
+	r.role = roleLeader
+	r.leader = r.id
+	for _, p := range r.peers {
+		r.nextIndex[p] = r.lastIndex() + 1
+		r.matchIndex[p] = 0
+	}
+	// entries of earlier terms are committed only together with an entry
+	// of the current term
+	r.Entries = append(r.Entries, &raftEntry{Term: r.Term, Index: r.lastIndex() + 1})
+	if err := r.persist(); err != nil {
+		r.log.Errorf("error persisting entry of new term, stepping down: %v", err)
+		r.Entries = r.Entries[:len(r.Entries)-1]
+		r.becomeFollower(r.Term)
+		return
+	}
+	r.advanceCommit()
+	r.replicate()
+	if r.elected != nil {
+		go r.elected()
+	}
+}
+
+// replicate sends entries (or heartbeats) to peers without a request in
+// flight. Must be called with the lock held.
+func (r *raft) replicate() {
+	//
+	for _, p := range r.peers {
+		if r.inflight[p] {
+			continue
+		}
+		req := &appendRequest{
+			Term:         r.Term,
+			Leader:       r.id,
+			LeaderCommit: r.Commit,
+		}
+		next := r.nextIndex[p]
+		if next <= r.SnapshotIndex {
+			req.Snapshot = &raftSnapshot{Index: r.SnapshotIndex, Term: r.SnapshotTerm, Data: r.Snapshot}
+			next = r.SnapshotIndex + 1
+		}
+		req.PrevLogIndex = next - 1
+		req.PrevLogTerm = r.termAt(next - 1)
+		req.Entries = append([]*raftEntry{}, r.Entries[next-r.SnapshotIndex-1:]...)
+		r.inflight[p] = true
+		go func(p string) {
+			resp := &appendResponse{}
+			err := r.post(p, "/_raft/append", req, resp)
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.inflight[p] = false
+			if err != nil {
+				return
+			}
+			if resp.Term > r.Term {
+				r.becomeFollower(resp.Term)
+				if err := r.persist(); err != nil {
+					r.log.Errorf("%v", err)
+				}
+				return
+			}
+			if r.role != roleLeader || r.Term != req.Term {
+				return
+			}
+			if resp.Success {
+				if resp.Match > r.matchIndex[p] {
+					r.matchIndex[p] = resp.Match
+				}
+				r.nextIndex[p] = r.matchIndex[p] + 1
+				r.advanceCommit()
+				return
+			}
+			// back off to what the follower says matches
+			next := r.nextIndex[p] - 1
+			if resp.Match+1 < next {
+				next = resp.Match + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			r.nextIndex[p] = next
+		}(p)
+	}
+}
+
+// advanceCommit commits the most recent entry of the current term that is
+// stored on a majority of peers. Must be called with the lock held.
+func (r *raft) advanceCommit() {
+	//
+	for n := r.lastIndex(); n > r.Commit; n-- {
+		if r.termAt(n) != r.Term {
+			break
+		}
+		count := 1
+		for _, p := range r.peers {
+			if r.matchIndex[p] >= n {
+				count += 1
+			}
+		}
+		if count > (len(r.peers)+1)/2 {
+			r.Commit = n
+			// the commit index can be learned again from peers
+			if err := r.persist(); err != nil {
+				r.log.Errorf("%v", err)
+			}
+			r.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// applier applies committed entries, in order, and compacts the log.
+func (r *raft) applier() {
+	//
+	for {
+		r.lock.Lock()
+		for r.applied >= r.Commit && !r.stopped() {
+			r.cond.Wait()
+		}
+		if r.stopped() {
+			r.lock.Unlock()
+			return
+		}
+		var data []byte
+		var index int
+		if r.applied < r.SnapshotIndex {
+			index, data = r.SnapshotIndex, r.Snapshot
+		} else {
+			index = r.applied + 1
+			data = r.entry(index).Data
+		}
+		r.lock.Unlock()
+		if data != nil {
+			r.apply(data)
+		}
+		r.lock.Lock()
+		if index > r.applied {
+			r.applied = index
+		}
+		r.compact()
+		r.cond.Broadcast()
+		r.lock.Unlock()
+	}
+}
+
+// compact folds applied entries into the snapshot, so that the log holds only
+// entries not yet applied. As each entry is a copy of the complete state,
+// this keeps the log, which is rewritten on every change, small. Peers behind
+// the snapshot are sent the snapshot instead. Must be called with the lock
+// held.
+func (r *raft) compact() {
+	//
+	if r.applied <= r.SnapshotIndex {
+		return
+	}
+	r.Snapshot = r.committedAt(r.applied)
+	r.SnapshotTerm = r.termAt(r.applied)
+	r.Entries = append([]*raftEntry{}, r.Entries[r.applied-r.SnapshotIndex:]...)
+	r.SnapshotIndex = r.applied
+	if err := r.persist(); err != nil {
+		r.log.Errorf("%v", err)
+	}
+}
+
+func (r *raft) committedAt(i int) []byte {
+	for ; i > r.SnapshotIndex; i-- {
+		if d := r.entry(i).Data; d != nil {
+			return d
+		}
+	}
+	return r.Snapshot
+}
+
+func (r *raft) handleVote(req *http.Request) *router.Response {
+	//
+	v := &voteRequest{}
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return &router.Response{Error: fmt.Errorf("error parsing vote request: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	term, vote := r.Term, r.VotedFor
+	if v.Term > r.Term {
+		r.becomeFollower(v.Term)
+	}
+	resp := &voteResponse{Term: r.Term}
+	upToDate := v.LastLogTerm > r.lastTerm() || (v.LastLogTerm == r.lastTerm() && v.LastLogIndex >= r.lastIndex())
+	if v.Term == r.Term && (r.VotedFor == "" || r.VotedFor == v.Candidate) && upToDate {
+		r.VotedFor = v.Candidate
+		r.lastContact = time.Now()
+		resp.Granted = true
+	}
+	if r.Term != term || r.VotedFor != vote {
+		if err := r.persist(); err != nil {
+			return &router.Response{Error: err}
+		}
+	}
+	j, _ := json.Marshal(resp)
+	return &router.Response{Body: j}
+}
+
+func (r *raft) handleAppend(req *http.Request) *router.Response {
+	//
+	a := &appendRequest{}
+	if err := json.NewDecoder(req.Body).Decode(a); err != nil {
+		return &router.Response{Error: fmt.Errorf("error parsing append request: %v", err), StatusCode: http.StatusBadRequest}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	resp := &appendResponse{Term: r.Term}
+	if a.Term < r.Term {
+		j, _ := json.Marshal(resp)
+		return &router.Response{Body: j}
+	}
+	// heartbeats which change nothing aren't persisted
+	changed := a.Term > r.Term
+	if a.Term > r.Term || r.role != roleFollower {
+		r.becomeFollower(a.Term)
+	}
+	resp.Term = r.Term
+	r.leader = a.Leader
+	r.lastContact = time.Now()
+	// the log is on disk before the leader is told how it was changed
+	reply := func() *router.Response {
+		if !changed {
+			j, _ := json.Marshal(resp)
+			return &router.Response{Body: j}
+		}
+		if err := r.persist(); err != nil {
+			return &router.Response{Error: err}
+		}
+		j, _ := json.Marshal(resp)
+		return &router.Response{Body: j}
+	}
+	//
+	if s := a.Snapshot; s != nil && s.Index > r.SnapshotIndex {
+		if r.termAt(s.Index) == s.Term {
+			r.Entries = append([]*raftEntry{}, r.Entries[s.Index-r.SnapshotIndex:]...)
+		} else {
+			r.Entries = nil
+		}
+		r.SnapshotIndex, r.SnapshotTerm, r.Snapshot = s.Index, s.Term, s.Data
+		if r.Commit < s.Index {
+			r.Commit = s.Index
+		}
+		changed = true
+		r.cond.Broadcast()
+	}
+	if a.PrevLogIndex > r.lastIndex() {
+		resp.Match = r.lastIndex()
+		return reply()
+	}
+	if a.PrevLogIndex >= r.SnapshotIndex && r.termAt(a.PrevLogIndex) != a.PrevLogTerm {
+		resp.Match = a.PrevLogIndex - 1
+		if resp.Match > r.Commit {
+			resp.Match = r.Commit
+		}
+		return reply()
+	}
+	for _, e := range a.Entries {
+		if e.Index <= r.SnapshotIndex {
+			continue
+		}
+		if e.Index <= r.lastIndex() {
+			if r.termAt(e.Index) == e.Term {
+				continue
+			}
+			// conflicting entry: drop it and everything after it
+			r.Entries = r.Entries[:e.Index-r.SnapshotIndex-1]
+		}
+		r.Entries = append(r.Entries, e)
+		changed = true
+	}
+	last := a.PrevLogIndex + len(a.Entries)
+	commit := a.LeaderCommit
+	if commit > last {
+		commit = last
+	}
+	if commit > r.Commit {
+		r.Commit = commit
+		changed = true
+		r.cond.Broadcast()
+	}
+	resp.Success = true
+	resp.Match = last
+	return reply()
+}
+
+func (r *raft) handleGetStatus(req *http.Request) *router.Response {
+	//
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status := map[string]interface{}{
+		"id":             r.id,
+		"role":           r.role,
+		"term":           r.Term,
+		"leader":         r.leader,
+		"peers":          r.peers,
+		"commit":         r.Commit,
+		"applied":        r.applied,
+		"last_index":     r.lastIndex(),
+		"snapshot_index": r.SnapshotIndex,
+	}
+	j, _ := json.Marshal(status)
+	return &router.Response{Body: j}
+}
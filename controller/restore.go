@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+// restore streams the files of one buffer directory, as a tar archive, to the
+// worker on which the restored buffer is placed.
+type restore struct {
+	dir    string
+	pw     *io.PipeWriter
+	tw     *tar.Writer
+	done   chan error
+	buffer *Buffer
+}
+
+func (c *Controller) startRestore(topic, dir string, offsets bool) (*restore, error) {
+	//
+	c.lock.Lock()
+	w, err := c.pickWorker()
+	c.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error picking worker for restored buffer: %v", err)
+	}
+	q := url.Values{"topic": {topic}}
+	if offsets {
+		q.Set("offsets", "true")
+	}
+	u := w.URL + "/buffers/_restore?" + q.Encode()
+	pr, pw := io.Pipe()
+	r := &restore{dir: dir, pw: pw, tw: tar.NewWriter(pw), done: make(chan error, 1)}
+	go func() {
+		resp, err := streamClient.Post(u, "application/x-tar", pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			r.done <- fmt.Errorf("error making restore buffer request: %v", err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		pr.Close()
+		if err != nil {
+			r.done <- fmt.Errorf("error reading response body for restore buffer request: %v", err)
+			return
+		}
+		if resp.StatusCode != http.StatusCreated {
+			r.done <- fmt.Errorf("error making restore buffer request: (%d) %v", resp.StatusCode, string(body))
+			return
+		}
+		b := &Buffer{}
+		if err := json.Unmarshal(body, b); err != nil {
+			r.done <- fmt.Errorf("error parsing response body for restore buffer request: %v", err)
+			return
+		}
+		r.buffer = b
+		r.done <- nil
+	}()
+	return r, nil
+}
+
+func (r *restore) add(h *tar.Header, data io.Reader) error {
+	hdr := *h
+	hdr.Name = path.Base(h.Name)
+	if err := r.tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(r.tw, data)
+	return err
+}
+
+func (r *restore) finish() (*Buffer, error) {
+	r.tw.Close()
+	r.pw.Close()
+	if err := <-r.done; err != nil {
+		return nil, err
+	}
+	return r.buffer, nil
+}
+
+func (r *restore) abort(err error) {
+	r.pw.CloseWithError(err)
+	<-r.done
+}
+
+// maxPendingFile is the max size of files other than segments (offsets,
+// manifest) in a restored archive; they are held in memory.
+const maxPendingFile = 1 << 20
+
+type pendingFile struct {
+	header *tar.Header
+	data   []byte
+}
+
+// restoreTopic reads a tar archive of buffer directories, and restores each
+// of them as a new buffer of topic id. Any directory containing segment files
+// is treated as a buffer directory; the files of a directory must be
+// contiguous in the archive. If the archive has a manifest.json (snapshots
+// do, raw tar archives of buffer directories don't), it must list as many
+// buffers with segments as were restored, so that a truncated snapshot is not
+// restored as a smaller topic. Only primary buffers are restored; the
+// restored topic has no replicas. On error, buffers already restored are
+// deleted.
+// Called without the lock held; it is taken only to place and register
+// buffers, not while the archive is streamed to workers.
+func (c *Controller) restoreTopic(id string, archive io.Reader, offsets bool) (_ *Topic, err error) {
+	//
+	t := &Topic{
+		ID:      id,
+		Buffers: make([]string, 0),
+	}
+	var current *restore
+	defer func() {
+		if err == nil {
+			return
+		}
+		if current != nil {
+			current.abort(err)
+		}
+		c.lock.Lock()
+		c.deleteRestored(t.Buffers)
+		c.lock.Unlock()
+	}()
+	// small files (offsets, manifest) may come before the segments in the
+	// archive; hold on to them until it is known the directory is a buffer
+	var pending []*pendingFile
+	var pendingDir string
+	var manifest *struct {
+		Buffers []struct {
+			Segments []string `json:"segments"`
+		} `json:"buffers"`
+	}
+	finish := func() error {
+		b, err := current.finish()
+		current = nil
+		if err != nil {
+			return fmt.Errorf("error restoring buffer: %v", err)
+		}
+		c.lock.Lock()
+		c.buffers[b.ID] = b
+		c.lock.Unlock()
+		t.Buffers = append(t.Buffers, b.ID)
+		return nil
+	}
+	tr := tar.NewReader(archive)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, name := path.Split(h.Name)
+		if current != nil && current.dir != dir {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+		if h.Name == "manifest.json" {
+			if h.Size > maxPendingFile {
+				return nil, fmt.Errorf("manifest in archive is %d bytes, max is %d", h.Size, maxPendingFile)
+			}
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("error parsing archive manifest: %v", err)
+			}
+			continue
+		}
+		if current == nil && !strings.HasPrefix(name, "segment_") {
+			if dir != pendingDir {
+				pending, pendingDir = nil, dir
+			}
+			if h.Size > maxPendingFile {
+				return nil, fmt.Errorf("file %q in archive is %d bytes, max for files other than segments is %d", h.Name, h.Size, maxPendingFile)
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("error reading archive: %v", err)
+			}
+			pending = append(pending, &pendingFile{header: h, data: data})
+			continue
+		}
+		if current == nil {
+			if current, err = c.startRestore(id, dir, offsets); err != nil {
+				return nil, err
+			}
+			if dir == pendingDir {
+				for _, f := range pending {
+					if err := current.add(f.header, bytes.NewReader(f.data)); err != nil {
+						return nil, fmt.Errorf("error sending data to worker: %v", err)
+					}
+				}
+			}
+			pending, pendingDir = nil, ""
+		}
+		if err := current.add(h, tr); err != nil {
+			return nil, fmt.Errorf("error sending data to worker: %v", err)
+		}
+	}
+	if current != nil {
+		if err := finish(); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.Buffers) == 0 {
+		return nil, fmt.Errorf("no buffers found in archive")
+	}
+	if manifest != nil {
+		// empty buffers have no segments, and aren't restored
+		n := 0
+		for _, b := range manifest.Buffers {
+			if len(b.Segments) > 0 {
+				n += 1
+			}
+		}
+		if n != len(t.Buffers) {
+			return nil, fmt.Errorf("archive manifest lists %d buffers with segments, %d found", n, len(t.Buffers))
+		}
+	}
+	t.Epochs = []int{len(t.Buffers)}
+	return t, nil
+}
+
+// deleteRestored deletes buffers of a topic which failed to restore. Must be
+// called with the lock held.
+func (c *Controller) deleteRestored(buffers []string) {
+	//
+	for _, b := range buffers {
+		if err := c.deleteBuffer(b); err != nil {
+			c.log.Errorf("error cleaning up restored buffer: %v", err)
+		}
+	}
+}
+
+func (c *Controller) handleRestoreTopic(req *http.Request) *router.Response {
+	//
+	id := mux.Vars(req)["topic"]
+	// checked before the archive is uploaded, and again after, as the lock
+	// isn't held during the upload
+	check := func() *router.Response {
+		if _, ok := c.topics[id]; ok {
+			return &router.Response{
+				Error:      fmt.Errorf("topic %q already exists", id),
+				StatusCode: http.StatusConflict,
+			}
+		}
+		return c.checkTopics()
+	}
+	c.lock.Lock()
+	resp := check()
+	c.lock.Unlock()
+	if resp != nil {
+		return resp
+	}
+	offsets := req.URL.Query().Get("offsets") == "true"
+	t, err := c.restoreTopic(id, req.Body, offsets)
+	if err != nil {
+		c.log.Errorf("error restoring topic: %v", err)
+		return &router.Response{
+			Error:      fmt.Errorf("error restoring topic: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if resp := check(); resp != nil {
+		c.deleteRestored(t.Buffers)
+		return resp
+	}
+	c.topics[id] = t
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			delete(c.topics, id)
+			c.deleteRestored(t.Buffers)
+		}
+		return &router.Response{Error: fmt.Errorf("error restoring topic: %v", err), StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("restored topic %q with %d buffers", id, len(t.Buffers))
+	j, _ := json.Marshal(t)
+	return &router.Response{Body: j, StatusCode: http.StatusCreated}
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/mkocikowski/hbuf/util"
+)
+
+const (
+	stateFile = "state"
+)
+
+// save persists the controller's metadata (workers, buffers, topics, replica
+// sets, the access policy, quotas and tokens) to the state file, or, when the controller is
+// replicated, commits it to the raft log. It must be called with the lock
+// held, after every mutation of the metadata, and before the mutation is
+// acknowledged. The write is atomic: after a crash the file holds either the
+// previous or the new state. On error the mutation is rolled back, unless it
+// may still be committed (see committing).
+func (c *Controller) save() error {
+	//
+	state := State{
+		Workers:  c.workers,
+		Topics:   c.topics,
+		Buffers:  c.buffers,
+		Replicas: c.replicas,
+		ACL:      c.access,
+		Quotas:   c.quotas,
+		Tokens:   c.tokens,
+	}
+	j, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding controller state: %v", err)
+	}
+	if c.raft != nil {
+		return c.raft.propose(j)
+	}
+	if err := os.MkdirAll(c.Path, 0755); err != nil {
+		return fmt.Errorf("error creating controller data directory: %v", err)
+	}
+	if err := util.WriteFileAtomic(filepath.Join(c.Path, stateFile), j, 0644); err != nil {
+		return fmt.Errorf("error writing controller state: %v", err)
+	}
+	return nil
+}
+
+// committing reports whether a change which failed to save may still be
+// committed by the replicated controllers. Such a change is kept, not rolled
+// back, as rolling it back would make the leader's state differ from the
+// state committed later.
+func committing(err error) bool {
+	return err == ErrorOutcomeUnknown
+}
+
+// saveStatus is the status of responses to requests whose change failed to
+// save: 503 when the change may still be committed, so that clients check and
+// retry, 500 otherwise.
+func saveStatus(err error) int {
+	if committing(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// load reads the controller's metadata from the state file. Data directories
+// written by older versions, with only "topics" and "replicas" files, are
+// read too; workers and buffers then become known as they re-register.
+func (c *Controller) load() error {
+	//
+	j, err := ioutil.ReadFile(filepath.Join(c.Path, stateFile))
+	if os.IsNotExist(err) {
+		return c.loadLegacy()
+	}
+	if err != nil {
+		return fmt.Errorf("error reading controller state: %v", err)
+	}
+	state := State{}
+	if err := json.Unmarshal(j, &state); err != nil {
+		return fmt.Errorf("error parsing controller state: %v", err)
+	}
+	if state.Workers != nil {
+		c.workers = state.Workers
+	}
+	if state.Topics != nil {
+		c.topics = state.Topics
+	}
+	if state.Buffers != nil {
+		c.buffers = state.Buffers
+	}
+	if state.Replicas != nil {
+		c.replicas = state.Replicas
+	}
+	c.access = state.ACL
+	c.quotas = state.Quotas
+	if state.Tokens != nil {
+		c.tokens = state.Tokens
+	}
+	return nil
+}
+
+func (c *Controller) loadLegacy() error {
+	//
+	t, err := ioutil.ReadFile(filepath.Join(c.Path, "topics"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		c.log.Errorf("error reading topics data: %v", err)
+		return nil
+	}
+	if err := json.Unmarshal(t, &c.topics); err != nil {
+		return fmt.Errorf("error parsing topics data: %v", err)
+	}
+	r, err := ioutil.ReadFile(filepath.Join(c.Path, "replicas"))
+	if err != nil {
+		c.log.Errorf("error reading replicas data: %v", err)
+		return nil
+	}
+	if err := json.Unmarshal(r, &c.replicas); err != nil {
+		return fmt.Errorf("error parsing replicas data: %v", err)
+	}
+	return nil
+}
+
+// workerChanged is true if registering w changes persisted metadata, such as
+// whether the worker is draining. Free
+// disk space is refreshed by periodic re-registration and is not persisted
+// on every change.
+func (c *Controller) workerChanged(w *Worker) bool {
+	old, ok := c.workers[w.ID]
+	return !ok || old.URL != w.URL || old.Draining != w.Draining || !reflect.DeepEqual(old.Labels, w.Labels)
+}
@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+const (
+	StatusGreen  = "green"  // all buffers available, with their replicas in sync
+	StatusYellow = "yellow" // all primary buffers available, some with fewer copies than configured
+	StatusRed    = "red"    // some primary buffers unavailable
+)
+
+const (
+	statusInSyncLag    = 100 // messages; how far behind its primary an in sync replica can be
+	statusProbeTimeout = 2 * time.Second
+	statusConcurrency  = 16 // primaries checked at once
+)
+
+// workers which don't respond within statusProbeTimeout are unreachable
+var probeClient = curl.NewClient(5000, statusProbeTimeout)
+
+func probe(u string) ([]byte, error) {
+	//
+	resp, err := probeClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("(%d) %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+type WorkerStatus struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Status of the tenant's cluster, as seen by its controller, with reasons
+// why it isn't green. When a worker goes down the status degrades; buffers
+// are not moved off the worker.
+type Status struct {
+	Status  string                   `json:"status"`
+	Reasons []string                 `json:"reasons"`
+	Workers map[string]*WorkerStatus `json:"workers"`
+	lock    *sync.Mutex
+}
+
+func (s *Status) degrade(status, reason string, args ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if status == StatusRed || s.Status == StatusGreen {
+		s.Status = status
+	}
+	s.Reasons = append(s.Reasons, fmt.Sprintf(reason, args...))
+}
+
+// primary is a primary buffer of a topic, with what is needed to check it
+// without holding the controller's lock.
+type primary struct {
+	*Buffer
+	topic    string
+	replicas []*Buffer // registered replicas
+	expected int       // number of replicas the topic is configured with
+}
+
+// status checks that workers are reachable, and that primary buffers of
+// topics are available and have replicas in sync with them.
+func (c *Controller) status() *Status {
+	//
+	s := &Status{
+		Status:  StatusGreen,
+		Reasons: []string{},
+		Workers: make(map[string]*WorkerStatus),
+		lock:    new(sync.Mutex),
+	}
+	c.lock.Lock()
+	workers := make([]*Worker, 0, len(c.workers))
+	for _, w := range c.workers {
+		workers = append(workers, w)
+	}
+	// worker of each buffer of topics; buffers not on a registered worker
+	// aren't in it
+	location := make(map[string]string)
+	locate := func(b *Buffer) {
+		for _, w := range workers {
+			if c.onWorker(b, w) {
+				location[b.ID] = w.ID
+			}
+		}
+	}
+	primaries := make([]*primary, 0)
+	for _, t := range c.topics {
+		config := t.Config
+		if config == nil {
+			config = c.Defaults
+		}
+		for _, id := range t.Buffers {
+			b, ok := c.buffers[id]
+			if !ok {
+				s.degrade(StatusRed, "buffer %q of topic %q not registered with controller", id, t.ID)
+				continue
+			}
+			locate(b)
+			p := &primary{Buffer: b, topic: t.ID, expected: config.Replicas}
+			for _, r := range c.replicas[id] {
+				if b, ok := c.buffers[r]; ok {
+					locate(b)
+					p.replicas = append(p.replicas, b)
+				}
+			}
+			primaries = append(primaries, p)
+		}
+	}
+	c.lock.Unlock()
+	//
+	if len(workers) == 0 {
+		s.degrade(StatusRed, "no workers registered")
+	}
+	wg := sync.WaitGroup{}
+	for _, w := range workers {
+		x := &WorkerStatus{URL: w.URL, Reachable: true}
+		s.Workers[w.ID] = x
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := probe(x.URL); err != nil {
+				x.Reachable, x.Error = false, err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	for id, w := range s.Workers {
+		if !w.Reachable {
+			s.degrade(StatusYellow, "worker %q (%s) unreachable: %s", id, w.URL, w.Error)
+		}
+	}
+	available := func(b *Buffer) bool {
+		w, ok := s.Workers[location[b.ID]]
+		return ok && w.Reachable
+	}
+	sem := make(chan bool, statusConcurrency)
+	for _, p := range primaries {
+		switch {
+		case location[p.ID] == "":
+			s.degrade(StatusRed, "buffer %q of topic %q not on a registered worker", p.ID, p.topic)
+			continue
+		case !available(p.Buffer):
+			s.degrade(StatusRed, "buffer %q of topic %q unavailable: worker %q unreachable", p.ID, p.topic, location[p.ID])
+			continue
+		}
+		if len(p.replicas) < p.expected {
+			s.degrade(StatusYellow, "buffer %q of topic %q has %d of %d replicas: no workers to place the rest on", p.ID, p.topic, len(p.replicas), p.expected)
+		}
+		if len(p.replicas) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- true
+		go func(p *primary) {
+			defer func() { <-sem; wg.Done() }()
+			n, err := inSync(p, available)
+			switch {
+			case err != nil:
+				s.degrade(StatusYellow, "error checking replicas of buffer %q of topic %q: %v", p.ID, p.topic, err)
+			case n == 0:
+				s.degrade(StatusYellow, "buffer %q of topic %q has no replicas in sync", p.ID, p.topic)
+			}
+		}(p)
+	}
+	wg.Wait()
+	sort.Strings(s.Reasons)
+	return s
+}
+
+// inSync returns the number of replicas of p which are available and no more
+// than statusInSyncLag messages behind p.
+func inSync(p *primary, available func(*Buffer) bool) (int, error) {
+	//
+	body, err := probe(p.URL)
+	if err != nil {
+		return 0, fmt.Errorf("error getting state of buffer: %v", err)
+	}
+	state := &bufferState{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return 0, fmt.Errorf("error parsing state of buffer: %v", err)
+	}
+	body, err = probe(p.URL + "/replicas")
+	if err != nil {
+		return 0, fmt.Errorf("error getting replicas of buffer: %v", err)
+	}
+	lengths := make(map[string]int)
+	if err := json.Unmarshal(body, &lengths); err != nil {
+		return 0, fmt.Errorf("error parsing replicas of buffer: %v", err)
+	}
+	n := 0
+	for _, r := range p.replicas {
+		if l, ok := lengths[r.ID]; ok && available(r) && state.Len-l <= statusInSyncLag {
+			n += 1
+		}
+	}
+	return n, nil
+}
+
+// handleGetStatus reports the status of the cluster: green, yellow or red,
+// with the reasons for it.
+func (c *Controller) handleGetStatus(req *http.Request) *router.Response {
+	//
+	j, _ := json.Marshal(c.status())
+	return &router.Response{Body: j}
+}
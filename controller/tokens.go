@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/acl"
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/router"
+)
+
+// The tenant's API tokens are part of the controller's state, so that they
+// are valid on all nodes of the cluster. Nodes check requests against tokens
+// they get from the controller, see auth.Store. Only nodes can use the
+// routes; tenants pass their token routes on to them.
+
+func (c *Controller) tokenRoutes() []*router.Route {
+	return []*router.Route{
+		{"/tokens", []string{"POST"}, nodeOnly(c.handleMintToken), ""},
+		{"/tokens", []string{"GET"}, nodeOnly(c.handleGetTokens), ""},
+		{"/tokens/_hashes", []string{"GET"}, nodeOnly(c.handleGetTokenHashes), ""},
+		{"/tokens/{token_id:[a-f0-9]{16}}", []string{"DELETE"}, nodeOnly(c.handleRevokeToken), ""},
+	}
+}
+
+func nodeOnly(h router.HandlerFunc) router.HandlerFunc {
+	return func(req *http.Request) *router.Response {
+		if acl.Principal(req) != acl.Node {
+			return &router.Response{Error: fmt.Errorf("node credentials required"), StatusCode: http.StatusForbidden}
+		}
+		return h(req)
+	}
+}
+
+// Tokens returns the tenant's tokens, with the hashes of their secrets.
+func (c *Controller) Tokens() map[string]*auth.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tokens := make(map[string]*auth.Token, len(c.tokens))
+	for id, t := range c.tokens {
+		tokens[id] = t
+	}
+	return tokens
+}
+
+// handleMintToken creates a token for ?principal= (the token's ID when not
+// set). The token is in the response only.
+func (c *Controller) handleMintToken(req *http.Request) *router.Response {
+	//
+	token, t, err := auth.NewToken(req.URL.Query().Get("principal"))
+	if err != nil {
+		return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tokens[t.ID] = t
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			delete(c.tokens, t.ID)
+		}
+		return &router.Response{Error: fmt.Errorf("error saving token: %v", err), StatusCode: saveStatus(err)}
+	}
+	j, _ := json.Marshal(map[string]interface{}{
+		"id":        t.ID,
+		"principal": t.Principal,
+		"created":   t.Created,
+		"token":     token,
+	})
+	c.log.Infof("minted token %q for principal %q", t.ID, t.Principal)
+	return &router.Response{Body: j, StatusCode: http.StatusCreated}
+}
+
+func (c *Controller) handleGetTokens(req *http.Request) *router.Response {
+	//
+	c.lock.Lock()
+	tokens := make([]*auth.Token, 0, len(c.tokens))
+	for _, t := range c.tokens {
+		tokens = append(tokens, t.Info())
+	}
+	c.lock.Unlock()
+	j, _ := json.Marshal(tokens)
+	return &router.Response{Body: j}
+}
+
+func (c *Controller) handleGetTokenHashes(req *http.Request) *router.Response {
+	//
+	j, _ := json.Marshal(c.Tokens())
+	return &router.Response{Body: j}
+}
+
+func (c *Controller) handleRevokeToken(req *http.Request) *router.Response {
+	//
+	id := mux.Vars(req)["token_id"]
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, ok := c.tokens[id]
+	if !ok {
+		return &router.Response{Error: fmt.Errorf("token %q not found", id), StatusCode: http.StatusNotFound}
+	}
+	delete(c.tokens, id)
+	if err := c.save(); err != nil {
+		if !committing(err) {
+			c.tokens[id] = t
+		}
+		return &router.Response{Error: fmt.Errorf("error saving tokens: %v", err), StatusCode: saveStatus(err)}
+	}
+	c.log.Infof("revoked token %q", id)
+	return &router.Response{}
+}
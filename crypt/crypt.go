@@ -0,0 +1,258 @@
+// Package crypt encrypts data at rest with AES-GCM. Keys are read from a key
+// file, and are identified by IDs recorded with the encrypted data, so that
+// keys can be rotated (new data encrypted with a new key) while data written
+// with old keys remains readable, as long as the old keys stay in the file.
+//
+// The key file is JSON:
+//
+//	{"current": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}}
+//
+// where keys are 32 random bytes (AES-256), base64 encoded.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ModeBody   = "body"   // message bodies are encrypted, metadata is not
+	ModeRecord = "record" // whole records, metadata and body, are encrypted
+	KeySize    = 32
+	// first byte of the header of encrypted files; plain segment and offset
+	// files start with a hex digit or '{'
+	headerPrefix = '#'
+)
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// Keyring holds keys read from a key file. The file is read again when it
+// changes, so keys are rotated by adding a key to the file and making it
+// current.
+type Keyring struct {
+	path    string
+	modTime time.Time
+	current string
+	keys    map[string]cipher.AEAD
+	lock    *sync.Mutex
+}
+
+// Load reads keys from the key file at path.
+func Load(path string) (*Keyring, error) {
+	//
+	k := &Keyring{path: path, lock: new(sync.Mutex)}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// New returns a keyring with the given keys, not backed by a file.
+func New(current string, keys map[string][]byte) (*Keyring, error) {
+	//
+	k := &Keyring{lock: new(sync.Mutex)}
+	if err := k.set(&keyFile{Current: current, Keys: keys}); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() []byte {
+	b := make([]byte, KeySize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (k *Keyring) set(f *keyFile) error {
+	//
+	keys := make(map[string]cipher.AEAD, len(f.Keys))
+	for id, key := range f.Keys {
+		if len(key) != KeySize {
+			return fmt.Errorf("key %q must be %d bytes", id, KeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("error creating cipher for key %q: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("error creating cipher for key %q: %v", id, err)
+		}
+		keys[id] = aead
+	}
+	if _, ok := keys[f.Current]; !ok {
+		return fmt.Errorf("current key %q not found", f.Current)
+	}
+	k.current = f.Current
+	k.keys = keys
+	return nil
+}
+
+// reload reads the key file if it changed since it was last read. Must be
+// called with the lock held.
+func (k *Keyring) reload() error {
+	//
+	if k.path == "" {
+		return nil
+	}
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("error reading key file: %v", err)
+	}
+	if info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("error reading key file: %v", err)
+	}
+	f := new(keyFile)
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("error parsing key file: %v", err)
+	}
+	if err := k.set(f); err != nil {
+		return fmt.Errorf("error loading key file %q: %v", k.path, err)
+	}
+	k.modTime = info.ModTime()
+	return nil
+}
+
+// Current returns the key new data is encrypted with.
+func (k *Keyring) Current() (string, cipher.AEAD, error) {
+	//
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if err := k.reload(); err != nil {
+		return "", nil, err
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+// Key returns key id.
+func (k *Keyring) Key(id string) (cipher.AEAD, error) {
+	//
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if aead, ok := k.keys[id]; ok {
+		return aead, nil
+	}
+	// the key may have been added to the file since it was read
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	if aead, ok := k.keys[id]; ok {
+		return aead, nil
+	}
+	return nil, fmt.Errorf("key %q not found", id)
+}
+
+// Seal encrypts plaintext, returning the nonce followed by the ciphertext.
+func Seal(aead cipher.AEAD, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+// Open decrypts data written by Seal.
+func Open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+	b, err := aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %v", err)
+	}
+	return b, nil
+}
+
+// Header starts encrypted files, and records the key (and for segments, the
+// mode) the file is encrypted with.
+type Header struct {
+	Key  string `json:"key"`
+	Mode string `json:"mode,omitempty"`
+}
+
+func (h *Header) Marshal() []byte {
+	j, _ := json.Marshal(h)
+	b := append([]byte{headerPrefix}, j...)
+	return append(b, '\n')
+}
+
+// ReadHeader reads the header from r, returning nil header if r doesn't start
+// with one, and the number of bytes read.
+func ReadHeader(r io.Reader) (*Header, int64, error) {
+	//
+	c := make([]byte, 1)
+	if _, err := io.ReadFull(r, c); err != nil {
+		return nil, 0, err
+	}
+	if c[0] != headerPrefix {
+		return nil, 0, nil
+	}
+	line := make([]byte, 0, 64)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, 0, fmt.Errorf("error reading header: %v", err)
+		}
+		if c[0] == '\n' {
+			break
+		}
+		line = append(line, c[0])
+	}
+	h := new(Header)
+	if err := json.Unmarshal(line, h); err != nil {
+		return nil, 0, fmt.Errorf("error parsing header: %v", err)
+	}
+	return h, int64(len(line) + 2), nil
+}
+
+// SealFile encrypts data with the current key, prefixed with a header.
+func (k *Keyring) SealFile(data []byte) ([]byte, error) {
+	//
+	id, aead, err := k.Current()
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{Key: id}
+	return append(h.Marshal(), Seal(aead, data)...), nil
+}
+
+// OpenFile decrypts data written by SealFile. Data without a header is not
+// encrypted, and is returned as is.
+func OpenFile(k *Keyring, data []byte) ([]byte, error) {
+	//
+	if len(data) == 0 || data[0] != headerPrefix {
+		return data, nil
+	}
+	r := bytes.NewReader(data)
+	h, n, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, fmt.Errorf("file is encrypted with key %q, and no keys are configured", h.Key)
+	}
+	aead, err := k.Key(h.Key)
+	if err != nil {
+		return nil, err
+	}
+	return Open(aead, data[n:])
+}
@@ -0,0 +1,60 @@
+package curl
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryAfter returns the delay asked for by the Retry-After header of resp,
+// given in seconds; 0 when there is none.
+func RetryAfter(resp *http.Response) time.Duration {
+	//
+	if resp == nil {
+		return 0
+	}
+	s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// Retryable is true for responses which may succeed when retried later:
+// server busy, over quota, or unavailable.
+func Retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable,
+		http.StatusInsufficientStorage, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Backoff is the delay between retries: it doubles from Min up to Max with
+// each retry, unless the server asks for longer with Retry-After.
+type Backoff struct {
+	Min   time.Duration
+	Max   time.Duration
+	delay time.Duration
+}
+
+// Next returns the delay before the next retry; resp is the response to the
+// last try, nil when there was none.
+func (b *Backoff) Next(resp *http.Response) time.Duration {
+	//
+	if b.delay == 0 {
+		b.delay = b.Min
+	} else if b.delay *= 2; b.delay > b.Max {
+		b.delay = b.Max
+	}
+	if d := RetryAfter(resp); d > b.delay {
+		return d
+	}
+	return b.delay
+}
+
+// Reset starts the delay over from Min, after a success.
+func (b *Backoff) Reset() {
+	b.delay = 0
+}
@@ -4,19 +4,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/mkocikowski/hbuf/logger"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 500,
-		},
-		Timeout: 5 * time.Second,
-	}
+	client = NewClient(500, 5*time.Second)
+	log    = logger.New("curl")
 )
 
 func Do(req *http.Request) ([]byte, error) {
@@ -57,13 +54,13 @@ func Post(url string, bodyType string, body io.Reader) ([]byte, error) {
 	//
 	resp, err := client.Post(url, bodyType, body)
 	if err != nil {
-		log.Println(err)
+		log.Errorf("%v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println(err)
+		log.Errorf("%v", err)
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
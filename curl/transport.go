@@ -0,0 +1,175 @@
+package curl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mkocikowski/hbuf/metrics"
+	"github.com/mkocikowski/hbuf/stats"
+	"github.com/mkocikowski/hbuf/trace"
+)
+
+var (
+	transports = make([]*http.Transport, 0)
+	tlsConfig  *tls.Config
+	token      string
+	lock       = new(sync.Mutex)
+)
+
+// tokenTransport sets node credentials on requests which don't carry their own.
+type tokenTransport struct {
+	*http.Transport
+}
+
+// calls to controllers, timed for stats; response bodies are not included
+var (
+	controllerRoute = regexp.MustCompile(`/manager(/|$)`)
+	controllerCalls = stats.NewHistogram("controller_call")
+)
+
+var callErrors = metrics.NewCounter("hbuf_internode_call_errors_total", "Failed requests to other nodes: transport errors and 5xx responses.", "host")
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	lock.Lock()
+	tok := token
+	lock.Unlock()
+	tr := trace.FromContext(req.Context())
+	r := req
+	if (tok != "" && req.Header.Get("Authorization") == "") || (tr != nil && req.Header.Get(trace.RequestIDHeader) == "") {
+		// RoundTrip must not modify the request
+		r = req.Clone(req.Context())
+		if tok != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		// requests made while handling a request carry its trace on
+		if tr != nil && r.Header.Get(trace.RequestIDHeader) == "" {
+			tr.SetHeaders(r.Header)
+		}
+	}
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(r)
+	if controllerRoute.MatchString(req.URL.Path) {
+		controllerCalls.Since(start)
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		callErrors.Add(1, req.URL.Host)
+	}
+	return resp, err
+}
+
+// newTransport returns a transport using the process wide TLS config. All
+// http clients should use transports created here, so that SetTLSConfig
+// applies to them.
+func newTransport() *http.Transport {
+	lock.Lock()
+	defer lock.Unlock()
+	t := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	transports = append(transports, t)
+	return t
+}
+
+// NewClient returns a client for requests and responses small enough to be
+// transferred within timeout. Zero timeout means no timeout.
+func NewClient(maxIdleConnsPerHost int, timeout time.Duration) *http.Client {
+	t := newTransport()
+	t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	return &http.Client{Transport: &tokenTransport{t}, Timeout: timeout}
+}
+
+// NewStreamClient returns a client for requests and responses which can take
+// arbitrarily long to transfer, such as snapshots and restores; only the time
+// to get the response headers is limited.
+func NewStreamClient(responseHeaderTimeout time.Duration) *http.Client {
+	t := newTransport()
+	t.ResponseHeaderTimeout = responseHeaderTimeout
+	return &http.Client{Transport: &tokenTransport{t}}
+}
+
+// SetTLSConfig sets the TLS config of all transports, existing and created
+// later. It is meant to be called once, on startup, before any requests are
+// made.
+func SetTLSConfig(c *tls.Config) {
+	lock.Lock()
+	defer lock.Unlock()
+	tlsConfig = c
+	for _, t := range transports {
+		t.TLSClientConfig = c
+	}
+}
+
+// SetToken sets the bearer token sent by all clients on requests which don't
+// set the Authorization header themselves. Nodes set it to their node
+// credentials, command line tools to the user's API token.
+func SetToken(t string) {
+	lock.Lock()
+	defer lock.Unlock()
+	token = t
+}
+
+func loadCA(ca string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", ca)
+	}
+	return pool, nil
+}
+
+// LoadTLSConfig returns client TLS config trusting certificates signed by the
+// CA in PEM file ca (system roots when empty) and, when cert and key are set,
+// presenting that certificate to servers requiring client certificates.
+func LoadTLSConfig(ca, cert, key string) (*tls.Config, error) {
+	//
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool, err := loadCA(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// LoadServerTLSConfig returns server TLS config with certificate cert and key.
+// Client certificates, when presented, are verified against the CA in ca;
+// whether they are required is up to the handler.
+func LoadServerTLSConfig(ca, cert, key string) (*tls.Config, error) {
+	//
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %v", err)
+	}
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+	}
+	if ca != "" {
+		pool, err := loadCA(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c, nil
+}
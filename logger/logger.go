@@ -0,0 +1,219 @@
+// Package logger writes leveled, structured logs, in logfmt or JSON. Each
+// component (worker, buffer, replica, ...) logs through its own Logger, which
+// carries fields identifying what is logging (tenant, worker, buffer, ...).
+// Levels are set per component, and can be changed at runtime.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+const (
+	Logfmt = "logfmt"
+	JSON   = "json"
+	// All sets the level of all components, including ones created later.
+	All = "*"
+)
+
+var (
+	lock                   = new(sync.Mutex)
+	out          io.Writer = os.Stderr
+	format                 = Logfmt
+	defaultLevel           = Info
+	levels                 = make(map[string]*int32)
+)
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	out = w
+	lock.Unlock()
+}
+
+// SetFormat sets the output format, Logfmt or JSON.
+func SetFormat(f string) error {
+	if f != Logfmt && f != JSON {
+		return fmt.Errorf("unknown log format %q", f)
+	}
+	lock.Lock()
+	format = f
+	lock.Unlock()
+	return nil
+}
+
+func componentLevel(component string) *int32 {
+	lock.Lock()
+	defer lock.Unlock()
+	l, ok := levels[component]
+	if !ok {
+		l = new(int32)
+		*l = int32(defaultLevel)
+		levels[component] = l
+	}
+	return l
+}
+
+// SetLevel sets the level of component, or of all components when component
+// is All.
+func SetLevel(component string, level Level) {
+	if component != All {
+		atomic.StoreInt32(componentLevel(component), int32(level))
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	defaultLevel = level
+	for _, l := range levels {
+		atomic.StoreInt32(l, int32(level))
+	}
+}
+
+// Levels returns the levels of all components; All is the level of
+// components created later.
+func Levels() map[string]string {
+	lock.Lock()
+	defer lock.Unlock()
+	m := map[string]string{All: defaultLevel.String()}
+	for c, l := range levels {
+		m[c] = Level(atomic.LoadInt32(l)).String()
+	}
+	return m
+}
+
+// Logger logs for a component, with fields added to every record.
+type Logger struct {
+	component string
+	level     *int32
+	fields    []string // key, value, ...
+}
+
+func New(component string) *Logger {
+	return &Logger{component: component, level: componentLevel(component)}
+}
+
+// With returns a logger with fields kv (key, value, ...) added.
+func (l *Logger) With(kv ...string) *Logger {
+	x := *l
+	x.fields = append(append([]string(nil), l.fields...), kv...)
+	if len(x.fields)%2 != 0 {
+		x.fields = append(x.fields, "")
+	}
+	return &x
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(l.level))
+}
+
+func (l *Logger) Debugf(f string, args ...interface{}) { l.log(Debug, 2, f, args...) }
+func (l *Logger) Infof(f string, args ...interface{})  { l.log(Info, 2, f, args...) }
+func (l *Logger) Warnf(f string, args ...interface{})  { l.log(Warn, 2, f, args...) }
+func (l *Logger) Errorf(f string, args ...interface{}) { l.log(Error, 2, f, args...) }
+
+func (l *Logger) log(level Level, depth int, f string, args ...interface{}) {
+	//
+	if !l.Enabled(level) {
+		return
+	}
+	kv := []string{
+		"ts", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"component", l.component,
+	}
+	if depth > 0 {
+		if _, file, line, ok := runtime.Caller(depth); ok {
+			kv = append(kv, "caller", filepath.Base(file)+":"+strconv.Itoa(line))
+		}
+	}
+	kv = append(kv, "msg", strings.TrimSpace(fmt.Sprintf(f, args...)))
+	kv = append(kv, l.fields...)
+	lock.Lock()
+	defer lock.Unlock()
+	out.Write(encode(format, kv))
+}
+
+func encode(format string, kv []string) []byte {
+	b := new(bytes.Buffer)
+	if format == JSON {
+		b.WriteByte('{')
+		for i := 0; i < len(kv); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(kv[i])
+			v, _ := json.Marshal(kv[i+1])
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+		}
+		b.WriteString("}\n")
+		return b.Bytes()
+	}
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(kv[i])
+		b.WriteByte('=')
+		v := kv[i+1]
+		if v == "" || strings.ContainsAny(v, " =\"\\\t\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// Writer returns a writer logging each write as a record at level, such as
+// for the standard library's log package.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writer{l, level}
+}
+
+type writer struct {
+	*Logger
+	at Level
+}
+
+func (w writer) Write(b []byte) (int, error) {
+	w.log(w.at, 0, "%s", b)
+	return len(b), nil
+}
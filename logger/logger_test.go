@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	b := new(bytes.Buffer)
+	SetOutput(b)
+	defer SetOutput(os.Stderr)
+	defer SetFormat(Logfmt)
+	l := New("test").With("tenant", "foo", "buffer", "a b")
+	l.Debugf("hidden")
+	l.Infof("hello %q", "world")
+	s := b.String()
+	for _, x := range []string{"level=info", "component=test", "caller=logger_test.go:", `msg="hello \"world\""`, `tenant=foo buffer="a b"`} {
+		if !strings.Contains(s, x) {
+			t.Fatalf("expected %s in: %s", x, s)
+		}
+	}
+	if strings.Contains(s, "hidden") {
+		t.Fatalf("debug message logged at level info: %s", s)
+	}
+	b.Reset()
+	SetFormat(JSON)
+	l.Warnf("careful")
+	m := make(map[string]string)
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("unexpected error: %v (%s)", err, b.String())
+	}
+	if m["level"] != "warn" || m["msg"] != "careful" || m["buffer"] != "a b" {
+		t.Fatalf("unexpected record: %v", m)
+	}
+	if err := SetFormat("xml"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	b := new(bytes.Buffer)
+	SetOutput(b)
+	defer SetOutput(os.Stderr)
+	defer SetLevel(All, Info)
+	foo, bar := New("foo"), New("bar")
+	SetLevel("foo", Debug)
+	foo.Debugf("foo")
+	bar.Debugf("bar")
+	if s := b.String(); !strings.Contains(s, "msg=foo") || strings.Contains(s, "msg=bar") {
+		t.Fatalf("unexpected output: %s", s)
+	}
+	SetLevel(All, Error)
+	if foo.Enabled(Warn) || New("baz").Enabled(Warn) {
+		t.Fatal("expected level error for all components")
+	}
+	if l := Levels(); l["foo"] != "error" || l[All] != "error" {
+		t.Fatalf("unexpected levels: %v", l)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -7,18 +7,38 @@ import (
 	"time"
 )
 
+// headers of consumed messages, set from the request which produced them
+const (
+	RequestIDHeader   = "Hbuf-Message-Request-Id"
+	TraceparentHeader = "Hbuf-Message-Traceparent"
+)
+
 type Message struct {
 	ID   int       `json:"id"`
 	TS   time.Time `json:"ts`
 	Type string    `json:"type"`
-	Body []byte    `json:"-"`
-	Sha  []byte    `json:"sha"`
+	// name of the codec the body is compressed with; "" when it isn't
+	Encoding string `json:"encoding,omitempty"`
+	// request ID and traceparent of the request which produced the message
+	RequestID string `json:"request_id,omitempty"`
+	Trace     string `json:"trace,omitempty"`
+	Body      []byte `json:"-"`
+	Sha       []byte `json:"sha"`
 }
 
 func (m *Message) Sum(previous []byte) []byte {
 	h := sha256.New()
 	b := bytes.NewBuffer(previous)
 	fmt.Fprint(b, m.ID, m.TS, m.Type)
+	if m.Encoding != "" {
+		// only when set, so that sums of messages written before
+		// compression was added don't change
+		fmt.Fprint(b, m.Encoding)
+	}
+	if m.RequestID != "" || m.Trace != "" {
+		// same, for messages written before request IDs were added
+		fmt.Fprint(b, m.RequestID, m.Trace)
+	}
 	h.Write(b.Bytes())
 	h.Write(m.Body)
 	m.Sha = h.Sum(nil)
@@ -0,0 +1,221 @@
+// Package metrics keeps labeled counters and gauges, and writes them in the
+// Prometheus text exposition format, to be scraped from the node's /metrics
+// route.
+//
+// Counters and gauges are updated as things happen. Gauges describing the
+// state of things, such as buffer sizes, are instead set by collectors, which
+// are called on every scrape; these gauges are reset before collectors run,
+// so that series of things which no longer exist (deleted buffers) go away.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ContentType = "text/plain; version=0.0.4"
+	counter     = "counter"
+	gauge       = "gauge"
+)
+
+type series struct {
+	values []string
+	value  float64
+}
+
+// Family is a metric with a name and label names; each combination of label
+// values is a separate series.
+type Family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	// reset on every scrape, and set by collectors
+	collected bool
+	series    map[string]*series
+	lock      *sync.Mutex
+}
+
+var (
+	families   = make(map[string]*Family)
+	collectors = make(map[string]func())
+	lock       = new(sync.Mutex)
+	// one scrape at a time, as collectors reset and set gauges
+	scrape = new(sync.Mutex)
+)
+
+func register(name, help, kind string, collected bool, labels []string) *Family {
+	lock.Lock()
+	defer lock.Unlock()
+	if f, ok := families[name]; ok {
+		if f.kind != kind || len(f.labels) != len(labels) {
+			panic(fmt.Sprintf("metric %q registered with different kind or labels", name))
+		}
+		return f
+	}
+	f := &Family{
+		name:      name,
+		help:      help,
+		kind:      kind,
+		labels:    labels,
+		collected: collected,
+		series:    make(map[string]*series),
+		lock:      new(sync.Mutex),
+	}
+	families[name] = f
+	return f
+}
+
+// NewCounter registers counter name, with label names labels. Registering a
+// name again returns the metric registered first.
+func NewCounter(name, help string, labels ...string) *Family {
+	return register(name, help, counter, false, labels)
+}
+
+// NewGauge registers gauge name, with label names labels.
+func NewGauge(name, help string, labels ...string) *Family {
+	return register(name, help, gauge, false, labels)
+}
+
+// NewCollectedGauge registers gauge name, set by collectors, see AddCollector.
+func NewCollectedGauge(name, help string, labels ...string) *Family {
+	return register(name, help, gauge, true, labels)
+}
+
+func (f *Family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %q has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	s, ok := f.series[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[k] = s
+	}
+	return s
+}
+
+// Add adds v to the series with label values values.
+func (f *Family) Add(v float64, values ...string) {
+	f.lock.Lock()
+	f.get(values).value += v
+	f.lock.Unlock()
+}
+
+// Set sets the series with label values values to v.
+func (f *Family) Set(v float64, values ...string) {
+	f.lock.Lock()
+	f.get(values).value = v
+	f.lock.Unlock()
+}
+
+// Delete removes the series with value for label, such as the series of a
+// deleted buffer.
+func (f *Family) Delete(label, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, l := range f.labels {
+		if l != label {
+			continue
+		}
+		for k, s := range f.series {
+			if s.values[i] == value {
+				delete(f.series, k)
+			}
+		}
+	}
+}
+
+// Reset removes all series.
+func (f *Family) Reset() {
+	f.lock.Lock()
+	f.series = make(map[string]*series)
+	f.lock.Unlock()
+}
+
+// AddCollector registers collector c under key, replacing the collector
+// registered under the same key, if any. Collectors set collected gauges.
+func AddCollector(key string, c func()) {
+	lock.Lock()
+	collectors[key] = c
+	lock.Unlock()
+}
+
+func RemoveCollector(key string) {
+	lock.Lock()
+	delete(collectors, key)
+	lock.Unlock()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (f *Family) write(w io.Writer) error {
+	//
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.series) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, k := range keys {
+		s := f.series[k]
+		b.WriteString(f.name)
+		if len(f.labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range f.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, `%s="%s"`, l, escaper.Replace(s.values[i]))
+			}
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(b, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write runs collectors, and writes all metrics to w in the text exposition
+// format.
+func Write(w io.Writer) error {
+	//
+	scrape.Lock()
+	defer scrape.Unlock()
+	lock.Lock()
+	fs := make([]*Family, 0, len(families))
+	for _, f := range families {
+		fs = append(fs, f)
+	}
+	cs := make([]func(), 0, len(collectors))
+	for _, c := range collectors {
+		cs = append(cs, c)
+	}
+	lock.Unlock()
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+	for _, f := range fs {
+		if f.collected {
+			f.Reset()
+		}
+	}
+	for _, c := range cs {
+		c()
+	}
+	for _, f := range fs {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
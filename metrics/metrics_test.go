@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "path", "code")
+	c.Add(1, "/foo", "200")
+	c.Add(2, "/foo", "200")
+	c.Add(1, `/"bar"`+"\n", "500")
+	g := NewGauge("test_temperature", "Temperature.")
+	g.Set(1.5)
+	b := new(bytes.Buffer)
+	if err := Write(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="/\"bar\"\n",code="500"} 1
+test_requests_total{path="/foo",code="200"} 3
+# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature 1.5
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+	// registering again returns the same metric
+	if NewCounter("test_requests_total", "Requests.", "path", "code") != c {
+		t.Fatal("expected the same metric")
+	}
+	c.Reset()
+	g.Reset()
+}
+
+func TestCollector(t *testing.T) {
+	g := NewCollectedGauge("test_queue_length", "Queue length.", "queue")
+	queues := map[string]int{"foo": 1, "bar": 2}
+	AddCollector("test", func() {
+		for q, n := range queues {
+			g.Set(float64(n), q)
+		}
+	})
+	b := new(bytes.Buffer)
+	Write(b)
+	expected := `# HELP test_queue_length Queue length.
+# TYPE test_queue_length gauge
+test_queue_length{queue="bar"} 2
+test_queue_length{queue="foo"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+	// series of queues which are gone go away
+	delete(queues, "bar")
+	b.Reset()
+	Write(b)
+	expected = `# HELP test_queue_length Queue length.
+# TYPE test_queue_length gauge
+test_queue_length{queue="foo"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+	RemoveCollector("test")
+	b.Reset()
+	Write(b)
+	if b.Len() != 0 {
+		t.Fatalf("expected no metrics, got:\n%s", b.String())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	c := NewCounter("test_deleted_total", "Deleted.", "topic", "buffer")
+	c.Add(1, "", "foo")
+	c.Add(1, "t", "foo")
+	c.Add(1, "t", "bar")
+	c.Delete("buffer", "foo")
+	b := new(bytes.Buffer)
+	Write(b)
+	expected := `# HELP test_deleted_total Deleted.
+# TYPE test_deleted_total counter
+test_deleted_total{topic="t",buffer="bar"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+	c.Reset()
+}
@@ -4,82 +4,476 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/controller"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/metrics"
+	"github.com/mkocikowski/hbuf/router"
 	"github.com/mkocikowski/hbuf/stats"
 	"github.com/mkocikowski/hbuf/tenant"
+	"github.com/mkocikowski/hbuf/trace"
+	"github.com/mkocikowski/hbuf/util"
 )
 
-func init() {
-	log.SetFlags(log.Lshortfile)
-}
-
 type Node struct {
-	URL     string
-	Path    string
-	tenants map[string]*tenant.Tenant
+	URL    string
+	Path   string
+	Labels map[string]string // labels of workers on this node
+	Peers  []string          // URLs of all nodes of the cluster; tenant controllers are replicated among them
+	Roles  tenant.Roles      // components run for each tenant; nil for all
+	Join   []string          // URLs of nodes running controllers, for nodes which don't run one
+	MTLS   bool              // require verified client certificates on inter-node routes
+	// credentials of nodes of the cluster; when set, requests must be
+	// authenticated, see auth package
+	NodeToken string
+	tenants   map[string]*tenant.Tenant
+	// each tenant's routes are registered on its own router, so that they
+	// can be removed with the tenant; mux routes can't be unregistered
+	routers map[string]*mux.Router
 	router  *mux.Router
+	loaded  bool // tenants on disk have been loaded
+	drain   bool // the node is draining, see Drain
+	lock    *sync.Mutex
+	log     *logger.Logger
 }
 
 func (n *Node) Init() *Node {
 	//
+	n.log = logger.New("node").With("node", n.URL)
 	n.tenants = make(map[string]*tenant.Tenant)
+	n.routers = make(map[string]*mux.Router)
+	n.lock = new(sync.Mutex)
 	n.router = mux.NewRouter()
 	//
 	n.router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n.lock.Lock()
 		j, _ := json.Marshal(n.tenants)
+		n.lock.Unlock()
 		fmt.Fprintln(w, string(j))
 	}).Methods("GET")
 	//
 	n.router.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, string(stats.Json()))
+		// ?reset=true gets stats and starts a new window, for comparing
+		// runs of load tests
+		fmt.Fprintln(w, string(stats.Json(r.URL.Query().Get("reset") == "true")))
 	}).Methods("GET")
 	n.router.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		stats.Reset()
 	}).Methods("DELETE")
+	n.router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metrics.ContentType)
+		if err := metrics.Write(w); err != nil {
+			n.log.Errorf("error writing metrics: %v", err)
+		}
+	}).Methods("GET")
+	router.RegisterRoutes(n.router, "", n.routes(), nil)
+	// routes of the default tenant are also served on /
+	n.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r := n.tenantRouter("-"); r != nil {
+			r.ServeHTTP(w, req)
+			return
+		}
+		http.NotFound(w, req)
+	})
 	//
-	log.Printf("starting node %q ...", n.URL)
+	n.log.Infof("starting node %q ...", n.URL)
 	return n
 }
 
+func (n *Node) routes() []*router.Route {
+	return []*router.Route{
+		{"/tenants", []string{"GET"}, n.handleGetTenants, "list tenants"},
+		{"/tenants/{tenant}", []string{"POST"}, n.handleCreateTenant, "create tenant; optional body is the tenant's default topic config"},
+		{"/tenants/{tenant}", []string{"DELETE"}, n.handleDeleteTenant, "stop tenant and delete its data"},
+		{"/log", []string{"GET"}, n.handleGetLogLevels, "show log levels of components"},
+		{"/log", []string{"POST"}, n.handleSetLogLevels, `set log levels; body maps components, or "*" for all, to levels: debug, info, warn, error`},
+		{"/healthz", []string{"GET"}, n.handleHealth, "200 when the node's process is up"},
+		{"/readyz", []string{"GET"}, n.handleReady, "200 when the node is ready to serve requests: tenants loaded, workers registered with controllers; 503 otherwise, with reasons"},
+		{"/_drain", []string{"POST"}, n.handleDrain, "drain node: new buffers are not placed on the node's workers, clients write to buffers on other nodes, and /readyz is 503; consuming from the node's buffers goes on"},
+		{"/_drain", []string{"DELETE"}, n.handleDrain, "stop draining node"},
+		{"/debug/traces", []string{"GET"}, n.handleGetTraces, "show spans of recent requests, oldest first; optional trace_id parameter selects spans of one trace"},
+	}
+}
+
 func (n *Node) Load() {
 	//
 	files, _ := ioutil.ReadDir(filepath.Join(n.Path, "tenants"))
 	for _, f := range files {
-		log.Printf("loading data for tenant %q", f.Name())
+		if !util.TenantIDRE.MatchString(f.Name()) {
+			n.log.Warnf("skipping %q: not a valid tenant id", f.Name())
+			continue
+		}
+		n.log.Infof("loading data for tenant %q", f.Name())
 		n.AddTenant(f.Name())
 	}
+	n.lock.Lock()
+	n.loaded = true
+	n.lock.Unlock()
 }
 
 func (n *Node) AddTenant(id string) (*tenant.Tenant, error) {
+	return n.addTenant(id, nil)
+}
+
+// addTenant initializes tenant id, with default topic config defaults; when
+// defaults is nil, defaults are read from the tenant's data directory, or
+// take global values.
+func (n *Node) addTenant(id string, defaults *controller.TopicConfig) (*tenant.Tenant, error) {
 	//
-	if _, ok := n.tenants[id]; ok {
-		return nil, fmt.Errorf("tenant already exists")
+	if !util.TenantIDRE.MatchString(id) {
+		return nil, ErrorInvalidTenant
+	}
+	// the router is added before the tenant is initialized, as the tenant's
+	// workers register with its controller during initialization
+	r := mux.NewRouter()
+	n.lock.Lock()
+	if _, ok := n.routers[id]; ok {
+		n.lock.Unlock()
+		return nil, ErrorTenantExists
 	}
+	n.routers[id] = r
+	n.lock.Unlock()
 	t := &tenant.Tenant{
-		ID:   id,
-		URL:  n.URL + "/tenants/" + id,
-		Path: filepath.Join(n.Path, "tenants", id),
+		ID:          id,
+		URL:         n.URL + "/tenants/" + id,
+		Path:        filepath.Join(n.Path, "tenants", id),
+		Labels:      n.Labels,
+		Roles:       n.Roles,
+		Controllers: n.controllers(id),
+		NodeToken:   n.NodeToken,
+		Defaults:    defaults,
 	}
-	if err := t.Init(n.router, ""); err != nil {
-		log.Println(err)
+	cURL := ""
+	if !n.Roles.Has(tenant.RoleController) && len(t.Controllers) > 0 {
+		cURL = t.Controllers[0]
+	}
+	if err := t.Init(r, cURL); err != nil {
+		n.log.Errorf("%v", err)
+		t.Stop()
+		n.lock.Lock()
+		delete(n.routers, id)
+		n.lock.Unlock()
 		return nil, fmt.Errorf("error initializing tenant: %v", err)
 	}
+	n.lock.Lock()
 	n.tenants[t.ID] = t
-	log.Printf("added tenant %q", t.ID)
+	n.lock.Unlock()
+	n.log.Infof("added tenant %q", t.ID)
 	return t, nil
 }
 
+// RemoveTenant stops tenant id, removes its routes, and deletes its data.
+func (n *Node) RemoveTenant(id string) error {
+	//
+	n.lock.Lock()
+	t, ok := n.tenants[id]
+	if !ok {
+		n.lock.Unlock()
+		return ErrorTenantNotFound
+	}
+	delete(n.tenants, id)
+	delete(n.routers, id)
+	n.lock.Unlock()
+	t.Stop()
+	if err := os.RemoveAll(t.Path); err != nil {
+		return fmt.Errorf("error deleting data of tenant %q: %v", id, err)
+	}
+	n.log.Infof("removed tenant %q", id)
+	return nil
+}
+
+func (n *Node) tenantRouter(id string) *mux.Router {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.routers[id]
+}
+
+func (n *Node) handleGetTenants(req *http.Request) *router.Response {
+	//
+	n.lock.Lock()
+	ids := make([]string, 0, len(n.tenants))
+	for id := range n.tenants {
+		ids = append(ids, id)
+	}
+	n.lock.Unlock()
+	sort.Strings(ids)
+	j, _ := json.Marshal(ids)
+	return &router.Response{Body: j}
+}
+
+func (n *Node) handleGetLogLevels(req *http.Request) *router.Response {
+	j, _ := json.Marshal(logger.Levels())
+	return &router.Response{Body: j}
+}
+
+func (n *Node) handleHealth(req *http.Request) *router.Response {
+	return &router.Response{Body: []byte(`{"status":"ok"}`)}
+}
+
+// handleReady reports whether the node is ready to serve requests, such as
+// for load balancers: tenants on disk have been loaded, and their workers
+// have registered with controllers.
+func (n *Node) handleReady(req *http.Request) *router.Response {
+	//
+	n.lock.Lock()
+	loaded, draining := n.loaded, n.drain
+	tenants := make([]*tenant.Tenant, 0, len(n.tenants))
+	for _, t := range n.tenants {
+		tenants = append(tenants, t)
+	}
+	n.lock.Unlock()
+	reasons := make([]string, 0)
+	if !loaded {
+		reasons = append(reasons, "tenants not loaded")
+	}
+	if draining {
+		reasons = append(reasons, "node draining")
+	}
+	for _, t := range tenants {
+		if err := t.Ready(); err != nil {
+			reasons = append(reasons, fmt.Sprintf("tenant %q: %v", t.ID, err))
+		}
+	}
+	sort.Strings(reasons)
+	j, _ := json.Marshal(map[string]interface{}{"ready": len(reasons) == 0, "reasons": reasons})
+	if len(reasons) > 0 {
+		return &router.Response{Body: j, StatusCode: http.StatusServiceUnavailable}
+	}
+	return &router.Response{Body: j}
+}
+
+// Drain tells controllers and clients to avoid the node's workers, or to stop
+// avoiding them when draining is false, ahead of a shutdown.
+func (n *Node) Drain(draining bool) error {
+	//
+	n.lock.Lock()
+	n.drain = draining
+	tenants := make([]*tenant.Tenant, 0, len(n.tenants))
+	for _, t := range n.tenants {
+		tenants = append(tenants, t)
+	}
+	n.lock.Unlock()
+	errors := make([]string, 0)
+	for _, t := range tenants {
+		if t.Worker == nil {
+			continue
+		}
+		if err := t.Worker.Drain(draining); err != nil {
+			errors = append(errors, fmt.Sprintf("tenant %q: %v", t.ID, err))
+		}
+	}
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return fmt.Errorf("error draining node: %s", strings.Join(errors, "; "))
+	}
+	n.log.Infof("node draining: %v", draining)
+	return nil
+}
+
+func (n *Node) handleDrain(req *http.Request) *router.Response {
+	//
+	if err := n.Drain(req.Method == "POST"); err != nil {
+		return &router.Response{Error: err}
+	}
+	return &router.Response{StatusCode: http.StatusOK}
+}
+
+// handleGetTraces returns spans recorded by the process wide span recorder;
+// 404 when spans aren't recorded.
+func (n *Node) handleGetTraces(req *http.Request) *router.Response {
+	//
+	r := trace.GetRecorder()
+	if r == nil {
+		return &router.Response{
+			Error:      fmt.Errorf("spans aren't recorded"),
+			StatusCode: http.StatusNotFound,
+		}
+	}
+	j, _ := json.Marshal(r.Spans(req.URL.Query().Get("trace_id")))
+	return &router.Response{Body: j}
+}
+
+// handleSetLogLevels sets log levels of components, such as
+// {"*": "info", "replica": "debug"}; "*" is applied first.
+func (n *Node) handleSetLogLevels(req *http.Request) *router.Response {
+	//
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal(body, &m); err != nil {
+		return &router.Response{
+			Error:      fmt.Errorf("error parsing log levels: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	levels := make(map[string]logger.Level)
+	for c, s := range m {
+		l, err := logger.ParseLevel(s)
+		if err != nil {
+			return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+		}
+		levels[c] = l
+	}
+	if l, ok := levels[logger.All]; ok {
+		logger.SetLevel(logger.All, l)
+		delete(levels, logger.All)
+	}
+	for c, l := range levels {
+		logger.SetLevel(c, l)
+	}
+	n.log.Infof("log levels set: %v", m)
+	return n.handleGetLogLevels(req)
+}
+
+func (n *Node) handleCreateTenant(req *http.Request) *router.Response {
+	//
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading request body: %v", err)}
+	}
+	var defaults *controller.TopicConfig
+	if len(body) > 0 {
+		if defaults, err = tenant.ParseDefaults(body); err != nil {
+			return &router.Response{
+				Error:      fmt.Errorf("invalid topic defaults: %v", err),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+	t, err := n.addTenant(mux.Vars(req)["tenant"], defaults)
+	switch err {
+	case nil:
+	case ErrorInvalidTenant:
+		return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+	case ErrorTenantExists:
+		return &router.Response{Error: err, StatusCode: http.StatusConflict}
+	default:
+		return &router.Response{Error: err}
+	}
+	j, _ := json.Marshal(t)
+	return &router.Response{Body: j, StatusCode: http.StatusCreated}
+}
+
+func (n *Node) handleDeleteTenant(req *http.Request) *router.Response {
+	//
+	id := mux.Vars(req)["tenant"]
+	if id == "-" {
+		// the default tenant is added on every start
+		return &router.Response{
+			Error:      fmt.Errorf("default tenant can't be deleted"),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	err := n.RemoveTenant(id)
+	if err == ErrorTenantNotFound {
+		return &router.Response{Error: err, StatusCode: http.StatusNotFound}
+	}
+	if err != nil {
+		return &router.Response{Error: err}
+	}
+	return &router.Response{}
+}
+
+// controllers returns URLs of the controllers of tenant id: on all peers
+// when the node runs a controller, on nodes to join otherwise.
+func (n *Node) controllers(id string) []string {
+	//
+	if !n.Roles.Has(tenant.RoleController) {
+		c := make([]string, 0, len(n.Join))
+		for _, j := range n.Join {
+			c = append(c, j+"/tenants/"+id+"/manager")
+		}
+		return c
+	}
+	if len(n.Peers) == 0 {
+		return nil
+	}
+	peers := n.Peers
+	self := false
+	for _, p := range peers {
+		self = self || p == n.URL
+	}
+	if !self {
+		peers = append([]string{n.URL}, peers...)
+	}
+	c := make([]string, 0, len(peers))
+	for _, p := range peers {
+		c = append(c, p+"/tenants/"+id+"/manager")
+	}
+	return c
+}
+
 func (n *Node) Stop() {
+	n.lock.Lock()
+	tenants := make([]*tenant.Tenant, 0, len(n.tenants))
 	for _, t := range n.tenants {
+		tenants = append(tenants, t)
+	}
+	n.lock.Unlock()
+	for _, t := range tenants {
 		t.Stop()
 	}
-	log.Println("node stopped")
+	n.log.Infof("node stopped")
 }
 
+var (
+	ErrorInvalidTenant  = fmt.Errorf("tenant id must match %q", util.TenantIDRE)
+	ErrorTenantExists   = fmt.Errorf("tenant already exists")
+	ErrorTenantNotFound = fmt.Errorf("tenant not found")
+)
+
+var (
+	// routes used by nodes to talk to each other: tenant controllers and
+	// workers; client routes are used by users
+	internalRoute = regexp.MustCompile(`^/tenants/[^/]+/(manager|worker)(/|$)`)
+	// routes of the node itself, as opposed to routes of its tenants
+	nodeRoute = regexp.MustCompile(`^/(stats|metrics|log|_drain|debug/traces|tenants(/[^/]+)?)?$`)
+	// routes of tenants, served by the tenants' routers
+	tenantRoute = regexp.MustCompile(`^/tenants/([^/]+)/`)
+	// routes streaming snapshots and restores, which take as long as they
+	// take; the server's read and write timeouts are lifted for them
+	streamRoute = regexp.MustCompile(`/(_snapshot|_restore)$`)
+)
+
 func (n *Node) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if n.MTLS && internalRoute.MatchString(req.URL.Path) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+	}
+	if n.NodeToken != "" && nodeRoute.MatchString(req.URL.Path) && !auth.IsNode(req, n.NodeToken) {
+		// tenant routes are authorized by tenants, node routes are for
+		// operators only
+		http.Error(w, "node credentials required", http.StatusUnauthorized)
+		return
+	}
+	if streamRoute.MatchString(req.URL.Path) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			n.log.Errorf("error lifting read deadline: %v", err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			n.log.Errorf("error lifting write deadline: %v", err)
+		}
+	}
+	if m := tenantRoute.FindStringSubmatch(req.URL.Path); m != nil {
+		if r := n.tenantRouter(m[1]); r != nil {
+			r.ServeHTTP(w, req)
+			return
+		}
+	}
 	n.router.ServeHTTP(w, req)
 }
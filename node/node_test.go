@@ -1,15 +1,43 @@
 package node
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/client"
+	"github.com/mkocikowski/hbuf/controller"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/router"
+	"github.com/mkocikowski/hbuf/tenant"
+	"github.com/mkocikowski/hbuf/trace"
+	"github.com/mkocikowski/hbuf/util"
+	"github.com/mkocikowski/hbuf/worker"
 )
 
 func TestNode(t *testing.T) {
@@ -97,6 +125,1970 @@ func TestNode(t *testing.T) {
 	}
 }
 
+// newTestNode starts node n behind a test server, with the server's URL as
+// the node's. Unless n.Path is set, the node is in a new temporary directory.
+// stop stops the node, closes the server, and removes the directory.
+func newTestNode(t *testing.T, n *Node) (server *httptest.Server, stop func()) {
+	//
+	t.Helper()
+	dir := ""
+	if n.Path == "" {
+		d, err := ioutil.TempDir("", "hbuf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Path, dir = d, d
+	}
+	server = httptest.NewServer(n)
+	n.URL = server.URL
+	n.Init()
+	return server, func() {
+		n.Stop()
+		server.Close()
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func addTenant(t *testing.T, n *Node, id string) *tenant.Tenant {
+	//
+	t.Helper()
+	tn, err := n.AddTenant(id)
+	if err != nil {
+		t.Fatalf("unexpected error adding tenant %q: %v", id, err)
+	}
+	return tn
+}
+
+// mustPost and mustGet make requests with the default client, and fail the
+// test on errors other than error status codes.
+func mustPost(t *testing.T, u, contentType string, body io.Reader) *http.Response {
+	//
+	t.Helper()
+	resp, err := http.Post(u, contentType, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp
+}
+
+func mustGet(t *testing.T, u string) *http.Response {
+	//
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp
+}
+
+func TestSealTopic(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/foo"
+	resp := mustPost(t, u, "text/plain", bytes.NewBufferString("bar"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustPost(t, u+"/_seal", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+	resp = mustPost(t, u, "text/plain", bytes.NewBufferString("baz"))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected %d, got: %d", http.StatusConflict, resp.StatusCode)
+	}
+	// data already in the topic can still be consumed
+	resp = mustGet(t, u+"/next")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustPost(t, u+"/_unseal", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustPost(t, u, "text/plain", bytes.NewBufferString("baz"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	// when a buffer can't be sealed, buffers already sealed are unsealed
+	resp = mustPost(t, tenant.Manager.URL+"/topics/bar", "application/json", bytes.NewBufferString(`{"buffers":2,"replicas":0}`))
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&topic)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || len(topic.Buffers) != 2 {
+		t.Fatalf("unexpected response: (%d) %v", resp.StatusCode, topic.Buffers)
+	}
+	buffers := server.URL + "/tenants/-/worker/buffers/"
+	req, _ := http.NewRequest("DELETE", buffers+topic.Buffers[1], nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	resp = mustPost(t, tenant.Client.URL+"/topics/bar/_seal", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got: %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+	resp = mustGet(t, buffers+topic.Buffers[0])
+	b := struct {
+		Sealed bool `json:"sealed"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if b.Sealed {
+		t.Fatalf("buffer %q left sealed", topic.Buffers[0])
+	}
+}
+
+func TestSnapshotTopic(t *testing.T) {
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/foo"
+	for i := 0; i < 10; i++ {
+		resp := mustPost(t, u, "text/plain", bytes.NewBufferString("bar"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(u + "/_snapshot?format=tar.gz")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manifest := struct {
+		Buffers []struct {
+			Len int `json:"len"`
+		} `json:"buffers"`
+	}{}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.Name == "manifest.json" {
+			b, _ := ioutil.ReadAll(tr)
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	if len(manifest.Buffers) != 3 {
+		t.Fatalf("expected 3 buffers in manifest, got: %d", len(manifest.Buffers))
+	}
+	n := 0
+	for _, b := range manifest.Buffers {
+		n += b.Len
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 messages in snapshot, got: %d", n)
+	}
+}
+
+func TestRestoreTopic(t *testing.T) {
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/"
+	for i := 0; i < 10; i++ {
+		mustPost(t, u+"foo", "text/plain", bytes.NewBufferString("bar")).Body.Close()
+	}
+	// consume one message, offsets are restored
+	mustGet(t, u+"foo/next?c=baz").Body.Close()
+	resp := mustGet(t, u+"foo/_snapshot")
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp = mustPost(t, u+"foo/_restore", "application/x-tar", bytes.NewReader(archive))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected %d, got: %d", http.StatusConflict, resp.StatusCode)
+	}
+	resp = mustPost(t, u+"restored/_restore?offsets=true", "application/x-tar", bytes.NewReader(archive))
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+	n := 0
+	for {
+		resp := mustGet(t, u+"restored/next?c=baz")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+		n += 1
+	}
+	if n != 9 {
+		t.Fatalf("expected 9 messages, got: %d", n)
+	}
+	// restored topic is writable
+	resp = mustPost(t, u+"restored", "text/plain", bytes.NewBufferString("bar"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	// empty buffers are listed in the snapshot's manifest, but have no
+	// segments, and aren't restored
+	mustPost(t, u+"one", "text/plain", bytes.NewBufferString("bar")).Body.Close()
+	resp = mustGet(t, u+"one/_snapshot")
+	archive, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp = mustPost(t, u+"one-restored/_restore", "application/x-tar", bytes.NewReader(archive))
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+}
+
+func TestRestoreRawArchive(t *testing.T) {
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/"
+	for i := 0; i < 10; i++ {
+		mustPost(t, u+"foo", "text/plain", bytes.NewBufferString("bar")).Body.Close()
+	}
+	// an archive made by running tar on the worker's buffer directories, with
+	// no manifest
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	root := filepath.Join(node.Path, "tenants", "-", "worker", "buffers")
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		h, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		h.Name, _ = filepath.Rel(root, p)
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tw.Close()
+
+	resp := mustPost(t, u+"restored/_restore", "application/x-tar", archive)
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+	resp.Body.Close()
+	n := 0
+	for {
+		resp := mustGet(t, u+"restored/next?c=baz")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+		n += 1
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 messages, got: %d", n)
+	}
+}
+
+func TestRestoreSlowUpload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// snapshots and restores outlast the server's timeouts
+	node := &Node{Path: dir}
+	server := httptest.NewUnstartedServer(node)
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	node.URL = server.URL
+	node.Init()
+	defer node.Stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/"
+	for i := 0; i < 10; i++ {
+		mustPost(t, u+"foo", "text/plain", bytes.NewBufferString("bar")).Body.Close()
+	}
+	resp := mustGet(t, u+"foo/_snapshot")
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(archive); i += len(archive) / 4 {
+			j := i + len(archive)/4
+			if j > len(archive) {
+				j = len(archive)
+			}
+			pw.Write(archive[i:j])
+			time.Sleep(100 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+	resp = mustPost(t, u+"restored/_restore", "application/x-tar", pr)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(b))
+	}
+}
+
+func TestRestoreCorruptArchive(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/"
+	for i := 0; i < 10; i++ {
+		resp, err := http.Post(u+"foo", "text/plain", bytes.NewBufferString("bar"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Get(u + "foo/_snapshot")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// the snapshot without its first buffer; its manifest lists all buffers
+	missing := new(bytes.Buffer)
+	tw := tar.NewWriter(missing)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	first := ""
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		dir := filepath.Dir(h.Name)
+		if first == "" {
+			first = dir
+		}
+		if dir == first {
+			continue
+		}
+		tw.WriteHeader(h)
+		io.Copy(tw, tr)
+	}
+	tw.Close()
+	// offsets file too large to hold in memory, before the segments
+	large := new(bytes.Buffer)
+	tw = tar.NewWriter(large)
+	tw.WriteHeader(&tar.Header{Name: "buffer/offsets", Mode: 0644, Size: 2 << 20, Typeflag: tar.TypeReg})
+	tw.Write(make([]byte, 2<<20))
+	tw.Close()
+	buffers := func() int {
+		resp, err := http.Get(server.URL + "/tenants/-/manager/buffers")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		b := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&b)
+		return len(b)
+	}
+	n := buffers()
+	// the archive is truncated within a block, as one cut between files
+	// reads as a smaller archive
+	for name, body := range map[string][]byte{
+		"garbage":   []byte("not a tar archive"),
+		"truncated": archive[:len(archive)/2/512*512+100],
+		"missing":   missing.Bytes(),
+		"large":     large.Bytes(),
+	} {
+		resp, err := http.Post(u+"restored/_restore", "application/x-tar", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got: %d", name, http.StatusBadRequest, resp.StatusCode)
+		}
+		// buffers restored before the error are deleted
+		if m := buffers(); m != n {
+			t.Fatalf("%s: expected %d buffers, got: %d", name, n, m)
+		}
+	}
+	resp, err = http.Get(server.URL + "/tenants/-/manager/topics/restored")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d, got: %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestMoveBuffer(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/foo"
+	for i := 0; i < 30; i++ {
+		mustPost(t, u, "text/plain", bytes.NewBufferString("bar")).Body.Close()
+	}
+	mustGet(t, u+"/next?c=baz").Body.Close()
+
+	// a second worker, registered after the topic was created, for the
+	// buffer to be moved to
+	w := &worker.Worker{
+		ID:         util.Uid(),
+		URL:        server.URL + "/w2",
+		Tenant:     "-",
+		Controller: tenant.Manager.URL,
+		Path:       filepath.Join(node.Path, "w2"),
+	}
+	if err := w.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+	router.RegisterRoutes(node.router, "/w2", w.Routes(), nil)
+
+	resp := mustGet(t, tenant.Manager.URL+"/topics/foo")
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	json.Unmarshal(body, &topic)
+	id := topic.Buffers[0]
+
+	resp = mustPost(t, tenant.Manager.URL+"/buffers/"+id+"/_move?worker="+w.ID, "", nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+	}
+	moved := struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}{}
+	json.Unmarshal(body, &moved)
+	if !strings.HasPrefix(moved.URL, w.URL) {
+		t.Fatalf("buffer not moved to the target worker: %v", moved.URL)
+	}
+	resp = mustGet(t, tenant.Manager.URL+"/topics/foo")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	json.Unmarshal(body, &topic)
+	if topic.Buffers[0] != moved.ID {
+		t.Fatalf("topic not updated with moved buffer: %v", topic.Buffers)
+	}
+	// consumer offsets moved with the data
+	n := 0
+	for {
+		resp := mustGet(t, u+"/next?c=baz")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			break
+		}
+		n += 1
+	}
+	if n != 29 {
+		t.Fatalf("expected 29 messages, got: %d", n)
+	}
+	if err := w.Drain(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		buffer string
+		worker string
+		code   int
+	}{
+		{"0000000000000000", w.ID, http.StatusNotFound},
+		{topic.Buffers[1], "nope", http.StatusNotFound},
+		{moved.ID, w.ID, http.StatusConflict},
+		{topic.Buffers[1], w.ID, http.StatusConflict}, // draining
+	} {
+		resp := mustPost(t, tenant.Manager.URL+"/buffers/"+tc.buffer+"/_move?worker="+tc.worker, "", nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Fatalf("%+v: unexpected status code: (%d) %v", tc, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestTopicConfig(t *testing.T) {
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	u := tenant.Manager.URL + "/topics/foo"
+	resp := mustPost(t, u, "application/json", bytes.NewBufferString(`{"buffers":0}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	config := `{"buffers":1,"replicas":0,"config":{"message_max_bytes":4}}`
+	resp = mustPost(t, u, "application/json", bytes.NewBufferString(config))
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+	}
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.Unmarshal(body, &topic)
+	if len(topic.Buffers) != 1 {
+		t.Fatalf("expected 1 buffer, got: %v", topic.Buffers)
+	}
+	u = tenant.Client.URL + "/topics/foo"
+	resp = mustPost(t, u, "text/plain", bytes.NewBufferString("bar"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustPost(t, u, "text/plain", bytes.NewBufferString("monkey"))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got: %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func TestCompression(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	// a second worker, for the replica
+	w := &worker.Worker{
+		ID:         util.Uid(),
+		URL:        server.URL + "/w2",
+		Tenant:     "-",
+		Controller: tenant.Manager.URL,
+		Path:       filepath.Join(node.Path, "w2"),
+	}
+	if err := w.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+	router.RegisterRoutes(node.router, "/w2", w.Routes(), nil)
+	config := `{"buffers":1,"replicas":1,"config":{"compression":"gzip"}}`
+	resp := mustPost(t, tenant.Manager.URL+"/topics/foo", "application/json", bytes.NewBufferString(config))
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+	}
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.Unmarshal(body, &topic)
+	u := tenant.Client.URL + "/topics/foo"
+	msg := strings.Repeat("log line ", 100)
+	for i := 0; i < 2; i++ {
+		resp = mustPost(t, u, "text/plain", bytes.NewBufferString(msg))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+	// consumers that don't ask for compressed bodies get them decompressed
+	resp = mustGet(t, u+"/next")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != msg {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	consume := func(u string) *http.Response {
+		req, _ := http.NewRequest("POST", u, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+	gunzip := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		if e := resp.Header.Get("Content-Encoding"); e != "gzip" {
+			t.Fatalf("expected gzip encoding, got: %q", e)
+		}
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		return string(b)
+	}
+	if b := gunzip(consume(u + "/next")); b != msg {
+		t.Fatalf("unexpected body: %q", b)
+	}
+	// replicas store the compressed records shipped by the primary
+	bufferURL := func(id string) string {
+		resp := mustGet(t, tenant.Manager.URL+"/buffers/"+id)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		b := struct {
+			URL string `json:"url"`
+		}{}
+		json.Unmarshal(body, &b)
+		return b.URL
+	}
+	replicas := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		resp = mustGet(t, bufferURL(topic.Buffers[0])+"/replicas")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(body, &replicas)
+		if synced(replicas, 2) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(replicas) != 1 || !synced(replicas, 2) {
+		t.Fatalf("replica not in sync: %v", replicas)
+	}
+	for r := range replicas {
+		if b := gunzip(consume(bufferURL(r) + "/consumers/c/_next")); b != msg {
+			t.Fatalf("unexpected body: %q", b)
+		}
+	}
+}
+
+func synced(replicas map[string]int, n int) bool {
+	for _, l := range replicas {
+		if l != n {
+			return false
+		}
+	}
+	return len(replicas) > 0
+}
+
+func TestGrowTopic(t *testing.T) {
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	topic := struct {
+		Buffers []string `json:"buffers"`
+		Epochs  []int    `json:"epochs"`
+	}{}
+	write := func(key, epoch string) string {
+		req, _ := http.NewRequest("POST", tenant.Client.URL+"/topics/foo", bytes.NewBufferString("bar"))
+		req.Header.Set("Hbuf-Key", key)
+		if epoch != "" {
+			req.Header.Set("Hbuf-Epoch", epoch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+		}
+		return string(body)
+	}
+	write("k", "")
+
+	resp := mustPost(t, tenant.Manager.URL+"/topics/foo/buffers?count=2", "", nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+	}
+	json.Unmarshal(body, &topic)
+	if len(topic.Buffers) != 5 {
+		t.Fatalf("expected 5 buffers, got: %v", topic.Buffers)
+	}
+	if len(topic.Epochs) != 2 || topic.Epochs[0] != 3 || topic.Epochs[1] != 5 {
+		t.Fatalf("unexpected epochs: %v", topic.Epochs)
+	}
+	// the client picks up the change on metadata refresh; listing topics
+	// forces a refresh
+	mustGet(t, tenant.Client.URL+"/topics").Body.Close()
+	// keys pinned to epoch 0 go to the same buffer as before the topic grew,
+	// so messages with the same key get consecutive ids
+	for i := 1; i < 5; i++ {
+		m := struct {
+			ID int `json:"id"`
+		}{}
+		json.Unmarshal([]byte(write("k", "0")), &m)
+		if m.ID != i {
+			t.Fatalf("expected message id %d, got: %d", i, m.ID)
+		}
+	}
+	req, _ := http.NewRequest("POST", tenant.Client.URL+"/topics/foo", bytes.NewBufferString("bar"))
+	req.Header.Set("Hbuf-Key", "k")
+	req.Header.Set("Hbuf-Epoch", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	zones := map[string]string{}
+	for _, zone := range []string{"a", "b", "c"} {
+		p := "/w-" + zone
+		w := &worker.Worker{
+			ID:         util.Uid(),
+			URL:        server.URL + p,
+			Labels:     map[string]string{"zone": zone, "host": "host-" + zone},
+			Tenant:     "-",
+			Controller: tenant.Manager.URL,
+			Path:       filepath.Join(node.Path, p),
+		}
+		if err := w.Init(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer w.Stop()
+		router.RegisterRoutes(node.router, p, w.Routes(), nil)
+		zones[w.ID] = zone
+	}
+
+	type placement struct {
+		Buffer   string       `json:"buffer"`
+		Worker   string       `json:"worker"`
+		Replicas []*placement `json:"replicas"`
+		Warnings []string     `json:"warnings"`
+	}
+	createTopic := func(id, config string) []*placement {
+		resp := mustPost(t, tenant.Manager.URL+"/topics/"+id, "application/json", bytes.NewBufferString(config))
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+		}
+		topic := struct {
+			Placement []*placement `json:"placement"`
+		}{}
+		json.Unmarshal(body, &topic)
+		return topic.Placement
+	}
+
+	// copies of each buffer are on separate workers, in separate zones
+	for _, p := range createTopic("foo", `{"buffers":2,"replicas":2}`) {
+		if len(p.Replicas) != 2 {
+			t.Fatalf("expected 2 replicas, got: %+v", p)
+		}
+		workers := map[string]bool{p.Worker: true}
+		used := map[string]bool{zones[p.Worker]: true}
+		for _, r := range p.Replicas {
+			if workers[r.Worker] {
+				t.Fatalf("two copies of buffer %q on worker %q", p.Buffer, r.Worker)
+			}
+			workers[r.Worker] = true
+			if used[zones[r.Worker]] {
+				t.Fatalf("two copies of buffer %q in zone %q", p.Buffer, zones[r.Worker])
+			}
+			used[zones[r.Worker]] = true
+		}
+	}
+	// with 4 workers there is room for at most 3 replicas
+	p := createTopic("bar", `{"buffers":1,"replicas":5}`)
+	if len(p[0].Replicas) != 3 || len(p[0].Warnings) != 1 {
+		t.Fatalf("unexpected placement: %+v", p[0])
+	}
+}
+
+func TestControllerState(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	tenant := addTenant(t, node, "-")
+	resp := mustPost(t, tenant.Manager.URL+"/topics/foo", "", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	// a controller started on the same data, without the first one having
+	// been stopped, knows about everything created so far
+	m := &controller.Controller{
+		ID:   util.Uid(),
+		URL:  server.URL + "/m2",
+		Path: tenant.Manager.Path,
+	}
+	if _, err := m.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	router.RegisterRoutes(node.router, "/m2", m.Routes(), nil)
+	resp = mustGet(t, m.URL)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	state := controller.State{}
+	if err := json.Unmarshal(body, &state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	topic, ok := state.Topics["foo"]
+	if !ok {
+		t.Fatalf("topic not found in restarted controller: %s", body)
+	}
+	if len(state.Workers) != 1 || len(state.Buffers) != len(topic.Buffers) {
+		t.Fatalf("unexpected state: %s", body)
+	}
+}
+
+func TestReplicatedController(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	timeout := controller.RaftCommitTimeout
+	controller.RaftCommitTimeout = time.Second
+	defer func() { controller.RaftCommitTimeout = timeout }()
+
+	nodes := make([]*Node, 3)
+	servers := make([]*httptest.Server, 3)
+	peers := make([]string, 3)
+	for i := range nodes {
+		nodes[i] = &Node{Path: filepath.Join(dir, strconv.Itoa(i))}
+		servers[i] = httptest.NewServer(nodes[i])
+		peers[i] = servers[i].URL
+	}
+	for i, n := range nodes {
+		n.URL = servers[i].URL
+		n.Peers = peers
+		n.Init()
+	}
+	for _, n := range nodes {
+		if _, err := n.AddTenant("-"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	stopped := make([]bool, 3)
+	defer func() {
+		for i, n := range nodes {
+			if !stopped[i] {
+				servers[i].Close()
+				n.Stop()
+			}
+		}
+	}()
+	// leader returns the index of the node with the leading controller
+	leader := func() int {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for i := range nodes {
+				if stopped[i] {
+					continue
+				}
+				resp, err := http.Get(peers[i] + "/tenants/-/manager/_raft")
+				if err != nil {
+					continue
+				}
+				status := struct {
+					Role string `json:"role"`
+				}{}
+				json.NewDecoder(resp.Body).Decode(&status)
+				resp.Body.Close()
+				if status.Role == "leader" {
+					return i
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal("no leader elected")
+		return -1
+	}
+
+	l := leader()
+	// workers retry registration until a leader is elected
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		workers := make(map[string]interface{})
+		if resp, err := http.Get(peers[l] + "/tenants/-/manager/workers"); err == nil {
+			json.NewDecoder(resp.Body).Decode(&workers)
+			resp.Body.Close()
+		}
+		if len(workers) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers not registered: %v", workers)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// topic is created through a follower, and the request is forwarded
+	f := (l + 1) % 3
+	resp := mustPost(t, peers[f]+"/tenants/-/manager/topics/foo", "", nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %v", resp.StatusCode, string(body))
+	}
+	// applied entries are compacted into the snapshot
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		status := struct {
+			LastIndex     int `json:"last_index"`
+			SnapshotIndex int `json:"snapshot_index"`
+		}{}
+		resp := mustGet(t, peers[l]+"/tenants/-/manager/_raft")
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if status.SnapshotIndex > 0 && status.LastIndex == status.SnapshotIndex {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log not compacted: %+v", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	servers[l].Close()
+	nodes[l].Stop()
+	stopped[l] = true
+	l = leader()
+	resp = mustGet(t, peers[l]+"/tenants/-/manager/topics/foo")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("topic not found after leader failure: (%d) %v", resp.StatusCode, string(body))
+	}
+
+	// without a majority changes aren't committed; the leader keeps them, as
+	// they may be committed later, and clients are told to check and retry
+	for i := range nodes {
+		if i != l && !stopped[i] {
+			servers[i].Close()
+			nodes[i].Stop()
+			stopped[i] = true
+		}
+	}
+	resp = mustPost(t, peers[l]+"/tenants/-/manager/quotas", "application/json", bytes.NewBufferString(`{"max_topics":7}`))
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got: (%d) %v", http.StatusServiceUnavailable, resp.StatusCode, string(body))
+	}
+	resp = mustGet(t, peers[l]+"/tenants/-/manager/quotas")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"max_topics":7`) {
+		t.Fatalf("expected change to be kept, got: %v", string(body))
+	}
+}
+
+func TestJoinNode(t *testing.T) {
+
+	a := &Node{}
+	sa, stopA := newTestNode(t, a)
+	defer stopA()
+	addTenant(t, a, "-")
+
+	// worker-only node, registering its worker with the controller on a
+	b := &Node{Roles: tenant.Roles{tenant.RoleWorker: true}, Join: []string{sa.URL}}
+	_, stopB := newTestNode(t, b)
+	defer stopB()
+	tb := addTenant(t, b, "-")
+	if tb.Manager != nil || tb.Client != nil {
+		t.Fatalf("worker-only node runs components other than worker")
+	}
+
+	resp := mustGet(t, sa.URL+"/tenants/-/manager/workers")
+	workers := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&workers)
+	resp.Body.Close()
+	if len(workers) != 2 {
+		t.Fatalf("expected 2 workers registered, got: %v", workers)
+	}
+	if _, ok := workers[tb.Worker.ID]; !ok {
+		t.Fatalf("worker of joined node not registered: %v", workers)
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	a := &Node{}
+	sa, stopA := newTestNode(t, a)
+	defer stopA()
+	resp := mustGet(t, sa.URL+"/healthz")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = mustGet(t, sa.URL+"/readyz")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d before tenants are loaded, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	a.Load()
+	addTenant(t, a, "status")
+	resp = mustGet(t, sa.URL+"/readyz")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	m := sa.URL + "/tenants/status/manager"
+	status := func() *controller.Status {
+		resp, err := http.Get(m + "/_status")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		s := new(controller.Status)
+		json.NewDecoder(resp.Body).Decode(s)
+		return s
+	}
+	// without replicas configured, a single worker is enough
+	resp = mustPost(t, m+"/topics/one", "application/json", bytes.NewBufferString(`{"buffers":1,"replicas":0}`))
+	resp.Body.Close()
+	if s := status(); s.Status != controller.StatusGreen {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	// ... but not for a topic with a replica
+	resp = mustPost(t, m+"/topics/two", "application/json", bytes.NewBufferString(`{"buffers":1,"replicas":1}`))
+	resp.Body.Close()
+	if s := status(); s.Status != controller.StatusYellow || len(s.Reasons) != 1 || !strings.Contains(s.Reasons[0], "has 0 of 1 replicas") {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	b := &Node{Roles: tenant.Roles{tenant.RoleWorker: true}, Join: []string{sa.URL}}
+	_, stopB := newTestNode(t, b)
+	addTenant(t, b, "status")
+	resp = mustPost(t, m+"/topics/three", "application/json", bytes.NewBufferString(`{"buffers":1,"replicas":1}`))
+	resp.Body.Close()
+	// replicas of topic "three" are set up in the background
+	for i := 0; ; i++ {
+		s := status()
+		if len(s.Reasons) == 1 && strings.Contains(s.Reasons[0], "topic \"two\"") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("unexpected status: %+v", s)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// the cluster degrades when a worker goes down
+	stopB()
+	s := status()
+	if s.Status == controller.StatusGreen || len(s.Workers) != 2 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	if !strings.Contains(strings.Join(s.Reasons, "\n"), "unreachable") {
+		t.Fatalf("expected unreachable worker in reasons: %v", s.Reasons)
+	}
+}
+
+func TestDrain(t *testing.T) {
+
+	a := &Node{}
+	sa, stopA := newTestNode(t, a)
+	defer stopA()
+	a.Load()
+	ta := addTenant(t, a, "drain")
+	b := &Node{Roles: tenant.Roles{tenant.RoleWorker: true}, Join: []string{sa.URL}}
+	sb, stopB := newTestNode(t, b)
+	defer stopB()
+	b.Load()
+	tb := addTenant(t, b, "drain")
+	m := sa.URL + "/tenants/drain/manager"
+	// workers of a topic created before the drain
+	createTopic := func(id string) map[string]bool {
+		resp, err := http.Post(m+"/topics/"+id, "application/json", bytes.NewBufferString(`{"buffers":2,"replicas":0}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		topic := struct {
+			Placement []struct {
+				Worker string `json:"worker"`
+			} `json:"placement"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&topic)
+		workers := make(map[string]bool)
+		for _, p := range topic.Placement {
+			workers[p.Worker] = true
+		}
+		return workers
+	}
+	if w := createTopic("foo"); !w[tb.Worker.ID] {
+		t.Fatalf("expected buffer on worker of node b: %v", w)
+	}
+	resp := mustPost(t, sb.URL+"/_drain", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = mustGet(t, sb.URL+"/readyz")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "node draining") {
+		t.Fatalf("unexpected response: (%d) %s", resp.StatusCode, body)
+	}
+	// no new buffers on the draining node
+	if w := createTopic("bar"); len(w) != 1 || !w[ta.Worker.ID] {
+		t.Fatalf("expected buffers on worker of node a only: %v", w)
+	}
+	// clients write to buffers on other nodes
+	for i := 0; i < 10; i++ {
+		resp := mustPost(t, ta.Client.URL+"/topics/foo", "text/plain", bytes.NewBufferString("bar"))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	resp = mustGet(t, tb.Worker.URL+"/buffers")
+	buffers := make(map[string]struct {
+		Len int `json:"len"`
+	})
+	json.NewDecoder(resp.Body).Decode(&buffers)
+	resp.Body.Close()
+	for id, x := range buffers {
+		if x.Len != 0 {
+			t.Fatalf("expected no writes to buffer %q on draining node, got %d", id, x.Len)
+		}
+	}
+	req, _ := http.NewRequest("DELETE", sb.URL+"/_drain", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	resp = mustGet(t, sb.URL+"/readyz")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+// writeCert writes a PEM certificate (signed by parent, self-signed when
+// parent is nil) and its key to dir, and returns the certificate and paths.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	certPath := filepath.Join(dir, name+".pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	k, _ := x509.MarshalECPrivateKey(key)
+	keyPath := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0600)
+	return cert, key, certPath, keyPath
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caPath, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, certPath, keyPath := writeCert(t, dir, "node", ca, caKey)
+
+	serverTLS, err := curl.LoadServerTLSConfig(caPath, certPath, keyPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clientTLS, err := curl.LoadTLSConfig(caPath, certPath, keyPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	curl.SetTLSConfig(clientTLS)
+	defer curl.SetTLSConfig(nil)
+
+	node := &Node{Path: dir, MTLS: true}
+	server := httptest.NewUnstartedServer(node)
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+	node.URL = server.URL
+	node.Init()
+	defer node.Stop()
+	// the worker registers with the controller over https, with the node's
+	// client certificate
+	if _, err := node.AddTenant("-"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a user with no client certificate can use client routes, but not
+	// inter-node routes
+	noCert, _ := curl.LoadTLSConfig(caPath, "", "")
+	user := &http.Client{Transport: &http.Transport{TLSClientConfig: noCert}}
+	resp, err := user.Get(server.URL + "/topics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp, err = user.Get(server.URL + "/tenants/-/manager/topics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d, got: %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestTokens(t *testing.T) {
+
+	nodeToken := auth.Secret()
+	curl.SetToken(nodeToken)
+	defer curl.SetToken("")
+
+	node := &Node{NodeToken: nodeToken}
+	server, stop := newTestNode(t, node)
+	defer stop()
+	addTenant(t, node, "-")
+
+	get := func(path, token string) int {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/topics", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code := get("/", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got: %d", http.StatusUnauthorized, code)
+	}
+	// tokens are minted with node credentials, which curl clients send
+	admin := curl.NewClient(1, 0)
+	resp, err := admin.Post(server.URL+"/tenants/-/tokens", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	minted := struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&minted)
+	resp.Body.Close()
+	// principals must be valid names in access policies, and not the node's
+	for _, p := range []string{"a%2Fb", "a+b", strings.Repeat("a", 257), "_node"} {
+		resp, err := admin.Post(server.URL+"/tenants/-/tokens?principal="+p, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("principal %q: expected %d, got: %d", p, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+	if code := get("/topics", minted.Token); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if code := get("/topics", minted.Token+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got: %d", http.StatusUnauthorized, code)
+	}
+	// tenant tokens don't give access to inter-node or node routes
+	if code := get("/tenants/-/manager/topics", minted.Token); code != http.StatusForbidden {
+		t.Fatalf("expected %d, got: %d", http.StatusForbidden, code)
+	}
+	if code := get("/tenants/-/tokens", minted.Token); code != http.StatusForbidden {
+		t.Fatalf("expected %d, got: %d", http.StatusForbidden, code)
+	}
+	// the controller's state holds hashes only
+	b, _ := ioutil.ReadFile(filepath.Join(node.Path, "tenants", "-", "manager", "state"))
+	if !strings.Contains(string(b), minted.ID) {
+		t.Fatalf("token not in controller state")
+	}
+	if strings.Contains(string(b), strings.SplitN(minted.Token, ".", 2)[1]) {
+		t.Fatalf("token stored in plain text")
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/tenants/-/tokens/"+minted.ID, nil)
+	if _, err := curl.Do(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := get("/topics", minted.Token); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got: %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestReplicatedTokens(t *testing.T) {
+
+	interval := auth.RefreshInterval
+	auth.RefreshInterval = 50 * time.Millisecond
+	defer func() { auth.RefreshInterval = interval }()
+	nodeToken := auth.Secret()
+	curl.SetToken(nodeToken)
+	defer curl.SetToken("")
+
+	a := &Node{NodeToken: nodeToken}
+	sa, stopA := newTestNode(t, a)
+	defer stopA()
+	addTenant(t, a, "-")
+	// worker-only node, which checks tokens against the controller on a
+	b := &Node{NodeToken: nodeToken, Roles: tenant.Roles{tenant.RoleWorker: true}, Join: []string{sa.URL}}
+	sb, stopB := newTestNode(t, b)
+	defer stopB()
+	addTenant(t, b, "-")
+	admin := curl.NewClient(1, 0)
+	resp, err := admin.Post(sa.URL+"/tenants/-/tokens", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minted := struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&minted)
+	resp.Body.Close()
+	get := func() int {
+		req, _ := http.NewRequest("GET", sb.URL+"/tenants/-/worker/buffers", nil)
+		req.Header.Set("Authorization", "Bearer "+minted.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the token is valid on b as soon as it is minted on a; the principal
+	// has no roles, so it is allowed nothing
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("expected %d, got: %d", http.StatusForbidden, code)
+	}
+	req, _ := http.NewRequest("DELETE", sb.URL+"/tenants/-/tokens/"+minted.ID, nil)
+	if _, err := curl.Do(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; get() != http.StatusUnauthorized; i++ {
+		if i == 100 {
+			t.Fatalf("revoked token still valid")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestACL(t *testing.T) {
+
+	interval := client.MetadataRefreshInterval
+	client.MetadataRefreshInterval = 50 * time.Millisecond
+	defer func() { client.MetadataRefreshInterval = interval }()
+	register := worker.RegisterInterval
+	worker.RegisterInterval = 50 * time.Millisecond
+	defer func() { worker.RegisterInterval = register }()
+
+	node := &Node{NodeToken: auth.Secret()}
+	curl.SetToken(node.NodeToken)
+	defer curl.SetToken("")
+	server, stop := newTestNode(t, node)
+	defer stop()
+	addTenant(t, node, "-")
+	admin := curl.NewClient(1, 0)
+	tokens := make(map[string]string)
+	for _, p := range []string{"a", "b", "ops"} {
+		resp, err := admin.Post(server.URL+"/tenants/-/tokens?principal="+p, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		minted := struct {
+			Token string `json:"token"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&minted)
+		resp.Body.Close()
+		tokens[p] = minted.Token
+	}
+	// service a may produce to orders, service b may consume from orders
+	// with consumer names prefixed b-, ops may do anything
+	policy := `{
+		"roles": {
+			"producer": [{"topics": ["orders"], "actions": ["produce"]}],
+			"consumer": [{"topics": ["orders"], "consumers": ["b-*"], "actions": ["consume"]}],
+			"ops": [{"topics": ["*"], "actions": ["admin"]}]
+		},
+		"principals": {"a": ["producer"], "b": ["consumer"], "ops": ["ops"]}
+	}`
+	resp, err := admin.Post(server.URL+"/tenants/-/manager/acl", "application/json", strings.NewReader(policy))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	do := func(method, path, principal string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader("foo"))
+		req.Header.Set("Authorization", "Bearer "+tokens[principal])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the client picks up the policy on metadata refresh
+	for i := 0; do("POST", "/topics/payments", "a") != http.StatusForbidden; i++ {
+		if i == 100 {
+			t.Fatalf("policy not applied")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// producers can't pass for replication on worker routes: the message id
+	// they send is ignored
+	if code := do("POST", "/topics/orders", "a"); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	resp, err = admin.Get(server.URL + "/tenants/-/manager/topics/orders")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&topic)
+	resp.Body.Close()
+	resp, err = admin.Get(server.URL + "/tenants/-/manager/buffers/" + topic.Buffers[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buffer := struct {
+		URL string `json:"url"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&buffer)
+	resp.Body.Close()
+	write := func() (int, int) {
+		req, _ := http.NewRequest("POST", buffer.URL, strings.NewReader("foo"))
+		req.Header.Set("Authorization", "Bearer "+tokens["a"])
+		req.Header.Set("Hbuf-Id", "100")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		m := struct {
+			ID int `json:"id"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m.ID
+	}
+	// the worker picks up the topics of buffers on registration refresh
+	code, id := write()
+	for i := 0; code == http.StatusForbidden; i++ {
+		if i == 100 {
+			t.Fatalf("policy not applied by worker")
+		}
+		time.Sleep(20 * time.Millisecond)
+		code, id = write()
+	}
+	if code != http.StatusOK || id == 100 {
+		t.Fatalf("expected message written with id assigned by buffer, got: (%d) %d", code, id)
+	}
+	tests := []struct {
+		method    string
+		path      string
+		principal string
+		code      int
+	}{
+		{"POST", "/topics/orders", "a", http.StatusOK},
+		{"POST", "/topics/orders", "b", http.StatusForbidden},
+		{"POST", "/topics/orders/next?c=b-1", "b", http.StatusOK},
+		{"POST", "/topics/orders/next?c=c-1", "b", http.StatusForbidden},
+		{"POST", "/topics/orders/next?c=b-1", "a", http.StatusForbidden},
+		{"GET", "/tenants/-/manager/topics", "a", http.StatusForbidden},
+		{"GET", "/tenants/-/manager/topics", "ops", http.StatusOK},
+		{"POST", "/tenants/-/manager/acl", "a", http.StatusForbidden},
+		{"DELETE", "/topics/orders", "a", http.StatusForbidden},
+		{"DELETE", "/topics/orders", "ops", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := do(test.method, test.path, test.principal); code != test.code {
+			t.Fatalf("%s %s as %q: expected %d, got %d", test.method, test.path, test.principal, test.code, code)
+		}
+	}
+}
+
+func TestACLBufferTopic(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// workers get the access policy on start, and the topics of buffers on
+	// registration refresh; a buffer created since is checked against the
+	// topic it was created for
+	state := filepath.Join(dir, "tenants", "-", "manager")
+	os.MkdirAll(state, 0755)
+	policy := `{"acl":{
+		"roles": {"producer": [{"topics": ["orders"], "actions": ["produce"]}]},
+		"principals": {"a": ["producer"]}
+	}}`
+	if err := ioutil.WriteFile(filepath.Join(state, "state"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{Path: dir, NodeToken: auth.Secret()}
+	curl.SetToken(node.NodeToken)
+	defer curl.SetToken("")
+	server, stop := newTestNode(t, node)
+	defer stop()
+	addTenant(t, node, "-")
+	admin := curl.NewClient(1, 0)
+	resp, err := admin.Post(server.URL+"/tenants/-/tokens?principal=a", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minted := struct {
+		Token string `json:"token"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&minted)
+	resp.Body.Close()
+
+	resp, err = admin.Post(server.URL+"/tenants/-/manager/topics/orders", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&topic)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp, err = admin.Get(server.URL + "/tenants/-/manager/buffers/" + topic.Buffers[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buffer := struct {
+		URL string `json:"url"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&buffer)
+	resp.Body.Close()
+	req, _ := http.NewRequest("POST", buffer.URL, strings.NewReader("foo"))
+	req.Header.Set("Authorization", "Bearer "+minted.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func TestTenants(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+
+	do := func(method, u, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, u, bytes.NewBufferString(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+	u := server.URL + "/tenants/foo"
+	if code, body := do("POST", u, `{"buffers":0}`); code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: (%d) %s", http.StatusBadRequest, code, body)
+	}
+	if code, body := do("POST", server.URL+"/tenants/foo.bar", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: (%d) %s", http.StatusBadRequest, code, body)
+	}
+	code, body := do("POST", u, `{"buffers":2,"replicas":0}`)
+	if code != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %s", code, body)
+	}
+	tenant := struct {
+		Manager struct {
+			URL string `json:"url"`
+		} `json:"manager"`
+		Client struct {
+			URL string `json:"url"`
+		} `json:"client"`
+	}{}
+	json.Unmarshal(body, &tenant)
+	if code, _ := do("POST", u, ""); code != http.StatusConflict {
+		t.Fatalf("expected %d, got: %d", http.StatusConflict, code)
+	}
+	addTenant(t, node, "-")
+	if _, body := do("GET", server.URL+"/tenants", ""); string(body) != `["-","foo"]` {
+		t.Fatalf("unexpected tenants: %s", body)
+	}
+	// topics auto-created by the tenant's client take the tenant's defaults
+	if code, body := do("POST", tenant.Client.URL+"/topics/bar", "baz"); code != http.StatusOK {
+		t.Fatalf("unexpected status code: (%d) %s", code, body)
+	}
+	code, body = do("GET", tenant.Manager.URL+"/topics/bar", "")
+	topic := struct {
+		Buffers []string `json:"buffers"`
+	}{}
+	json.Unmarshal(body, &topic)
+	if len(topic.Buffers) != 2 {
+		t.Fatalf("expected 2 buffers, got: (%d) %s", code, body)
+	}
+	// the default tenant is not affected
+	if code, _ := do("GET", server.URL+"/topics/bar/next", ""); code != http.StatusNoContent {
+		t.Fatalf("expected %d, got: %d", http.StatusNoContent, code)
+	}
+
+	if code, _ := do("DELETE", server.URL+"/tenants/-", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code, body := do("DELETE", u, ""); code != http.StatusOK {
+		t.Fatalf("unexpected status code: (%d) %s", code, body)
+	}
+	if code, _ := do("POST", tenant.Client.URL+"/topics/bar", "baz"); code != http.StatusNotFound {
+		t.Fatalf("expected %d, got: %d", http.StatusNotFound, code)
+	}
+	if _, err := os.Stat(filepath.Join(node.Path, "tenants", "foo")); !os.IsNotExist(err) {
+		t.Fatalf("tenant data not deleted: %v", err)
+	}
+	if code, _ := do("DELETE", u, ""); code != http.StatusNotFound {
+		t.Fatalf("expected %d, got: %d", http.StatusNotFound, code)
+	}
+	// the id can be used again
+	if code, body := do("POST", u, ""); code != http.StatusCreated {
+		t.Fatalf("unexpected status code: (%d) %s", code, body)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hbuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// workers and clients get quotas on start, and then periodically; set
+	// in the controller's state before the tenant starts, quotas apply
+	// right away
+	state := filepath.Join(dir, "tenants", "-", "manager")
+	os.MkdirAll(state, 0755)
+	quotas := `{"quotas":{"max_topics":1,"max_bytes":4096,"consume_bytes_per_sec":100}}`
+	if err := ioutil.WriteFile(filepath.Join(state, "state"), []byte(quotas), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{Path: dir}
+	_, stop := newTestNode(t, node)
+	defer stop()
+	tenant := addTenant(t, node, "-")
+	resp := mustPost(t, tenant.Manager.URL+"/quotas", "application/json", bytes.NewBufferString(`{"max_bytes":-1}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	msg := strings.Repeat("x", 300)
+	resp = mustPost(t, tenant.Client.URL+"/topics/foo", "text/plain", bytes.NewBufferString(msg))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustPost(t, tenant.Client.URL+"/topics/bar", "text/plain", bytes.NewBufferString(msg))
+	if resp.StatusCode != http.StatusInsufficientStorage || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected %d with Retry-After, got: %d %v", http.StatusInsufficientStorage, resp.StatusCode, resp.Header)
+	}
+	// consuming 300 bytes at 100 bytes/s leaves the next consumer waiting
+	resp = mustGet(t, tenant.Client.URL+"/topics/foo/next")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	resp = mustGet(t, tenant.Client.URL+"/topics/foo/next")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected %d, got: %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if r := resp.Header.Get("Retry-After"); r != "2" && r != "3" {
+		t.Fatalf("unexpected Retry-After: %q", r)
+	}
+	n := 0
+	for ; n < 20; n++ {
+		resp = mustPost(t, tenant.Client.URL+"/topics/foo", "text/plain", bytes.NewBufferString(msg))
+		if resp.StatusCode != http.StatusOK {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusInsufficientStorage || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected %d with Retry-After, got: %d %v", http.StatusInsufficientStorage, resp.StatusCode, resp.Header)
+	}
+	if n < 5 {
+		t.Fatalf("storage quota exceeded too early: after %d messages", n)
+	}
+	resp = mustGet(t, tenant.Manager.URL)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	info := struct {
+		Quotas struct {
+			MaxTopics int `json:"max_topics"`
+		} `json:"quotas"`
+		Usage struct {
+			Topics int `json:"topics"`
+		} `json:"usage"`
+	}{}
+	json.Unmarshal(body, &info)
+	if info.Quotas.MaxTopics != 1 || info.Usage.Topics != 1 {
+		t.Fatalf("unexpected quotas and usage: %s", body)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+
+	// no room for writes: all producer writes are refused
+	max := worker.MaxPendingWritesPerWorker
+	worker.MaxPendingWritesPerWorker = 0
+	defer func() { worker.MaxPendingWritesPerWorker = max }()
+
+	node := &Node{}
+	_, stop := newTestNode(t, node)
+	defer stop()
+	tenant := addTenant(t, node, "-")
+	u := tenant.Client.URL + "/topics/foo"
+	for i := 0; i < 2; i++ {
+		// the second write isn't sent to the buffers, which asked the
+		// client to retry later
+		resp := mustPost(t, u, "text/plain", bytes.NewBufferString("bar"))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("expected %d with Retry-After, got: %d %v", http.StatusTooManyRequests, resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+	// metrics are process wide; a tenant of its own keeps them apart from
+	// those of other tests
+	tenant := addTenant(t, node, "metrics")
+	u := tenant.Client.URL + "/topics/foo"
+	resp := mustPost(t, u, "text/plain", bytes.NewBufferString("bar"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = mustPost(t, u+"/next", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	scrape := func() []byte {
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("unexpected content type: %q", ct)
+		}
+		return b
+	}
+	b := scrape()
+	for _, re := range []string{
+		`(?m)^# TYPE hbuf_produce_messages_total counter$`,
+		`(?m)^hbuf_produce_messages_total\{tenant="metrics",topic="foo",buffer="[a-f0-9]{16}",worker="[^"]+"\} 1$`,
+		`(?m)^hbuf_produce_bytes_total\{tenant="metrics",topic="foo",.*\} 3$`,
+		`(?m)^hbuf_consume_messages_total\{tenant="metrics",topic="foo",.*\} 1$`,
+		`(?m)^hbuf_buffer_messages\{tenant="metrics",topic="foo",.*\} 1$`,
+		`(?m)^hbuf_buffer_segments\{tenant="metrics",topic="foo",.*\} 1$`,
+		`(?m)^hbuf_consumer_lag_messages\{tenant="metrics",topic="foo",.*,consumer="[^"]+"\} 0$`,
+		`(?m)^hbuf_http_requests_total\{route="/tenants/metrics/worker/buffers/[^"]+",method="POST",code="200"\} [1-9]`,
+	} {
+		if !regexp.MustCompile(re).Match(b) {
+			t.Fatalf("no match for %s in:\n%s", re, b)
+		}
+	}
+	// series of deleted buffers go away
+	req, _ := http.NewRequest("DELETE", tenant.Client.URL+"/topics/foo", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if b := scrape(); bytes.Contains(b, []byte(`tenant="metrics",topic="foo"`)) {
+		t.Fatalf("series of deleted topic in:\n%s", b)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+	defer logger.SetLevel(logger.All, logger.Info)
+	resp := mustPost(t, server.URL+"/log", "application/json", bytes.NewBufferString(`{"replica":"loud"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp = mustPost(t, server.URL+"/log", "application/json", bytes.NewBufferString(`{"*":"warn","replica":"debug"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = mustGet(t, server.URL+"/log")
+	levels := make(map[string]string)
+	json.NewDecoder(resp.Body).Decode(&levels)
+	resp.Body.Close()
+	if levels["replica"] != "debug" || levels["node"] != "warn" || levels["*"] != "warn" {
+		t.Fatalf("unexpected levels: %v", levels)
+	}
+}
+
+func TestTrace(t *testing.T) {
+
+	node := &Node{}
+	server, stop := newTestNode(t, node)
+	defer stop()
+	resp := mustGet(t, server.URL+"/debug/traces")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	trace.SetRecorder(trace.NewRecorder(100))
+	defer trace.SetRecorder(nil)
+	tenant := addTenant(t, node, "trace")
+	const (
+		traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+		traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+	)
+	req, _ := http.NewRequest("POST", tenant.Client.URL+"/topics/foo", bytes.NewBufferString("bar"))
+	req.Header.Set(trace.RequestIDHeader, "req-1")
+	req.Header.Set(trace.TraceparentHeader, traceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(trace.RequestIDHeader) != "req-1" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+	// the consumer sees which request produced the message
+	resp = mustPost(t, tenant.Client.URL+"/topics/foo/next", "", nil)
+	resp.Body.Close()
+	if resp.Header.Get(message.RequestIDHeader) != "req-1" || !strings.HasPrefix(resp.Header.Get(message.TraceparentHeader), "00-"+traceID+"-") {
+		t.Fatalf("unexpected message headers: %v", resp.Header)
+	}
+	// requests without a request ID get one
+	resp = mustPost(t, tenant.Client.URL+"/topics/foo", "text/plain", bytes.NewBufferString("baz"))
+	resp.Body.Close()
+	if resp.Header.Get(trace.RequestIDHeader) == "" {
+		t.Fatalf("expected request id header: %v", resp.Header)
+	}
+	resp = mustGet(t, server.URL+"/debug/traces?trace_id="+traceID)
+	var spans []*trace.Span
+	json.NewDecoder(resp.Body).Decode(&spans)
+	resp.Body.Close()
+	// the write to the topic, and the write to the buffer made by the
+	// client on its behalf
+	var client, worker *trace.Span
+	for _, s := range spans {
+		if s.RequestID != "req-1" {
+			t.Fatalf("unexpected span: %+v", s)
+		}
+		switch {
+		case strings.Contains(s.Name, "/topics/") && !strings.HasSuffix(s.Name, "/next") && s.Method == "POST":
+			client = s
+		case strings.HasSuffix(s.Name, "/worker/buffers/{buffer:[a-f0-9]{16}}") && s.Method == "POST":
+			worker = s
+		}
+	}
+	if client == nil || worker == nil {
+		t.Fatalf("expected client and worker spans, got %d spans", len(spans))
+	}
+	if client.ParentID != "00f067aa0ba902b7" || worker.ParentID != client.SpanID {
+		t.Fatalf("unexpected span parents: %+v %+v", client, worker)
+	}
+}
+
 func TestParallel(t *testing.T) {
 	//
 	if testing.Short() {
@@ -0,0 +1,126 @@
+// Package quota limits what a tenant can use: disk space taken by its
+// buffers, number of topics, and produce and consume byte rates. Quotas are
+// part of the tenant's controller state; workers and clients fetch them
+// periodically, so changes take effect on them with a delay.
+//
+// Disk space is checked by workers against the tenant's usage as last
+// reported by all its workers to the controller, so it can be exceeded by
+// what is written between reports. Rates are enforced by each worker and
+// client on its own: a tenant running on n nodes can produce and consume up
+// to n times the rate.
+package quota
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mkocikowski/hbuf/router"
+)
+
+// Quotas of a tenant; zero values mean no limit.
+type Quotas struct {
+	MaxBytes           int64 `json:"max_bytes"`  // total size of the tenant's buffers, replicas included
+	MaxTopics          int   `json:"max_topics"` // number of topics
+	ProduceBytesPerSec int64 `json:"produce_bytes_per_sec"`
+	ConsumeBytesPerSec int64 `json:"consume_bytes_per_sec"`
+}
+
+func (q *Quotas) Validate() error {
+	switch {
+	case q.MaxBytes < 0:
+		return fmt.Errorf("max_bytes must be >= 0")
+	case q.MaxTopics < 0:
+		return fmt.Errorf("max_topics must be >= 0")
+	case q.ProduceBytesPerSec < 0:
+		return fmt.Errorf("produce_bytes_per_sec must be >= 0")
+	case q.ConsumeBytesPerSec < 0:
+		return fmt.Errorf("consume_bytes_per_sec must be >= 0")
+	}
+	return nil
+}
+
+// Usage of a tenant, against its quotas.
+type Usage struct {
+	Bytes  int64 `json:"bytes"`
+	Topics int   `json:"topics"`
+	// bytes used on each of the tenant's workers, as last reported
+	Workers map[string]int64 `json:"workers"`
+}
+
+// Status is quotas of a tenant, and their usage.
+type Status struct {
+	Quotas *Quotas `json:"quotas"`
+	Usage  *Usage  `json:"usage"`
+}
+
+// Limiter limits a rate of bytes. Each second rate bytes are added to the
+// limiter's allowance, up to rate; bytes taken are subtracted from it. Taking
+// more than the allowance puts the limiter in debt, and no more bytes are
+// allowed until the debt is paid off, so that messages larger than the rate
+// can still pass.
+type Limiter struct {
+	rate      int64
+	allowance float64
+	last      time.Time
+	lock      *sync.Mutex
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{lock: new(sync.Mutex)}
+}
+
+// SetRate sets the rate in bytes per second; 0 for no limit.
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate != l.rate {
+		l.rate = rate
+		l.allowance = float64(rate)
+		l.last = time.Now()
+	}
+}
+
+func (l *Limiter) update() {
+	now := time.Now()
+	l.allowance += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.allowance > float64(l.rate) {
+		l.allowance = float64(l.rate)
+	}
+	l.last = now
+}
+
+// Wait returns how long until bytes are allowed again; 0 when they are now.
+func (l *Limiter) Wait() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.update()
+	if l.allowance >= 0 {
+		return 0
+	}
+	return time.Duration(-l.allowance / float64(l.rate) * float64(time.Second))
+}
+
+// Take subtracts n bytes from the allowance.
+func (l *Limiter) Take(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate == 0 {
+		return
+	}
+	l.update()
+	l.allowance -= float64(n)
+}
+
+// Exceeded returns an error response for a quota exceeded: status is 429 for
+// rates, 507 for storage. The Retry-After header is set to retry.
+func Exceeded(status int, retry time.Duration, err error) *router.Response {
+	return &router.Response{
+		Error:      fmt.Errorf("quota exceeded: %v", err),
+		StatusCode: status,
+		Header:     router.RetryAfter(retry),
+	}
+}
@@ -0,0 +1,41 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter()
+	l.Take(1 << 20)
+	if d := l.Wait(); d != 0 {
+		t.Fatalf("expected no limit, got: %v", d)
+	}
+	l.SetRate(100)
+	if d := l.Wait(); d != 0 {
+		t.Fatalf("expected no wait, got: %v", d)
+	}
+	// larger than the rate, passes, and puts the limiter in debt
+	l.Take(300)
+	d := l.Wait()
+	if d < time.Second || d > 2*time.Second {
+		t.Fatalf("expected wait of about 2s, got: %v", d)
+	}
+	l.SetRate(100) // same rate doesn't reset
+	if l.Wait() == 0 {
+		t.Fatalf("expected wait")
+	}
+	l.SetRate(0)
+	if d := l.Wait(); d != 0 {
+		t.Fatalf("expected no limit, got: %v", d)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Quotas{MaxBytes: 1, ConsumeBytesPerSec: 1}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&Quotas{MaxTopics: -1}).Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -1,14 +1,25 @@
 package router
 
 import (
-	"log"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/logger"
+	"github.com/mkocikowski/hbuf/metrics"
+	"github.com/mkocikowski/hbuf/trace"
 )
 
 type HandlerFunc func(*http.Request) *Response
 
+// Authorizer is called before the handler of a route; when it returns a
+// response, that response is sent and the handler is not called. Nil
+// Authorizer allows all requests.
+type Authorizer func(*http.Request) *Response
+
 type Route struct {
 	Path    string      `json:"path"`
 	Methods []string    `json:"methods"`
@@ -21,13 +32,75 @@ type Response struct {
 	StatusCode  int
 	Error       error
 	ContentType string
+	// set on the response in addition to Content-Type
+	Header http.Header
+	// when Stream is set it is called to write the response body, and Body
+	// is ignored; used for responses too large to be held in memory
+	Stream func(io.Writer) error
+}
+
+// RetryAfter returns a Retry-After header asking clients to wait d, rounded up
+// to full seconds.
+func RetryAfter(d time.Duration) http.Header {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return http.Header{"Retry-After": []string{strconv.Itoa(s)}}
+}
+
+var log = logger.New("router")
+
+var httpRequests = metrics.NewCounter("hbuf_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code")
+
+// finish records the span of a handled request, and logs it: at debug level,
+// or as a warning on server errors.
+func finish(t *trace.Trace, route, method string, status int, start time.Time) {
+	//
+	d := time.Since(start)
+	if r := trace.GetRecorder(); r != nil {
+		r.Record(&trace.Span{
+			TraceID:   t.TraceID,
+			SpanID:    t.SpanID,
+			ParentID:  t.ParentID,
+			RequestID: t.RequestID,
+			Name:      route,
+			Method:    method,
+			Status:    status,
+			Start:     start,
+			Duration:  d,
+		})
+	}
+	if status >= 500 {
+		log.With(t.Fields()...).Warnf("%s %s: %d (%v)", method, route, status, d)
+	} else if log.Enabled(logger.Debug) {
+		log.With(t.Fields()...).Debugf("%s %s: %d (%v)", method, route, status, d)
+	}
 }
 
-func RegisterRoutes(router *mux.Router, base string, routes []*Route) {
+func RegisterRoutes(router *mux.Router, base string, routes []*Route, auth Authorizer) {
 	for _, r := range routes {
 		r := r // see section 5.6.1 in "the go programming language" very important caveat
+		route := base + r.Path
 		f := func(w http.ResponseWriter, req *http.Request) {
-			resp := r.Handler(req)
+			start := time.Now()
+			t := trace.FromRequest(req)
+			req = req.WithContext(trace.NewContext(req.Context(), t))
+			w.Header().Set(trace.RequestIDHeader, t.RequestID)
+			var resp *Response
+			if auth != nil {
+				resp = auth(req)
+			}
+			if resp == nil {
+				resp = r.Handler(req)
+			}
+			defer func() {
+				httpRequests.Add(1, route, req.Method, strconv.Itoa(resp.StatusCode))
+				finish(t, route, req.Method, resp.StatusCode, start)
+			}()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
 			if resp.Error != nil {
 				if resp.StatusCode == 0 {
 					resp.StatusCode = http.StatusInternalServerError
@@ -43,14 +116,19 @@ func RegisterRoutes(router *mux.Router, base string, routes []*Route) {
 				resp.StatusCode = http.StatusOK
 			}
 			w.WriteHeader(resp.StatusCode)
-			_, err := w.Write(resp.Body)
+			var err error
+			if resp.Stream != nil {
+				err = resp.Stream(w)
+			} else {
+				_, err = w.Write(resp.Body)
+			}
 			if err != nil {
-				log.Printf("error sending response body to client: %v", err)
+				log.Errorf("error sending response body to client: %v", err)
 				// TODO: anything else in the way to cleanup or signaling to
 				// the client? the response is partially sent at this point, so
 				// can't change the status code / headers
 			}
 		}
-		router.HandleFunc(base+r.Path, f).Methods(r.Methods...)
+		router.HandleFunc(route, f).Methods(r.Methods...)
 	}
 }
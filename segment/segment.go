@@ -4,6 +4,7 @@ package segment
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,8 +12,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/mkocikowski/hbuf/crypt"
 	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/stats"
 )
 
 func init() {
@@ -28,13 +32,24 @@ var (
 	ErrorOutOfBounds   = fmt.Errorf("message id out of segment bounds")
 )
 
+var (
+	writeLatency = stats.NewHistogram("segment_write")
+	fsyncLatency = stats.NewHistogram("segment_fsync")
+)
+
 type Config struct {
 	OffsetCacheSize int `json:"segment_offset_cache_size"`
 }
 
 type Segment struct {
-	Path      string
-	First     int
+	Path  string
+	First int
+	// ID of the key the segment is encrypted with, and the encryption mode
+	// (see crypt package); empty when the segment is not encrypted
+	Key       string
+	Mode      string
+	aead      cipher.AEAD
+	start     int64 // size of the header of encrypted segments
 	len       int
 	lenLock   *sync.Mutex
 	sizeB     int64
@@ -56,16 +71,47 @@ func (s *Segment) init() *Segment {
 }
 
 func New(path string, first int) (*Segment, error) {
+	return NewEncrypted(path, first, nil, "")
+}
+
+// NewEncrypted creates a segment encrypted, in mode (crypt.ModeBody or
+// crypt.ModeRecord), with the current key of keys. The ID of the key is
+// recorded in the segment's header. When mode is "" the segment is not
+// encrypted.
+func NewEncrypted(path string, first int, keys *crypt.Keyring, mode string) (*Segment, error) {
 	//
 	var err error
 	s := (&Segment{
 		Path:  filepath.Join(path, fmt.Sprintf("segment_%016x", first)),
 		First: first,
 	}).init()
+	var header []byte
+	switch mode {
+	case "":
+	case crypt.ModeBody, crypt.ModeRecord:
+		if keys == nil {
+			return nil, fmt.Errorf("encrypted segment requires keys")
+		}
+		s.Key, s.aead, err = keys.Current()
+		if err != nil {
+			return nil, fmt.Errorf("error getting encryption key: %v", err)
+		}
+		s.Mode = mode
+		header = (&crypt.Header{Key: s.Key, Mode: s.Mode}).Marshal()
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q", mode)
+	}
 	s.writer, err = os.OpenFile(s.Path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("error opening segment file for writing: %v", err)
 	}
+	if header != nil {
+		if _, err := s.writer.Write(header); err != nil {
+			return nil, fmt.Errorf("error writing segment header: %v", err)
+		}
+		s.start = int64(len(header))
+		s.sizeB = s.start
+	}
 	s.reader, err = os.Open(s.Path)
 	if err != nil {
 		return nil, fmt.Errorf("error opening segment file for reading: %v", err)
@@ -74,6 +120,11 @@ func New(path string, first int) (*Segment, error) {
 }
 
 func Open(path string) (*Segment, error) {
+	return OpenWithKeys(path, nil)
+}
+
+// OpenWithKeys opens a segment which may be encrypted with one of keys.
+func OpenWithKeys(path string, keys *crypt.Keyring) (*Segment, error) {
 	//
 	var err error
 	s := (&Segment{Path: path}).init()
@@ -85,6 +136,9 @@ func Open(path string) (*Segment, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error opening segment file for reading: %v", err)
 	}
+	if err := s.readHeader(keys); err != nil {
+		return nil, err
+	}
 	// get id of first message
 	m, err := s.read()
 	if err == io.EOF {
@@ -104,6 +158,31 @@ func Open(path string) (*Segment, error) {
 	return s, nil
 }
 
+// readHeader reads the header of an encrypted segment, leaving the reader at
+// the first record.
+func (s *Segment) readHeader(keys *crypt.Keyring) error {
+	//
+	h, n, err := crypt.ReadHeader(s.reader)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading segment header: %v", err)
+	}
+	if h == nil {
+		s.reader.Seek(0, 0)
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("segment is encrypted with key %q, and no keys are configured", h.Key)
+	}
+	if s.aead, err = keys.Key(h.Key); err != nil {
+		return fmt.Errorf("error getting segment key: %v", err)
+	}
+	s.Key, s.Mode, s.start = h.Key, h.Mode, n
+	return nil
+}
+
 func (s *Segment) Close() {
 	s.writer.Close()
 	s.writer = nil
@@ -122,7 +201,7 @@ func (s *Segment) SizeB() int64 {
 }
 
 func (s *Segment) count() (int, error) {
-	s.reader.Seek(0, 0)
+	s.reader.Seek(s.start, 0)
 	var err error
 	for i := 0; ; i++ {
 		err = s.next()
@@ -192,7 +271,7 @@ func (s *Segment) seek(n int) error {
 		s.reader.Seek(pos, 0)
 		i = n - 1
 	} else {
-		s.reader.Seek(0, 0)
+		s.reader.Seek(s.start, 0)
 	}
 	for ; i < n; i++ {
 		err := s.next()
@@ -240,10 +319,20 @@ func (s *Segment) read() (*message.Message, error) {
 	if _, err := s.reader.Read(b); err != nil {
 		return nil, err
 	}
+	if s.Mode == crypt.ModeRecord {
+		if b, err = crypt.Open(s.aead, b); err != nil {
+			return nil, err
+		}
+	}
 	m := new(message.Message)
 	if err := unmarshal(b, m); err != nil {
 		return nil, err
 	}
+	if s.Mode == crypt.ModeBody {
+		if m.Body, err = crypt.Open(s.aead, m.Body); err != nil {
+			return nil, err
+		}
+	}
 	return m, nil
 }
 
@@ -272,18 +361,32 @@ func marshal(m *message.Message) ([]byte, error) {
 }
 
 func (s *Segment) write(m *message.Message) error {
-	b, _ := marshal(m)
+	var b []byte
+	switch s.Mode {
+	case crypt.ModeBody:
+		x := *m
+		x.Body = crypt.Seal(s.aead, m.Body)
+		b, _ = marshal(&x)
+	case crypt.ModeRecord:
+		b, _ = marshal(m)
+		b = crypt.Seal(s.aead, b)
+	default:
+		b, _ = marshal(m)
+	}
 	head := fmt.Sprintf("%08x", int32(len(b)))
+	start := time.Now()
 	if _, err := s.writer.WriteString(head); err != nil {
 		return err
 	}
 	if _, err := s.writer.Write(b); err != nil {
 		return err
 	}
+	writeLatency.Since(start)
 	s.sizeBLock.Lock()
 	s.sizeB += int64(len(head) + len(b))
 	s.sizeBLock.Unlock()
 	// skipping Sync() improves performance by order of magnitude
+	defer fsyncLatency.Since(time.Now())
 	return s.writer.Sync()
 }
 
@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mkocikowski/hbuf/crypt"
 	"github.com/mkocikowski/hbuf/message"
 )
 
@@ -161,6 +162,66 @@ func TestReadWrite(t *testing.T) {
 	s.Close()
 }
 
+func TestEncrypted(t *testing.T) {
+	//
+	keys, err := crypt.New("k1", map[string][]byte{"k1": crypt.GenerateKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{crypt.ModeBody, crypt.ModeRecord} {
+		dir, err := ioutil.TempDir("", "hbuf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewEncrypted(dir, 10, keys, mode)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 10; i < 20; i++ {
+			m := &message.Message{ID: i, TS: time.Now().UTC(), Type: "text/plain", Body: []byte(fmt.Sprintf("secret-%d", i))}
+			if err := s.Write(m); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		s.Close()
+		b, _ := ioutil.ReadFile(s.Path)
+		if bytes.Contains(b, []byte("secret")) {
+			t.Fatalf("%s: plain text found in encrypted segment", mode)
+		}
+		if bytes.Contains(b, []byte("text/plain")) != (mode == crypt.ModeBody) {
+			t.Fatalf("%s: metadata encrypted in body mode, or not encrypted in record mode", mode)
+		}
+		if _, err := Open(s.Path); err == nil {
+			t.Fatalf("%s: expected error opening encrypted segment without keys", mode)
+		}
+		s, err = OpenWithKeys(s.Path, keys)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s.First != 10 || s.Len() != 10 || s.Key != "k1" || s.Mode != mode {
+			t.Fatalf("%s: unexpected segment: %+v", mode, s)
+		}
+		for _, i := range []int{9, 3, 0} {
+			m, err := s.Read(i)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(m.Body) != fmt.Sprintf("secret-%d", i+10) || m.ID != i+10 {
+				t.Fatalf("%s: unexpected message: %d %q", mode, m.ID, m.Body)
+			}
+		}
+		other, _ := crypt.New("k1", map[string][]byte{"k1": crypt.GenerateKey()})
+		x, err := OpenWithKeys(s.Path, other)
+		if err == nil {
+			_, err = x.Read(0)
+		}
+		if err == nil {
+			t.Fatalf("%s: expected error reading with wrong key", mode)
+		}
+	}
+}
+
 func TestRWParallel(t *testing.T) {
 
 	if testing.Short() {
@@ -0,0 +1,119 @@
+package stats
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// histogram counts durations, in microseconds, in fixed log-linear buckets:
+// values under 8 get a bucket each, larger values 8 buckets per power of 2.
+// Quantiles are accurate to within 1/16 of the value. Observations are
+// atomic; histograms are sharded, and merged to be read.
+type histogram struct {
+	buckets [8 + 61*8]int64
+	count   int64
+	max     int64
+}
+
+func bucket(v int64) int {
+	if v < 8 {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - 4
+	return (shift+1)*8 + int(v>>uint(shift)) - 8
+}
+
+// value returns the middle of bucket i.
+func value(i int) int64 {
+	if i < 8 {
+		return int64(i)
+	}
+	shift := uint(i/8 - 1)
+	m := int64(i%8 + 8)
+	lower := m << shift
+	return lower + (int64(1)<<shift)/2
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Microseconds()
+	atomic.AddInt64(&h.buckets[bucket(v)], 1)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			return
+		}
+	}
+}
+
+// add adds the counts of x to h; h must not be in use.
+func (h *histogram) add(x *histogram) {
+	for i := range x.buckets {
+		h.buckets[i] += atomic.LoadInt64(&x.buckets[i])
+	}
+	h.count += atomic.LoadInt64(&x.count)
+	if max := atomic.LoadInt64(&x.max); max > h.max {
+		h.max = max
+	}
+}
+
+func (h *histogram) reset() {
+	for i := range h.buckets {
+		atomic.StoreInt64(&h.buckets[i], 0)
+	}
+	atomic.StoreInt64(&h.count, 0)
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// quantile returns the value, in microseconds, at quantile q (0 < q <= 1);
+// h must not be in use.
+func (h *histogram) quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var n int64
+	for i, c := range h.buckets {
+		n += c
+		if n >= rank {
+			if v := value(i); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func ms(us int64) float64 {
+	return float64(us) / 1000
+}
+
+// summary of histogram name, as reported in stats JSON; durations are in
+// milliseconds.
+type summary struct {
+	Name  string  `json:"name"`
+	Count int64   `json:"val"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func (h *histogram) summary(name string) *summary {
+	return &summary{
+		Name:  name,
+		Count: h.count,
+		P50:   ms(h.quantile(0.5)),
+		P90:   ms(h.quantile(0.9)),
+		P99:   ms(h.quantile(0.99)),
+		P999:  ms(h.quantile(0.999)),
+		Max:   ms(h.max),
+	}
+}
@@ -1,57 +1,238 @@
+// Package stats keeps counters, gauges and latency histograms, reported as
+// JSON on the node's /stats route.
+//
+// Stats are registered up front, usually as package variables, and updated
+// with atomic operations on one of several shards, chosen at random, so that
+// concurrent updates don't contend for a lock or a cache line. Reads sum the
+// shards. Resets are not atomic with respect to concurrent updates: an update
+// made while stats are being reset may be lost.
 package stats
 
 import (
 	"encoding/json"
+	"math/rand"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	Counter byte = 'c'
-	Gauge        = 'g'
+	Counter   byte = 'c'
+	Gauge          = 'g'
+	Histogram      = 'h' // Duration is observed; reported as count and quantiles
 )
 
+// Stat is a single update of stat Name, sent on Stats.
 type Stat struct {
-	Name   string `json:"name"`
-	Kind   byte   `json:"-"`
-	IntVal int    `json:"val"`
+	Name     string        `json:"name"`
+	Kind     byte          `json:"-"`
+	IntVal   int           `json:"val"`
+	Duration time.Duration `json:"-"`
 }
 
 var (
-	stats = make(map[string]*Stat)
+	registry = make(map[string]stat)
+	lock     = new(sync.Mutex)
+	since    = time.Now().UnixNano() // start of the stats window
+	shards   = numShards()
+	// Stats is a compatibility shim for code sending updates as Stat values:
+	// updates are applied by a single goroutine, which registers stats on
+	// first use. Sends block when the channel is full; use the stats
+	// returned by NewCounter, NewGauge and NewHistogram instead.
 	Stats = make(chan *Stat, 1<<12)
-	lock  = new(sync.Mutex)
 )
 
 func init() {
 	go listen()
 }
 
+// numShards is the number of shards of each counter and histogram: a power of
+// 2, at least the number of CPUs.
+func numShards() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n *= 2
+	}
+	return n
+}
+
+func shard() int {
+	return int(rand.Uint32() & uint32(shards-1))
+}
+
+type stat interface {
+	json(name string) interface{}
+	reset()
+}
+
+// cell is an int64 alone on its cache line, so that updates to neighbouring
+// cells don't contend.
+type cell struct {
+	n int64
+	_ [56]byte
+}
+
+// Int is a counter, or a gauge.
+type Int struct {
+	kind  byte
+	cells []cell
+}
+
+// Add adds n to a counter, or to a gauge. Gauges have a single cell.
+func (s *Int) Add(n int) {
+	i := 0
+	if len(s.cells) > 1 {
+		i = shard()
+	}
+	atomic.AddInt64(&s.cells[i].n, int64(n))
+}
+
+// Set sets the value of a gauge, or of a counter, whose other shards are
+// zeroed.
+func (s *Int) Set(n int) {
+	atomic.StoreInt64(&s.cells[0].n, int64(n))
+	for i := 1; i < len(s.cells); i++ {
+		atomic.StoreInt64(&s.cells[i].n, 0)
+	}
+}
+
+func (s *Int) Value() int {
+	var n int64
+	for i := range s.cells {
+		n += atomic.LoadInt64(&s.cells[i].n)
+	}
+	return int(n)
+}
+
+func (s *Int) json(name string) interface{} {
+	return &Stat{Name: name, Kind: s.kind, IntVal: s.Value()}
+}
+
+func (s *Int) reset() {
+	for i := range s.cells {
+		atomic.StoreInt64(&s.cells[i].n, 0)
+	}
+}
+
+// Timer is a latency histogram.
+type Timer struct {
+	shards []histogram
+}
+
+func (s *Timer) Observe(d time.Duration) {
+	s.shards[shard()].observe(d)
+}
+
+// Since observes the time since start, as in:
+//
+//	defer t.Since(time.Now())
+func (s *Timer) Since(start time.Time) {
+	s.Observe(time.Since(start))
+}
+
+func (s *Timer) json(name string) interface{} {
+	h := new(histogram)
+	for i := range s.shards {
+		h.add(&s.shards[i])
+	}
+	return h.summary(name)
+}
+
+func (s *Timer) reset() {
+	for i := range s.shards {
+		s.shards[i].reset()
+	}
+}
+
+// register returns stat name, creating it with f if it isn't registered.
+func register(name string, f func() stat) stat {
+	lock.Lock()
+	defer lock.Unlock()
+	s, ok := registry[name]
+	if !ok {
+		s = f()
+		registry[name] = s
+	}
+	return s
+}
+
+func newInt(name string, kind byte) *Int {
+	s, ok := register(name, func() stat {
+		n := 1
+		if kind == Counter {
+			n = shards
+		}
+		return &Int{kind: kind, cells: make([]cell, n)}
+	}).(*Int)
+	if !ok || s.kind != kind {
+		panic("stat " + name + " registered with different kind")
+	}
+	return s
+}
+
+// NewCounter registers counter name. Registering a name again returns the
+// stat registered first; it panics if that is of a different kind.
+func NewCounter(name string) *Int {
+	return newInt(name, Counter)
+}
+
+func NewGauge(name string) *Int {
+	return newInt(name, Gauge)
+}
+
+func NewHistogram(name string) *Timer {
+	s, ok := register(name, func() stat {
+		return &Timer{shards: make([]histogram, shards)}
+	}).(*Timer)
+	if !ok {
+		panic("stat " + name + " registered with different kind")
+	}
+	return s
+}
+
 func listen() {
 	for s := range Stats {
-		lock.Lock()
-		if _, ok := stats[s.Name]; !ok {
-			stats[s.Name] = s
-		} else {
-			switch s.Kind {
-			case Counter:
-				stats[s.Name].IntVal += s.IntVal
-			case Gauge:
-				stats[s.Name] = s
-			}
+		switch s.Kind {
+		case Counter:
+			NewCounter(s.Name).Add(s.IntVal)
+		case Gauge:
+			NewGauge(s.Name).Set(s.IntVal)
+		case Histogram:
+			NewHistogram(s.Name).Observe(s.Duration)
 		}
-		lock.Unlock()
 	}
 }
 
-func Json() []byte {
+// Json returns stats collected since the last reset. The length of that
+// window is reported as "stats_window_ms". When reset is true, stats are
+// reset after they are read, so that consecutive calls return consecutive
+// windows.
+func Json(reset bool) []byte {
 	lock.Lock()
-	j, _ := json.Marshal(stats)
-	lock.Unlock()
+	defer lock.Unlock()
+	out := make(map[string]interface{})
+	for k, v := range registry {
+		out[k] = v.json(k)
+	}
+	w := time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&since)) / time.Millisecond
+	out["stats_window_ms"] = &Stat{Name: "stats_window_ms", Kind: Gauge, IntVal: int(w)}
+	j, _ := json.Marshal(out)
+	if reset {
+		empty()
+	}
 	return j
 }
 
+func empty() {
+	for _, s := range registry {
+		s.reset()
+	}
+	atomic.StoreInt64(&since, time.Now().UnixNano())
+}
+
 func Reset() {
 	lock.Lock()
-	stats = make(map[string]*Stat)
+	empty()
 	lock.Unlock()
 }
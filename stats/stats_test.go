@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 7, 8, 15, 16, 17, 100, 1000, 12345, 1 << 40, math.MaxInt64} {
+		i := bucket(v)
+		if i < 0 || i >= len(histogram{}.buckets) {
+			t.Fatalf("bucket %d out of range for %d", i, v)
+		}
+		if d := math.Abs(float64(value(i)-v)) / float64(v+1); d > 1.0/16 {
+			t.Fatalf("value %d of bucket %d too far from %d", value(i), i, v)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := new(histogram)
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	for _, tc := range []struct {
+		q        float64
+		expected float64
+	}{{0.5, 500}, {0.9, 900}, {0.99, 990}, {0.999, 999}, {1, 1000}} {
+		v := ms(h.quantile(tc.q))
+		if math.Abs(v-tc.expected)/tc.expected > 1.0/16 {
+			t.Fatalf("expected p%v around %v, got %v", tc.q*100, tc.expected, v)
+		}
+	}
+	if h.quantile(1) != 1000000 {
+		t.Fatalf("expected max, got %d", h.quantile(1))
+	}
+}
+
+func TestJson(t *testing.T) {
+	h := NewHistogram("test_latency")
+	c := NewCounter("test_count")
+	if NewCounter("test_count") != c {
+		t.Fatal("expected the same counter")
+	}
+	for i := 0; i < 10; i++ {
+		h.Since(time.Now().Add(-time.Duration(i) * time.Millisecond))
+		c.Add(1)
+	}
+	// sent on the shim; applied asynchronously
+	Stats <- &Stat{Name: "test_shim", Kind: Counter, IntVal: 3}
+	time.Sleep(100 * time.Millisecond)
+	s := make(map[string]map[string]interface{})
+	if err := json.Unmarshal(Json(true), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s["test_latency"]["val"] != 10.0 || s["test_latency"]["p50_ms"] == nil || s["test_count"]["val"] != 10.0 || s["test_shim"]["val"] != 3.0 || s["stats_window_ms"] == nil {
+		t.Fatalf("unexpected stats: %v", s)
+	}
+	// a new window was started
+	s = make(map[string]map[string]interface{})
+	json.Unmarshal(Json(false), &s)
+	if s["test_latency"]["val"] != 0.0 || s["test_count"]["val"] != 0.0 {
+		t.Fatalf("expected stats to be reset, got: %v", s)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	c := NewCounter("test_concurrent")
+	c.reset()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Value() != 16000 {
+		t.Fatalf("expected 16000, got %d", c.Value())
+	}
+}
+
+func TestAddSet(t *testing.T) {
+	g := NewGauge("test_gauge")
+	g.Set(5)
+	for i := 0; i < 100; i++ {
+		g.Add(1)
+	}
+	if g.Value() != 105 {
+		t.Fatalf("expected 105, got %d", g.Value())
+	}
+	c := NewCounter("test_set")
+	for i := 0; i < 100; i++ {
+		c.Add(1)
+	}
+	c.Set(5)
+	if c.Value() != 5 {
+		t.Fatalf("expected 5, got %d", c.Value())
+	}
+}
+
+// Run with -cpu 1,4,16 (or up to the number of cores): time per update of
+// sharded counters and histograms stays flat as goroutines are added; that
+// of a mutex and of the channel shim grows, as does that of a single atomic
+// counter on machines with many cores.
+
+func BenchmarkCounter(b *testing.B) {
+	c := NewCounter("bench_counter")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Add(1)
+		}
+	})
+}
+
+func BenchmarkHistogram(b *testing.B) {
+	h := NewHistogram("bench_histogram")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.Observe(time.Millisecond)
+		}
+	})
+}
+
+func BenchmarkAtomic(b *testing.B) {
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			atomic.AddInt64(&n, 1)
+		}
+	})
+}
+
+func BenchmarkMutex(b *testing.B) {
+	var n int64
+	l := new(sync.Mutex)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Lock()
+			n++
+			l.Unlock()
+		}
+	})
+}
+
+func BenchmarkShim(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Stats <- &Stat{Name: "bench_shim", Kind: Counter, IntVal: 1}
+		}
+	})
+}
@@ -1,89 +1,364 @@
 package tenant
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/auth"
+	"github.com/mkocikowski/hbuf/buffer"
 	"github.com/mkocikowski/hbuf/client"
 	"github.com/mkocikowski/hbuf/controller"
+	"github.com/mkocikowski/hbuf/crypt"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
 	"github.com/mkocikowski/hbuf/router"
 	"github.com/mkocikowski/hbuf/util"
 	"github.com/mkocikowski/hbuf/worker"
 )
 
+const (
+	RoleController = "controller"
+	RoleWorker     = "worker"
+	RoleClient     = "client"
+	RoleAll        = "all"
+)
+
+// Roles is the set of components (controller, worker, client) a node runs for
+// each tenant. Nil Roles means all of them.
+type Roles map[string]bool
+
+// ParseRoles parses a comma separated list of roles.
+func ParseRoles(s string) (Roles, error) {
+	roles := make(Roles)
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		switch r {
+		case RoleController, RoleWorker, RoleClient, RoleAll:
+			roles[r] = true
+		default:
+			return nil, fmt.Errorf("unknown role %q", r)
+		}
+	}
+	return roles, nil
+}
+
+func (r Roles) Has(role string) bool {
+	return r == nil || r[RoleAll] || r[role]
+}
+
 type Tenant struct {
-	ID      string                 `json:"-"`
-	URL     string                 `json:"-"`
-	Path    string                 `json:"-"`
-	Manager *controller.Controller `json:"manager"`
-	Worker  *worker.Worker         `json:"worker"`
-	Client  *client.Client         `json:"client"`
+	ID     string            `json:"-"`
+	URL    string            `json:"-"`
+	Path   string            `json:"-"`
+	Labels map[string]string `json:"-"` // worker labels, see controller.FailureDomains
+	Roles  Roles             `json:"-"`
+	// URLs of this tenant's controllers on all nodes of the cluster,
+	// including this one; empty when the node runs on its own
+	Controllers []string `json:"-"`
+	// credentials nodes use to talk to each other; when set, all requests
+	// must carry either these or one of the tenant's tokens
+	NodeToken string `json:"-"`
+	// default topic config of the tenant; given when the tenant is
+	// created, read from disk when an existing tenant is loaded
+	Defaults *controller.TopicConfig `json:"-"`
+	Manager  *controller.Controller  `json:"manager"`
+	Worker   *worker.Worker          `json:"worker"`
+	Client   *client.Client          `json:"client"`
+	tokens   *auth.Store
+	cURL     string // URL of the controller in use
+	done     chan bool
+	log      *logger.Logger
 }
 
+// calls to the controller's token routes, made with node credentials
+var tokenClient = curl.NewClient(10, 5*time.Second)
+
+// Init starts the tenant's components, for roles the node runs, and registers
+// their routes with r. cURL is the URL of the controller to use when the node
+// doesn't run a controller.
 func (t *Tenant) Init(r *mux.Router, cURL string) error {
-	var id string
-	var u *url.URL
 	//
-	id = util.Uid()
+	t.log = logger.New("tenant").With("tenant", t.ID)
+	t.done = make(chan bool)
+	if t.Defaults != nil {
+		if err := t.saveDefaults(); err != nil {
+			return fmt.Errorf("error saving topic defaults for tenant %q: %v", t.ID, err)
+		}
+	}
+	if t.NodeToken != "" {
+		t.tokens = auth.NewStore(t.getTokens)
+		u, _ := url.Parse(t.URL)
+		router.RegisterRoutes(r, u.Path+"/tokens", t.tokenRoutes(), auth.Node(t.NodeToken))
+	}
+	if t.Roles.Has(RoleController) {
+		if err := t.initManager(r); err != nil {
+			return err
+		}
+		cURL = t.Manager.URL
+	}
+	if cURL == "" {
+		return fmt.Errorf("tenant %q has no controller: node doesn't run one and has no nodes to join", t.ID)
+	}
+	t.cURL = cURL
+	if t.tokens != nil {
+		go t.refreshTokens(auth.RefreshInterval)
+	}
+	if t.Roles.Has(RoleWorker) {
+		if err := t.initWorker(r, cURL); err != nil {
+			return err
+		}
+	}
+	if t.Roles.Has(RoleClient) {
+		t.initClient(r, cURL)
+	}
+	t.log.Infof("tenant %q initialized", t.ID)
+	return nil
+}
+
+func (t *Tenant) initManager(r *mux.Router) error {
+	//
+	id := util.Uid()
+	defaults, err := t.loadDefaults()
+	if err != nil {
+		return fmt.Errorf("error loading topic defaults for tenant %q: %v", t.ID, err)
+	}
 	m := &controller.Controller{
-		ID:     id,
-		Tenant: t.ID,
+		ID:       id,
+		Tenant:   t.ID,
+		Defaults: defaults,
 		//URL:    t.URL + "/nodes/" + id,
-		URL:  t.URL + "/manager",
-		Path: filepath.Join(t.Path, "manager"),
+		URL:   t.URL + "/manager",
+		Path:  filepath.Join(t.Path, "manager"),
+		Peers: t.Controllers,
 	}
 	if _, err := m.Init(); err != nil {
 		return fmt.Errorf("error initializing manager for tenant %q: %v", t.ID, err)
 	}
-	u, _ = url.Parse(m.URL)
-	router.RegisterRoutes(r, u.Path, m.Routes())
+	u, _ := url.Parse(m.URL)
+	router.RegisterRoutes(r, u.Path, m.Routes(), t.authorizer())
 	t.Manager = m
-	log.Printf("registered manager %q for tenant %q", m.ID, t.ID)
-	cURL = m.URL
+	t.log.Infof("registered manager %q for tenant %q", m.ID, t.ID)
+	return nil
+}
+
+func (t *Tenant) initWorker(r *mux.Router, cURL string) error {
 	//
-	id = util.Uid()
+	keys, err := t.loadKeys()
+	if err != nil {
+		return fmt.Errorf("error loading keys for tenant %q: %v", t.ID, err)
+	}
+	id := util.Uid()
 	w := &worker.Worker{
 		ID: id,
 		//URL:        t.URL + "/nodes/" + id,
-		URL:        t.URL + "/worker",
-		Tenant:     t.ID,
-		Controller: cURL,
-		Path:       filepath.Join(t.Path, "worker"),
+		URL:         t.URL + "/worker",
+		Tenant:      t.ID,
+		Controller:  cURL,
+		Controllers: t.Controllers,
+		Path:        filepath.Join(t.Path, "worker"),
+		Labels:      copyLabels(t.Labels),
+		Keys:        keys,
 	}
 	if err := w.Init(); err != nil {
 		return fmt.Errorf("error initializing worker for tenant %q: %v", t.ID, err)
 	}
-	u, _ = url.Parse(w.URL)
-	router.RegisterRoutes(r, u.Path, w.Routes())
+	u, _ := url.Parse(w.URL)
+	router.RegisterRoutes(r, u.Path, w.Routes(), t.authorizer())
 	t.Worker = w
-	log.Printf("registered worker %q for tenant %q", w.ID, t.ID)
+	t.log.Infof("registered worker %q for tenant %q", w.ID, t.ID)
+	return nil
+}
+
+func (t *Tenant) initClient(r *mux.Router, cURL string) {
 	//
-	id = util.Uid()
+	id := util.Uid()
 	c := &client.Client{
-		ID:         id,
-		URL:        t.URL + "/nodes/" + id,
-		Tenant:     t.ID,
-		Controller: cURL,
+		ID:          id,
+		URL:         t.URL + "/nodes/" + id,
+		Tenant:      t.ID,
+		Controller:  cURL,
+		Controllers: t.Controllers,
 	}
 	c.Init()
-	u, _ = url.Parse(c.URL)
-	router.RegisterRoutes(r, u.Path, c.Routes())
+	u, _ := url.Parse(c.URL)
+	router.RegisterRoutes(r, u.Path, c.Routes(), t.authorizer())
 	if t.ID == "-" {
 		// if this is default tenant, register client also on the / route
-		router.RegisterRoutes(r, "", c.Routes())
+		router.RegisterRoutes(r, "", c.Routes(), t.authorizer())
 	}
 	t.Client = c
-	log.Printf("registered client %q for tenant %q", c.ID, t.ID)
+	t.log.Infof("registered client %q for tenant %q", c.ID, t.ID)
+}
+
+// authorizer returns the authorizer for the tenant's routes; nil when
+// authentication is disabled. Which principals may do what is up to the
+// access policy enforced by the handlers, see acl package.
+func (t *Tenant) authorizer() router.Authorizer {
+	if t.tokens == nil {
+		return nil
+	}
+	return auth.Tenant(t.NodeToken, t.tokens)
+}
+
+func (t *Tenant) tokenRoutes() []*router.Route {
+	return []*router.Route{
+		&router.Route{"", []string{"POST"}, t.forwardTokens, "mint new API token for the tenant; ?principal= sets the principal access policies refer to"},
+		&router.Route{"", []string{"GET"}, t.forwardTokens, "list the tenant's API tokens"},
+		&router.Route{"/{token_id}", []string{"DELETE"}, t.forwardTokens, "revoke API token"},
+	}
+}
+
+// forwardTokens passes requests to the token routes on to the controller,
+// where tokens are kept. Tokens minted or revoked on this node take effect
+// on it at once, and on other nodes within auth.RefreshInterval.
+func (t *Tenant) forwardTokens(req *http.Request) *router.Response {
 	//
-	log.Printf("tenant %q initialized", t.ID)
+	u := t.cURL + "/tokens"
+	if id := mux.Vars(req)["token_id"]; id != "" {
+		u += "/" + id
+	}
+	if req.URL.RawQuery != "" {
+		u += "?" + req.URL.RawQuery
+	}
+	r, _ := http.NewRequest(req.Method, u, nil)
+	resp, err := tokenClient.Do(r)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error making request to controller: %v", err), StatusCode: http.StatusServiceUnavailable}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading response from controller: %v", err)}
+	}
+	if req.Method != "GET" && resp.StatusCode < 300 {
+		if err := t.tokens.Refresh(); err != nil {
+			t.log.Errorf("%v", err)
+		}
+	}
+	return &router.Response{Body: body, StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")}
+}
+
+// getTokens gets the tenant's tokens from its controller; from the state of
+// the controller on this node when there is one.
+func (t *Tenant) getTokens() (map[string]*auth.Token, error) {
+	//
+	if t.Manager != nil {
+		return t.Manager.Tokens(), nil
+	}
+	b, err := curl.Get(t.cURL + "/tokens/_hashes")
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]*auth.Token)
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (t *Tenant) refreshTokens(interval time.Duration) {
+	//
+	for {
+		if err := t.tokens.Refresh(); err != nil {
+			t.log.Errorf("%v", err)
+		}
+		select {
+		case <-t.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// loadKeys reads the tenant's encryption keys from the "keys" file in the
+// tenant's directory; nil when there is no such file. See crypt package for
+// the format of the file, and for key rotation.
+func (t *Tenant) loadKeys() (*crypt.Keyring, error) {
+	//
+	p := filepath.Join(t.Path, "keys")
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return crypt.Load(p)
+}
+
+// loadDefaults reads the tenant's default topic config from the "defaults"
+// file in the tenant's directory. Fields not set in the file take the global
+// default values. These defaults are used for topics created without explicit
+// config, such as topics auto-created by clients.
+func (t *Tenant) loadDefaults() (*controller.TopicConfig, error) {
+	//
+	b, err := ioutil.ReadFile(filepath.Join(t.Path, "defaults"))
+	if os.IsNotExist(err) {
+		return controller.DefaultTopicConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseDefaults(b)
+}
+
+func (t *Tenant) saveDefaults() error {
+	//
+	if err := os.MkdirAll(t.Path, 0755); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(t.Defaults)
+	return util.WriteFileAtomic(filepath.Join(t.Path, "defaults"), j, 0644)
+}
+
+// ParseDefaults parses and validates default topic config of a tenant. Fields
+// not set in b take the global default values.
+func ParseDefaults(b []byte) (*controller.TopicConfig, error) {
+	//
+	config := controller.DefaultTopicConfig()
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if config.Config == nil {
+		config.Config = buffer.DefaultConfig()
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Ready returns an error if any of the tenant's components isn't ready to
+// serve requests.
+func (t *Tenant) Ready() error {
+	if t.Worker != nil {
+		return t.Worker.Ready()
+	}
 	return nil
 }
 
 func (t *Tenant) Stop() {
-	t.Worker.Stop()
-	t.Manager.Stop()
-	log.Printf("tenant %q stopped", t.ID)
+	close(t.done)
+	if t.Client != nil {
+		t.Client.Stop()
+	}
+	if t.Worker != nil {
+		t.Worker.Stop()
+	}
+	if t.Manager != nil {
+		t.Manager.Stop()
+	}
+	t.log.Infof("tenant %q stopped", t.ID)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
 }
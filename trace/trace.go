@@ -0,0 +1,172 @@
+// Package trace correlates requests across nodes. Each request handled by a
+// node gets a request ID, from the Hbuf-Request-Id header, and a trace, from
+// the W3C traceparent header; both are generated when the request doesn't
+// carry them, at the edge of the cluster. Requests made by nodes while
+// handling a request carry them on, see curl package.
+//
+// Spans of handled requests can be kept in memory by a Recorder, to be
+// dumped on the node's /debug/traces route.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RequestIDHeader   = "Hbuf-Request-Id"
+	TraceparentHeader = "Traceparent"
+)
+
+var (
+	requestIDRE   = regexp.MustCompile(`^[a-zA-Z0-9_\-.]{1,128}$`)
+	traceparentRE = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+)
+
+// Trace of a request: its ID, and its span in a W3C trace.
+type Trace struct {
+	RequestID string
+	TraceID   string
+	SpanID    string // of the request on this node
+	ParentID  string // span of the caller; "" at the edge
+	Flags     string
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// FromRequest returns the trace of req, starting a new span of the trace in
+// req's traceparent header. Request ID and trace are generated when req
+// doesn't have valid ones.
+func FromRequest(req *http.Request) *Trace {
+	//
+	t := &Trace{
+		RequestID: req.Header.Get(RequestIDHeader),
+		SpanID:    randomHex(8),
+		Flags:     "01",
+	}
+	if !requestIDRE.MatchString(t.RequestID) {
+		t.RequestID = randomHex(8)
+	}
+	// all zero trace IDs are invalid
+	if m := traceparentRE.FindStringSubmatch(req.Header.Get(TraceparentHeader)); m != nil && strings.Trim(m[1], "0") != "" {
+		t.TraceID, t.ParentID, t.Flags = m[1], m[2], m[3]
+	} else {
+		t.TraceID = randomHex(16)
+	}
+	return t
+}
+
+// Traceparent returns the traceparent header value for requests made on
+// behalf of t: the span of t is their parent.
+func (t *Trace) Traceparent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// SetHeaders sets request ID and traceparent headers of h, for requests made
+// on behalf of t.
+func (t *Trace) SetHeaders(h http.Header) {
+	h.Set(RequestIDHeader, t.RequestID)
+	h.Set(TraceparentHeader, t.Traceparent())
+}
+
+// Fields returns log fields identifying t; nil for a nil t.
+func (t *Trace) Fields() []string {
+	if t == nil {
+		return nil
+	}
+	return []string{"request_id", t.RequestID, "trace_id", t.TraceID}
+}
+
+type key struct{}
+
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, key{}, t)
+}
+
+// FromContext returns the trace in ctx; nil if there is none.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(key{}).(*Trace)
+	return t
+}
+
+// Span is a request handled by the node.
+type Span struct {
+	TraceID   string        `json:"trace_id"`
+	SpanID    string        `json:"span_id"`
+	ParentID  string        `json:"parent_id,omitempty"`
+	RequestID string        `json:"request_id"`
+	Name      string        `json:"name"` // route
+	Method    string        `json:"method"`
+	Status    int           `json:"status"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// Recorder keeps the last spans recorded, up to a limit.
+type Recorder struct {
+	spans []*Span
+	next  int
+	lock  *sync.Mutex
+}
+
+func NewRecorder(max int) *Recorder {
+	if max < 1 {
+		max = 1
+	}
+	return &Recorder{spans: make([]*Span, 0, max), lock: new(sync.Mutex)}
+}
+
+func (r *Recorder) Record(s *Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.spans) < cap(r.spans) {
+		r.spans = append(r.spans, s)
+		return
+	}
+	r.spans[r.next] = s
+	r.next = (r.next + 1) % len(r.spans)
+}
+
+// Spans returns recorded spans, oldest first; only spans of trace traceID,
+// unless it is "".
+func (r *Recorder) Spans(traceID string) []*Span {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	spans := make([]*Span, 0, len(r.spans))
+	for i := range r.spans {
+		s := r.spans[(r.next+i)%len(r.spans)]
+		if traceID == "" || s.TraceID == traceID {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+var (
+	recorder *Recorder
+	lock     = new(sync.Mutex)
+)
+
+// SetRecorder sets the process wide recorder of spans; nil to not record
+// spans, which is the default.
+func SetRecorder(r *Recorder) {
+	lock.Lock()
+	recorder = r
+	lock.Unlock()
+}
+
+func GetRecorder() *Recorder {
+	lock.Lock()
+	defer lock.Unlock()
+	return recorder
+}
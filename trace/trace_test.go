@@ -0,0 +1,48 @@
+package trace
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "foo")
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	tr := FromRequest(req)
+	if tr.RequestID != "foo" || tr.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tr.ParentID != "00f067aa0ba902b7" || len(tr.SpanID) != 16 {
+		t.Fatalf("unexpected trace: %+v", tr)
+	}
+	h := make(http.Header)
+	tr.SetHeaders(h)
+	if h.Get(RequestIDHeader) != "foo" || h.Get(TraceparentHeader) != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+tr.SpanID+"-01" {
+		t.Fatalf("unexpected headers: %v", h)
+	}
+	// invalid values are replaced
+	for _, tp := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		req.Header.Set(RequestIDHeader, "foo bar")
+		req.Header.Set(TraceparentHeader, tp)
+		tr = FromRequest(req)
+		if tr.RequestID == "foo bar" || len(tr.RequestID) != 16 || len(tr.TraceID) != 32 || tr.ParentID != "" {
+			t.Fatalf("unexpected trace for %q: %+v", tp, tr)
+		}
+	}
+	if (*Trace)(nil).Fields() != nil {
+		t.Fatal("expected no fields")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(3)
+	for i := 0; i < 5; i++ {
+		r.Record(&Span{TraceID: strconv.Itoa(i % 2), Status: i})
+	}
+	spans := r.Spans("")
+	if len(spans) != 3 || spans[0].Status != 2 || spans[2].Status != 4 {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	if spans = r.Spans("1"); len(spans) != 1 || spans[0].Status != 3 {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+}
@@ -2,7 +2,10 @@ package util
 
 import (
 	"encoding/hex"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"regexp"
 	"time"
 )
@@ -10,6 +13,10 @@ import (
 var (
 	TopicNameRE    = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,256}$`)
 	ConsumerNameRE = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,256}$`)
+	// tenant ids are names of directories, and parts of URLs
+	TenantIDRE = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,128}$`)
+	// principals are named in access policies, and in their URLs
+	PrincipalRE = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,256}$`)
 	//Client      = &http.Client{
 	//Transport: &http.Transport{
 	//MaxIdleConnsPerHost: 256,
@@ -28,3 +35,40 @@ func Uid() string {
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
+
+// WriteFileAtomic writes data to a temporary file in the directory of path,
+// syncs it, and renames it to path, so that path holds either the old or the
+// new data, even if the process crashes half way through.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import "syscall"
+
+// freeBytes returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func freeBytes(path string) (uint64, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(path, &s); err != nil {
+		return 0, err
+	}
+	return s.Bavail * uint64(s.Bsize), nil
+}
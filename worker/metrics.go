@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"github.com/mkocikowski/hbuf/buffer"
+	"github.com/mkocikowski/hbuf/metrics"
+)
+
+var (
+	produceMessages = metrics.NewCounter("hbuf_produce_messages_total", "Messages written by producers.", "tenant", "topic", "buffer", "worker")
+	produceBytes    = metrics.NewCounter("hbuf_produce_bytes_total", "Bytes of message bodies written by producers, as received.", "tenant", "topic", "buffer", "worker")
+	consumeMessages = metrics.NewCounter("hbuf_consume_messages_total", "Messages consumed.", "tenant", "topic", "buffer", "worker")
+	consumeBytes    = metrics.NewCounter("hbuf_consume_bytes_total", "Bytes of message bodies consumed, as stored.", "tenant", "topic", "buffer", "worker")
+	bufferMessages  = metrics.NewCollectedGauge("hbuf_buffer_messages", "Messages in the buffer.", "tenant", "topic", "buffer", "worker")
+	bufferSegments  = metrics.NewCollectedGauge("hbuf_buffer_segments", "Segments of the buffer.", "tenant", "topic", "buffer", "worker")
+	bufferBytes     = metrics.NewCollectedGauge("hbuf_buffer_bytes", "Size of the buffer's segments on disk.", "tenant", "topic", "buffer", "worker")
+	replicaLag      = metrics.NewCollectedGauge("hbuf_replica_lag_messages", "Messages not yet pushed to the replica.", "tenant", "topic", "buffer", "worker", "replica")
+	consumerLag     = metrics.NewCollectedGauge("hbuf_consumer_lag_messages", "Messages not yet consumed by the consumer.", "tenant", "topic", "buffer", "worker", "consumer")
+)
+
+// topic returns the topic of buffer b, as set by the controller when the
+// buffer was created; for buffers created before topics were set, it is the
+// topic last fetched from the controller with the access policy, if any.
+func (w *Worker) topic(b *buffer.Buffer) string {
+	if b.Topic != "" {
+		return b.Topic
+	}
+	w.aclLock.Lock()
+	defer w.aclLock.Unlock()
+	return w.topics[b.ID]
+}
+
+// count adds a message of n bytes to counters messages and bytes of buffer b.
+func (w *Worker) count(messages, bytes *metrics.Family, b *buffer.Buffer, n int) {
+	t := w.topic(b)
+	messages.Add(1, w.Tenant, t, b.ID, w.ID)
+	bytes.Add(float64(n), w.Tenant, t, b.ID, w.ID)
+}
+
+// deleteSeries removes the counters of deleted buffer id; gauges go away on
+// the next scrape.
+func (w *Worker) deleteSeries(id string) {
+	for _, f := range []*metrics.Family{produceMessages, produceBytes, consumeMessages, consumeBytes} {
+		f.Delete("buffer", id)
+	}
+}
+
+// collect sets gauges of the worker's buffers; it is called on every scrape.
+func (w *Worker) collect() {
+	//
+	w.lock.Lock()
+	ids := make([]string, 0, len(w.buffers))
+	for id := range w.buffers {
+		ids = append(ids, id)
+	}
+	w.lock.Unlock()
+	for _, id := range ids {
+		w.lock.Lock()
+		b, ok := w.buffers[id]
+		w.lock.Unlock()
+		if !ok {
+			continue
+		}
+		t := w.topic(b)
+		first, next := b.First(), b.Next()
+		bufferMessages.Set(float64(next-first), w.Tenant, t, id, w.ID)
+		bufferSegments.Set(float64(b.NumSegments()), w.Tenant, t, id, w.ID)
+		bufferBytes.Set(float64(b.SizeB()), w.Tenant, t, id, w.ID)
+		for r, n := range b.Replicas() {
+			replicaLag.Set(float64(next-n), w.Tenant, t, id, w.ID, r)
+		}
+		for c, n := range b.Offsets() {
+			// messages older than first were trimmed, and can't be consumed
+			if n < first {
+				n = first
+			}
+			consumerLag.Set(float64(next-n), w.Tenant, t, id, w.ID, c)
+		}
+	}
+}
@@ -1,77 +1,282 @@
 package worker
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mkocikowski/hbuf/acl"
 	"github.com/mkocikowski/hbuf/buffer"
+	"github.com/mkocikowski/hbuf/codec"
+	"github.com/mkocikowski/hbuf/crypt"
+	"github.com/mkocikowski/hbuf/curl"
+	"github.com/mkocikowski/hbuf/logger"
 	"github.com/mkocikowski/hbuf/message"
+	"github.com/mkocikowski/hbuf/metrics"
+	"github.com/mkocikowski/hbuf/quota"
 	"github.com/mkocikowski/hbuf/router"
 	"github.com/mkocikowski/hbuf/segment"
+	"github.com/mkocikowski/hbuf/trace"
 	"github.com/mkocikowski/hbuf/util"
 )
 
 var (
-	client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 1000,
-		},
-		Timeout: 5 * time.Second,
-	}
+	client = curl.NewClient(1000, 5*time.Second)
+	// how often the worker re-registers with the controller, to refresh
+	// its free disk space
+	RegisterInterval = 30 * time.Second
+	// how often registration is retried when it failed on startup
+	RegisterRetryInterval = 1 * time.Second
+	// producer writes admitted at a time, per buffer and per worker, waiting
+	// for or holding buffer locks; writes over the limits are refused with
+	// 429 right away, and producers are asked to retry after
+	// AdmissionRetryAfter
+	MaxPendingWritesPerBuffer = 64
+	MaxPendingWritesPerWorker = 1024
+	AdmissionRetryAfter       = 1 * time.Second
 )
 
 type Worker struct {
-	ID         string `json:"id"`
-	URL        string `json:"url"`
-	Tenant     string `json:"-"`
-	Controller string `json:"-"`
-	Path       string `json:"-"`
+	ID         string            `json:"id"`
+	URL        string            `json:"url"`
+	Labels     map[string]string `json:"labels"` // failure domains (host, rack, zone) used for placement
+	FreeBytes  uint64            `json:"free_bytes"`
+	UsedBytes  int64             `json:"used_bytes"`         // size of the worker's buffers
+	Draining   bool              `json:"draining,omitempty"` // gets no new buffers; clients write to other workers
+	Tenant     string            `json:"-"`
+	Controller string            `json:"-"` // the controller in use
+	// all controllers of the tenant, when the controller is replicated; on
+	// error the worker fails over to the next one
+	Controllers []string `json:"-"`
+	Path        string   `json:"-"`
+	// keys of the tenant, for encrypted buffers; replicas are written with
+	// the keys of the worker they are on
+	Keys       *crypt.Keyring `json:"-"`
 	routes     []*router.Route
 	buffers    map[string]*buffer.Buffer
+	used       int64 // size of buffers; updated by them, read without the lock
+	registered bool
 	running    bool
+	done       chan bool
 	lock       *sync.Mutex
+	// held while registering without the lock, so that registrations reach
+	// the controller in order
+	regLock *sync.Mutex
+	// access policy of the tenant, and topics of buffers it is checked
+	// against; fetched from the controller on every registration refresh
+	policy  *acl.Policy
+	topics  map[string]string
+	aclLock *sync.Mutex
+	// quotas of the tenant, and its usage; fetched with the access policy
+	quotas  *quota.Status
+	produce *quota.Limiter
+	// admitted writes, per buffer and for the worker
+	pending  map[string]chan bool
+	admitted chan bool
+	log      *logger.Logger
 }
 
 func (w *Worker) Init() error {
 	//
+	w.log = logger.New("worker").With("tenant", w.Tenant, "worker", w.ID)
 	w.buffers = make(map[string]*buffer.Buffer)
+	w.done = make(chan bool)
 	w.lock = new(sync.Mutex)
+	w.regLock = new(sync.Mutex)
+	w.topics = make(map[string]string)
+	w.aclLock = new(sync.Mutex)
+	w.produce = quota.NewLimiter()
+	w.pending = make(map[string]chan bool)
+	w.admitted = make(chan bool, MaxPendingWritesPerWorker)
+	if w.Labels == nil {
+		w.Labels = make(map[string]string)
+	}
+	if w.Labels["host"] == "" {
+		w.Labels["host"], _ = os.Hostname()
+	}
 	w.lock.Lock()
-	defer w.lock.Unlock()
 	w.routes = []*router.Route{
-		{"", []string{"GET"}, w.handleGetInfo, ""},
-		{"/buffers", []string{"POST"}, w.handleCreateBuffer, ""},
-		{"/buffers", []string{"GET"}, w.handleGetBuffers, ""},
-		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"GET"}, w.handleGetBuffer, ""},
-		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"POST"}, w.handleWriteToBuffer, ""},
-		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"DELETE"}, w.handleDeleteBuffer, ""},
-		{"/buffers/{buffer:[a-f0-9]{16}}/replicas", []string{"POST"}, w.handleSetReplicas, ""},
-		{"/buffers/{buffer:[a-f0-9]{16}}/consumers", []string{"GET"}, w.handleGetOffsets, ""},
+		{"", []string{"GET"}, w.allow(acl.Admin, w.handleGetInfo), ""},
+		{"/buffers", []string{"POST"}, w.allow(acl.Admin, w.handleCreateBuffer), ""},
+		{"/buffers", []string{"GET"}, w.allow(acl.Admin, w.handleGetBuffers), ""},
+		{"/buffers/_restore", []string{"POST"}, w.allow(acl.Admin, w.handleRestoreBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"GET"}, w.allow(acl.Admin, w.handleGetBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"POST"}, w.allow(acl.Produce, w.handleWriteToBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}", []string{"DELETE"}, w.allow(acl.Admin, w.handleDeleteBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/replicas", []string{"POST"}, w.allow(acl.Admin, w.handleSetReplicas), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/replicas", []string{"GET"}, w.allow(acl.Admin, w.handleGetReplicas), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/_seal", []string{"POST"}, w.allow(acl.Admin, w.handleSealBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/_unseal", []string{"POST"}, w.allow(acl.Admin, w.handleUnsealBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/_snapshot", []string{"GET"}, w.allow(acl.Admin, w.handleSnapshotBuffer), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/consumers", []string{"GET"}, w.allow(acl.Admin, w.handleGetOffsets), ""},
+		{"/buffers/{buffer:[a-f0-9]{16}}/consumers", []string{"POST"}, w.allow(acl.Admin, w.handleSetOffsets), ""},
 		{
 			`/buffers/{buffer:[a-f0-9]{16}}/consumers/{consumer:[a-zA-Z0-9_\-]{1,256}}/_next`,
-			[]string{"POST"}, w.handleConsumeFromBuffer, "",
+			[]string{"POST"}, w.allow(acl.Consume, w.handleConsumeFromBuffer), "",
 		},
 	}
-	if err := w.loadBuffers(); err != nil {
+	err := w.loadBuffers()
+	w.lock.Unlock()
+	if err != nil {
 		return fmt.Errorf("error loading buffers: %v", err)
 	}
-	if err := w.registerWithController(); err != nil {
-		return fmt.Errorf("error registering worker with controller: %v", err)
+	u, err := w.registerWithController()
+	if err != nil {
+		if len(w.Controllers) < 2 {
+			return fmt.Errorf("error registering worker with controller: %v", err)
+		}
+		// replicated controllers may not have elected a leader yet
+		w.log.Warnf("error registering worker with controllers, will retry: %v", err)
+	}
+	if err := w.updatePolicy(u); err != nil {
+		w.log.Errorf("error getting access policy: %v", err)
 	}
+	metrics.AddCollector(w.Path, w.collect)
+	go w.refresh()
 	return nil
 }
 
+// refresh periodically re-registers the worker with the controller, so that
+// the controller has current free disk space for placement. Registration
+// which failed on startup is retried more often.
+func (w *Worker) refresh() {
+	//
+	for {
+		w.lock.Lock()
+		interval := RegisterInterval
+		if !w.registered {
+			interval = RegisterRetryInterval
+		}
+		w.lock.Unlock()
+		select {
+		case <-w.done:
+			return
+		case <-time.After(interval):
+		}
+		// the lock is not held while calling the controller, which may be
+		// calling the worker while holding its own lock
+		w.regLock.Lock()
+		w.lock.Lock()
+		registered, u := w.registered, w.Controller
+		var j []byte
+		var err error
+		if registered {
+			j, err = w.marshal()
+		}
+		w.lock.Unlock()
+		if !registered {
+			u, err = w.registerWithController()
+		} else if err == nil {
+			err = postWorker(u, j)
+		}
+		w.regLock.Unlock()
+		if err != nil {
+			w.log.Errorf("error refreshing worker registration: %v", err)
+		}
+		if err := w.updatePolicy(u); err != nil {
+			w.log.Errorf("error refreshing access policy: %v", err)
+		}
+	}
+}
+
+// allow wraps handler h with a check of the access policy: writing and
+// consuming need produce and consume permissions on the buffer's topic,
+// everything else is admin. Without a policy only nodes are allowed.
+func (w *Worker) allow(action string, h router.HandlerFunc) router.HandlerFunc {
+	return acl.Enforce(w.getPolicy, false, action, w.resource, h)
+}
+
+func (w *Worker) getPolicy() *acl.Policy {
+	w.aclLock.Lock()
+	defer w.aclLock.Unlock()
+	return w.policy
+}
+
+// resource returns the topic of the request's buffer (see topic); buffers of
+// unknown topics are checked against topic "".
+func (w *Worker) resource(req *http.Request) ([]string, string) {
+	_, consumer := acl.Topics(req)
+	id := mux.Vars(req)["buffer"]
+	w.lock.Lock()
+	b, ok := w.buffers[id]
+	w.lock.Unlock()
+	if ok {
+		return []string{w.topic(b)}, consumer
+	}
+	w.aclLock.Lock()
+	defer w.aclLock.Unlock()
+	return []string{w.topics[id]}, consumer
+}
+
+// updatePolicy gets the access policy, the topics of buffers, and quotas
+// from controller u.
+func (w *Worker) updatePolicy(u string) error {
+	//
+	policy := new(acl.Policy)
+	topics := make(map[string]struct {
+		Buffers []string `json:"buffers"`
+	})
+	quotas := new(quota.Status)
+	for _, x := range []struct {
+		path string
+		v    interface{}
+	}{{"/acl", &policy}, {"/topics", &topics}, {"/quotas", quotas}} {
+		b, err := curl.Get(u + x.path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, x.v); err != nil {
+			return err
+		}
+	}
+	if quotas.Quotas != nil {
+		w.produce.SetRate(quotas.Quotas.ProduceBytesPerSec)
+	} else {
+		w.produce.SetRate(0)
+	}
+	w.aclLock.Lock()
+	defer w.aclLock.Unlock()
+	w.policy = policy
+	w.quotas = quotas
+	w.topics = make(map[string]string)
+	for id, t := range topics {
+		for _, b := range t.Buffers {
+			w.topics[b] = id
+		}
+	}
+	return nil
+}
+
+func (w *Worker) controllers() []string {
+	if len(w.Controllers) > 0 {
+		return w.Controllers
+	}
+	return []string{w.Controller}
+}
+
+// failover switches to the controller following the one in use.
+func (w *Worker) failover() {
+	c := w.controllers()
+	for i, u := range c {
+		if u == w.Controller {
+			w.Controller = c[(i+1)%len(c)]
+			return
+		}
+	}
+	w.Controller = c[0]
+}
+
 func (w *Worker) Routes() []*router.Route {
 	return w.routes
 }
@@ -80,33 +285,52 @@ func (w *Worker) loadBuffers() error {
 	//
 	files, err := ioutil.ReadDir(filepath.Join(w.Path, "buffers"))
 	if err != nil && !os.IsNotExist(err) {
-		log.Printf("can't access worker's data directory: %v", err)
+		w.log.Errorf("can't access worker's data directory: %v", err)
 		return nil
 	}
 	for _, f := range files {
 		uid := f.Name()
 		b := &buffer.Buffer{
-			ID:         uid,
-			URL:        w.URL + "/buffers/" + uid,
-			Controller: w.Controller,
-			Tenant:     w.Tenant,
-			Path:       filepath.Join(w.Path, "buffers", uid),
+			ID:          uid,
+			URL:         w.URL + "/buffers/" + uid,
+			Controller:  w.Controller,
+			Controllers: w.Controllers,
+			Tenant:      w.Tenant,
+			Keys:        w.Keys,
+			Path:        filepath.Join(w.Path, "buffers", uid),
+			Used:        &w.used,
 		}
 		if err := b.Init(); err != nil {
-			log.Printf("error initializing buffer from disk: %v", err)
+			w.log.Errorf("error initializing buffer from disk: %v", err)
 			continue
 		}
 		w.buffers[b.ID] = b
 		//j, _ := json.Marshal(b)
-		log.Printf("loaded buffer: %v", b.Path)
+		w.log.Infof("loaded buffer: %v", b.Path)
 	}
 	return nil
 }
 
-func (w *Worker) registerWithController() error {
+// marshal updates the worker's disk usage and returns its registration. Must
+// be called with the lock held.
+func (w *Worker) marshal() ([]byte, error) {
 	//
+	if err := os.MkdirAll(w.Path, 0755); err != nil {
+		return nil, err
+	}
+	n, err := freeBytes(w.Path)
+	if err != nil {
+		w.log.Errorf("error getting free disk space for worker %q: %v", w.ID, err)
+	}
+	w.FreeBytes = n
+	w.UsedBytes = atomic.LoadInt64(&w.used)
 	j, _ := json.Marshal(w)
-	resp, err := client.Post(w.Controller+"/workers", "application/json", bytes.NewBuffer(j))
+	return j, nil
+}
+
+func postWorker(u string, j []byte) error {
+	//
+	resp, err := client.Post(u+"/workers", "application/json", bytes.NewBuffer(j))
 	if err != nil {
 		return err
 	}
@@ -118,11 +342,52 @@ func (w *Worker) registerWithController() error {
 	if resp.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("error registering worker: (%d) %v", resp.StatusCode, string(body))
 	}
+	return nil
+}
+
+// registerWithController registers the worker and its buffers, trying each
+// of the controllers in turn, and returns the controller in use. Must be
+// called without the lock held, as the controller may be calling the worker
+// while holding its own lock.
+func (w *Worker) registerWithController() (string, error) {
 	//
-	for _, b := range w.buffers {
-		c := map[string]string{"id": b.ID, "url": b.URL}
-		j, _ := json.Marshal(c)
-		resp, err := client.Post(w.Controller+"/buffers", "application/json", bytes.NewBuffer(j))
+	var err error
+	var u string
+	for range w.controllers() {
+		w.lock.Lock()
+		u = w.Controller
+		var j []byte
+		j, err = w.marshal()
+		buffers := make(map[string][]byte)
+		for _, b := range w.buffers {
+			buffers[b.ID], _ = json.Marshal(map[string]string{"id": b.ID, "url": b.URL})
+		}
+		w.lock.Unlock()
+		if err == nil {
+			err = w.registerAll(u, j, buffers)
+		}
+		w.lock.Lock()
+		if err == nil {
+			w.registered = true
+			w.lock.Unlock()
+			return u, nil
+		}
+		w.failover()
+		u = w.Controller
+		w.lock.Unlock()
+	}
+	return u, err
+}
+
+// registerAll posts registration j of the worker, and registrations of its
+// buffers, to controller u.
+func (w *Worker) registerAll(u string, j []byte, buffers map[string][]byte) error {
+	//
+	if err := postWorker(u, j); err != nil {
+		return err
+	}
+	for id, j := range buffers {
+		resp, err := client.Post(u+"/buffers", "application/json", bytes.NewBuffer(j))
 		if err != nil {
 			return err
 		}
@@ -134,38 +399,112 @@ func (w *Worker) registerWithController() error {
 		if resp.StatusCode != http.StatusNoContent {
 			return fmt.Errorf("error registering buffer: (%d) %v", resp.StatusCode, string(body))
 		}
-		log.Printf("registered buffer %q with controller", b.ID)
+		w.log.Infof("registered buffer %q with controller", id)
+	}
+	return nil
+}
+
+// Ready returns an error if the worker isn't ready to serve requests: it
+// hasn't registered itself and its buffers with a controller yet. Buffers
+// are opened by Init.
+func (w *Worker) Ready() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.registered {
+		return fmt.Errorf("worker %q not registered with controller", w.ID)
+	}
+	return nil
+}
+
+// Drain marks the worker as draining, or not, and re-registers it with the
+// controller, so that the controller and clients learn of it.
+func (w *Worker) Drain(draining bool) error {
+	//
+	w.regLock.Lock()
+	defer w.regLock.Unlock()
+	w.lock.Lock()
+	w.Draining = draining
+	j, err := w.marshal()
+	u := w.Controller
+	w.lock.Unlock()
+	if err == nil {
+		err = postWorker(u, j)
+	}
+	if err != nil {
+		return fmt.Errorf("error registering draining worker: %v", err)
 	}
+	w.log.Infof("worker %q draining: %v", w.ID, draining)
 	return nil
 }
 
+// Stop stops the worker's buffers. Buffers are stopped concurrently, as each
+// waits for its replicas to catch up.
 func (w *Worker) Stop() {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	w.running = false
+	close(w.done)
+	metrics.RemoveCollector(w.Path)
+	wg := sync.WaitGroup{}
 	for _, b := range w.buffers {
-		b.Stop()
-	}
-	log.Printf("worker %q stopped", w.ID)
+		wg.Add(1)
+		go func(b *buffer.Buffer) {
+			defer wg.Done()
+			b.Stop()
+		}(b)
+	}
+	wg.Wait()
+	w.log.Infof("worker %q stopped", w.ID)
 }
 
 func (w *Worker) handleGetInfo(req *http.Request) *router.Response {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	j, _ := json.Marshal(w)
-	log.Println(req.Proto)
+	w.log.Debugf("info requested over %s", req.Proto)
 	return &router.Response{Body: j}
 }
 
+// handleCreateBuffer creates a new buffer. Optional request body is a JSON
+// buffer config; fields not set in it take default values.
 func (w *Worker) handleCreateBuffer(req *http.Request) *router.Response {
 	//
+	config := buffer.DefaultConfig()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading create buffer request body: %v", err)}
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, config); err != nil {
+			return &router.Response{
+				Error:      fmt.Errorf("error parsing buffer config: %v", err),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return &router.Response{
+			Error:      fmt.Errorf("invalid buffer config: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	if config.Encryption != "" && w.Keys == nil {
+		return &router.Response{
+			Error:      fmt.Errorf("buffer config requires encryption, and tenant %q has no key file", w.Tenant),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
 	uid := util.Uid()
 	b := &buffer.Buffer{
-		ID:         uid,
-		URL:        w.URL + "/buffers/" + uid,
-		Controller: w.Controller,
-		Tenant:     w.Tenant,
-		Path:       filepath.Join(w.Path, "buffers", uid),
+		Config:      config,
+		ID:          uid,
+		URL:         w.URL + "/buffers/" + uid,
+		Controller:  w.Controller,
+		Controllers: w.Controllers,
+		Tenant:      w.Tenant,
+		Keys:        w.Keys,
+		Path:        filepath.Join(w.Path, "buffers", uid),
+		Used:        &w.used,
 	}
 	if err := b.Init(); err != nil {
 		return &router.Response{Error: fmt.Errorf("error creating buffer: %v", err)}
@@ -174,7 +513,58 @@ func (w *Worker) handleCreateBuffer(req *http.Request) *router.Response {
 	w.buffers[b.ID] = b
 	w.lock.Unlock()
 	j, _ := json.Marshal(b)
-	log.Printf("created buffer %q", b.ID)
+	w.log.Infof("created buffer %q", b.ID)
+	return &router.Response{Body: j, StatusCode: http.StatusCreated}
+}
+
+// handleRestoreBuffer creates a new buffer from a tar archive of a buffer
+// directory sent in the request body. The SHA chain of the restored buffer is
+// verified before the buffer is opened for business. Consumer offsets are
+// restored when ?offsets=true.
+func (w *Worker) handleRestoreBuffer(req *http.Request) *router.Response {
+	//
+	uid := util.Uid()
+	b := &buffer.Buffer{
+		ID:          uid,
+		URL:         w.URL + "/buffers/" + uid,
+		Controller:  w.Controller,
+		Controllers: w.Controllers,
+		Tenant:      w.Tenant,
+		Keys:        w.Keys,
+		Path:        filepath.Join(w.Path, "buffers", uid),
+		Used:        &w.used,
+	}
+	offsets := req.URL.Query().Get("offsets") == "true"
+	manifest, err := buffer.Restore(b.Path, req.Body, offsets)
+	if err != nil {
+		os.RemoveAll(b.Path)
+		return &router.Response{
+			Error:      fmt.Errorf("error restoring buffer: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	if err := b.Init(); err != nil {
+		os.RemoveAll(b.Path)
+		return &router.Response{Error: fmt.Errorf("error opening restored buffer: %v", err)}
+	}
+	if err := b.Verify(manifest); err != nil {
+		b.Delete()
+		return &router.Response{
+			Error:      fmt.Errorf("error verifying restored buffer: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	if t := req.URL.Query().Get("topic"); t != "" && t != b.Topic {
+		if err := b.SetTopic(t); err != nil {
+			b.Delete()
+			return &router.Response{Error: fmt.Errorf("error setting topic of restored buffer: %v", err)}
+		}
+	}
+	w.lock.Lock()
+	w.buffers[b.ID] = b
+	w.lock.Unlock()
+	j, _ := json.Marshal(b)
+	w.log.Infof("restored buffer %q (%d messages)", b.ID, b.Len)
 	return &router.Response{Body: j, StatusCode: http.StatusCreated}
 }
 
@@ -190,6 +580,8 @@ func (w *Worker) handleDeleteBuffer(req *http.Request) *router.Response {
 		return &router.Response{Error: fmt.Errorf("error deleting buffer: %v", err)}
 	}
 	delete(w.buffers, id)
+	delete(w.pending, id)
+	w.deleteSeries(id)
 	return &router.Response{StatusCode: http.StatusOK}
 }
 
@@ -203,7 +595,7 @@ func (w *Worker) handleSetReplicas(req *http.Request) *router.Response {
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Printf("error reading set replica body: %v", err)
+		w.log.Errorf("error reading set replica body: %v", err)
 		return &router.Response{Error: fmt.Errorf("error reading set replica body: %v", err)}
 	}
 	var replicas []string
@@ -211,11 +603,75 @@ func (w *Worker) handleSetReplicas(req *http.Request) *router.Response {
 		return &router.Response{Error: fmt.Errorf("error parsing set replica body: %v", err)}
 	}
 	b.SetReplicas(replicas)
-	log.Printf("set replicas %q for buffer %q", replicas, b.ID)
+	w.log.Infof("set replicas %q for buffer %q", replicas, b.ID)
 	// TODO: should this call the replicas to see what's up?
 	return &router.Response{StatusCode: http.StatusOK}
 }
 
+func (w *Worker) handleGetReplicas(req *http.Request) *router.Response {
+	//
+	w.lock.Lock()
+	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	w.lock.Unlock()
+	if !ok {
+		return &router.Response{StatusCode: http.StatusNotFound}
+	}
+	j, _ := json.Marshal(b.Replicas())
+	return &router.Response{Body: j}
+}
+
+func (w *Worker) handleSealBuffer(req *http.Request) *router.Response {
+	//
+	w.lock.Lock()
+	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	w.lock.Unlock()
+	if !ok {
+		return &router.Response{StatusCode: http.StatusNotFound}
+	}
+	if err := b.Seal(); err != nil {
+		return &router.Response{Error: err}
+	}
+	w.log.Infof("sealed buffer %q", b.ID)
+	return &router.Response{StatusCode: http.StatusOK}
+}
+
+func (w *Worker) handleUnsealBuffer(req *http.Request) *router.Response {
+	//
+	w.lock.Lock()
+	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	w.lock.Unlock()
+	if !ok {
+		return &router.Response{StatusCode: http.StatusNotFound}
+	}
+	if err := b.Unseal(); err != nil {
+		return &router.Response{Error: err}
+	}
+	w.log.Infof("unsealed buffer %q", b.ID)
+	return &router.Response{StatusCode: http.StatusOK}
+}
+
+func (w *Worker) handleSnapshotBuffer(req *http.Request) *router.Response {
+	//
+	w.lock.Lock()
+	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	w.lock.Unlock()
+	if !ok {
+		return &router.Response{StatusCode: http.StatusNotFound}
+	}
+	snap, err := b.Snapshot()
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error taking snapshot: %v", err)}
+	}
+	stream := func(out io.Writer) error {
+		tw := tar.NewWriter(out)
+		if err := snap.WriteTar(tw, b.ID); err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+	return &router.Response{Stream: stream, ContentType: "application/x-tar"}
+}
+
 func (w *Worker) handleGetBuffers(req *http.Request) *router.Response {
 	//
 	w.lock.Lock()
@@ -241,21 +697,64 @@ func (w *Worker) handleGetBuffer(req *http.Request) *router.Response {
 	return &router.Response{Body: j}
 }
 
+// admit admits a write to buffer id, returning false when there are too
+// many writes pending; admitted writes must call release when done.
+func (w *Worker) admit(id string) (release func(), ok bool) {
+	//
+	w.lock.Lock()
+	q, ok := w.pending[id]
+	if !ok {
+		q = make(chan bool, MaxPendingWritesPerBuffer)
+		w.pending[id] = q
+	}
+	w.lock.Unlock()
+	select {
+	case w.admitted <- true:
+	default:
+		return nil, false
+	}
+	select {
+	case q <- true:
+	default:
+		<-w.admitted
+		return nil, false
+	}
+	return func() { <-q; <-w.admitted }, true
+}
+
 func (w *Worker) handleWriteToBuffer(req *http.Request) *router.Response {
 	//
+	bid := mux.Vars(req)["buffer"]
 	w.lock.Lock()
-	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	b, ok := w.buffers[bid]
 	w.lock.Unlock()
 	if !ok {
 		return &router.Response{StatusCode: http.StatusNotFound}
 	}
+	// writes from replication carry the id of the message on the primary,
+	// and are made with node credentials; producers can't set message ids,
+	// or get around the checks below, by sending the header
+	replica := req.Header.Get("Hbuf-Id") != "" && acl.Principal(req) == acl.Node
+	// replicas send one write at a time per buffer, and must get through to
+	// stay in sync; writes from producers can pile up
+	if !replica {
+		release, ok := w.admit(bid)
+		if !ok {
+			return &router.Response{
+				Error:      fmt.Errorf("too many pending writes to buffer %q", bid),
+				StatusCode: http.StatusTooManyRequests,
+				Header:     router.RetryAfter(AdmissionRetryAfter),
+			}
+		}
+		defer release()
+	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return &router.Response{Error: fmt.Errorf("error reading message body: %v", err)}
 	}
 	id := 0
-	if h := req.Header.Get("Hbuf-Id"); h != "" {
-		id, err = strconv.Atoi(h)
+	if replica {
+		id, err = strconv.Atoi(req.Header.Get("Hbuf-Id"))
 		if err != nil {
 			return &router.Response{
 				Error:      fmt.Errorf("error parsing Hbuf-Id header: %v", err),
@@ -264,7 +763,7 @@ func (w *Worker) handleWriteToBuffer(req *http.Request) *router.Response {
 		}
 	}
 	ts := time.Now().UTC()
-	if h := req.Header.Get("Hbuf-Ts"); h != "" {
+	if h := req.Header.Get("Hbuf-Ts"); replica && h != "" {
 		ts, err = time.Parse(time.RFC3339Nano, h)
 		if err != nil {
 			return &router.Response{
@@ -274,16 +773,56 @@ func (w *Worker) handleWriteToBuffer(req *http.Request) *router.Response {
 		}
 	}
 	m := &message.Message{
-		ID:   id,
-		TS:   ts,
-		Type: req.Header.Get("Content-Type"),
-		Body: body,
+		ID:       id,
+		TS:       ts,
+		Type:     req.Header.Get("Content-Type"),
+		Body:     body,
+		Encoding: req.Header.Get("Content-Encoding"),
+	}
+	if !replica {
+		t := trace.FromContext(req.Context())
+		m.RequestID, m.Trace = t.RequestID, t.Traceparent()
+	} else {
+		// replicas store messages as they were on the primary
+		m.RequestID = req.Header.Get(trace.RequestIDHeader)
+		m.Trace = req.Header.Get(trace.TraceparentHeader)
+	}
+	if !replica {
+		// quotas apply to producers; writes from replication must get
+		// through for replicas to stay in sync
+		if resp := w.checkQuotas(len(body)); resp != nil {
+			return resp
+		}
+		// producers may send bodies compressed; replicas store messages as
+		// they were on the primary, so only producer writes are compressed
+		if resp := checkEncoding(m, b.MessageMaxBytes); resp != nil {
+			return resp
+		}
+		err = b.Compress(m)
+	}
+	if err == nil {
+		err = b.Write(m)
+	}
+	if err == buffer.ErrorBufferSealed {
+		return &router.Response{
+			Error:      fmt.Errorf("error writing message body: %v", err),
+			StatusCode: http.StatusConflict,
+		}
 	}
-	if err := b.Write(m); err != nil {
+	if err == buffer.ErrorMessageSize {
+		return &router.Response{
+			Error:      fmt.Errorf("error writing message body: %v", err),
+			StatusCode: http.StatusRequestEntityTooLarge,
+		}
+	}
+	if err != nil {
 		// theoretically the buffer may have been destroyed in the mean time
-		log.Printf("error writing message body to disk: %v", err)
+		w.log.With(trace.FromContext(req.Context()).Fields()...).Errorf("error writing message body to disk: %v", err)
 		return &router.Response{Error: fmt.Errorf("error writing message body: %v", err)}
 	}
+	if !replica {
+		w.count(produceMessages, produceBytes, b, len(body))
+	}
 	j, _ := json.Marshal(m)
 	return &router.Response{Body: j}
 }
@@ -308,7 +847,91 @@ func (w *Worker) handleReadFromBuffer(req *http.Request) *router.Response {
 	if err != nil {
 		return &router.Response{Error: fmt.Errorf("error reading from buffer %q: %v", buffer, err)}
 	}
-	return &router.Response{Body: m.Body, ContentType: m.Type}
+	return messageResponse(req, m)
+}
+
+// checkQuotas returns an error response if writing n bytes would exceed the
+// tenant's produce rate or storage quota; otherwise the bytes are charged
+// against the produce rate. Storage used on other workers is as they last
+// reported it to the controller; on this worker it is current.
+func (w *Worker) checkQuotas(n int) *router.Response {
+	//
+	w.aclLock.Lock()
+	status := w.quotas
+	w.aclLock.Unlock()
+	if status == nil || status.Quotas == nil {
+		return nil
+	}
+	q := status.Quotas
+	if d := w.produce.Wait(); d > 0 {
+		return quota.Exceeded(http.StatusTooManyRequests, d, fmt.Errorf("produce rate of tenant %q over %d bytes/s", w.Tenant, q.ProduceBytesPerSec))
+	}
+	if q.MaxBytes > 0 && status.Usage != nil {
+		used := status.Usage.Bytes - status.Usage.Workers[w.ID] + atomic.LoadInt64(&w.used)
+		if used+int64(n) > q.MaxBytes {
+			return quota.Exceeded(http.StatusInsufficientStorage, RegisterInterval, fmt.Errorf("tenant %q uses %d bytes, max_bytes is %d", w.Tenant, used, q.MaxBytes))
+		}
+	}
+	w.produce.Take(n)
+	return nil
+}
+
+// checkEncoding checks that the body of a message sent compressed by a
+// producer decompresses, and isn't larger than max when decompressed.
+func checkEncoding(m *message.Message, max int32) *router.Response {
+	//
+	if m.Encoding == "" {
+		return nil
+	}
+	// decompressed no further than max, so that a small body can't make the
+	// worker allocate much more
+	_, err := codec.DecodeMax(m.Encoding, m.Body, int(max))
+	if err == codec.ErrorTooLarge {
+		return &router.Response{
+			Error:      fmt.Errorf("error writing message body: %v", buffer.ErrorMessageSize),
+			StatusCode: http.StatusRequestEntityTooLarge,
+		}
+	}
+	if err != nil {
+		return &router.Response{
+			Error:      fmt.Errorf("error decoding message body with Content-Encoding %q: %v", m.Encoding, err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// messageResponse returns the body of m compressed, as it is stored, if the
+// request's Accept-Encoding allows it, and decompressed otherwise.
+func messageResponse(req *http.Request, m *message.Message) *router.Response {
+	//
+	header := messageHeader(m)
+	if m.Encoding == "" {
+		return &router.Response{Body: m.Body, ContentType: m.Type, Header: header}
+	}
+	if codec.Accepts(req.Header.Get("Accept-Encoding"), m.Encoding) {
+		header.Set("Content-Encoding", m.Encoding)
+		return &router.Response{Body: m.Body, ContentType: m.Type, Header: header}
+	}
+	body, err := codec.Decode(m.Encoding, m.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error decompressing message %d: %v", m.ID, err)}
+	}
+	return &router.Response{Body: body, ContentType: m.Type, Header: header}
+}
+
+// messageHeader returns headers identifying the request which produced m, so
+// that consumers can tell.
+func messageHeader(m *message.Message) http.Header {
+	//
+	h := make(http.Header)
+	if m.RequestID != "" {
+		h.Set(message.RequestIDHeader, m.RequestID)
+	}
+	if m.Trace != "" {
+		h.Set(message.TraceparentHeader, m.Trace)
+	}
+	return h
 }
 
 func (w *Worker) handleConsumeFromBuffer(req *http.Request) *router.Response {
@@ -332,10 +955,11 @@ func (w *Worker) handleConsumeFromBuffer(req *http.Request) *router.Response {
 		return &router.Response{StatusCode: http.StatusNoContent}
 	}
 	if err != nil {
-		log.Printf("error consuming from buffer %q, consumer id %q: %v", buffer, consumer, err)
+		w.log.Errorf("error consuming from buffer %q, consumer id %q: %v", buffer, consumer, err)
 		return &router.Response{Error: fmt.Errorf("error consuming from buffer: %v", err)}
 	}
-	return &router.Response{Body: m.Body, ContentType: m.Type}
+	w.count(consumeMessages, consumeBytes, b, len(m.Body))
+	return messageResponse(req, m)
 }
 
 func (w *Worker) handleGetOffsets(req *http.Request) *router.Response {
@@ -348,3 +972,21 @@ func (w *Worker) handleGetOffsets(req *http.Request) *router.Response {
 	}
 	return &router.Response{Body: b.Consumers()}
 }
+
+func (w *Worker) handleSetOffsets(req *http.Request) *router.Response {
+	//
+	w.lock.Lock()
+	b, ok := w.buffers[mux.Vars(req)["buffer"]]
+	w.lock.Unlock()
+	if !ok {
+		return &router.Response{StatusCode: http.StatusNotFound}
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return &router.Response{Error: fmt.Errorf("error reading consumer offsets: %v", err)}
+	}
+	if err := b.SetConsumers(body); err != nil {
+		return &router.Response{Error: err, StatusCode: http.StatusBadRequest}
+	}
+	return &router.Response{StatusCode: http.StatusOK}
+}